@@ -0,0 +1,386 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	backupManifestFile = "manifest.json"
+	backupIdFormat     = "20060102-150405"
+
+	// Number of backups kept in each sandbox, older ones are pruned
+	defaultBackupRetention = 10
+)
+
+// A record of the changes in the sandbox that were backed up before an
+// operation that could overwrite them. Each backup is kept in its own
+// directory named after its ID.
+type backupManifest struct {
+	Id        string
+	Time      time.Time
+	Operation string
+	Changes   []statusChange
+}
+
+// Backups are identified by the time they were taken
+func newBackupId(sandboxPath string) string {
+	base := time.Now().Format(backupIdFormat)
+	id := base
+
+	for i := 2; ; i++ {
+		_, err := os.Stat(filepath.Join(sandboxPath, backupFolder, id))
+		if os.IsNotExist(err) {
+			return id
+		}
+
+		id = fmt.Sprintf("%v-%v", base, i)
+	}
+}
+
+// The subcommand being run and its arguments, to record which operation
+// took a backup or holds a lock. This must be called before the subcommand
+// takes its own arguments off of os.Args.
+func commandLine() string {
+	return strings.Join(os.Args, " ")
+}
+
+// Find the changes in the sandbox and back them up before the operation
+// overwrites them. If any paths (relative to the sandbox) are provided then
+// only those files and directories are backed up.
+func scmBackup(sandboxPath string, operation string, filter []string) (*status, error) {
+	status, err := scmStatusPaths(sandboxPath, BACKUP, false, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	if !status.unchanged() {
+		err = status.writeBackupManifest(operation)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return status, nil
+}
+
+// Record the changes that were copied into the backup of the status
+func (status *status) writeBackupManifest(operation string) error {
+	manifest := backupManifest{
+		Id:        filepath.Base(status.copyPath),
+		Time:      time.Now(),
+		Operation: operation,
+		Changes:   status.changes(),
+	}
+
+	err := os.MkdirAll(status.copyPath, 0700)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(status.copyPath, backupManifestFile), b, 0600)
+}
+
+// The backups of the sandbox from oldest to newest
+func listBackups(sandboxPath string) ([]backupManifest, error) {
+	backups := []backupManifest{}
+
+	entries, err := ioutil.ReadDir(filepath.Join(sandboxPath, backupFolder))
+	if os.IsNotExist(err) {
+		return backups, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		b, err := ioutil.ReadFile(filepath.Join(sandboxPath, backupFolder, entry.Name(), backupManifestFile))
+		if err != nil {
+			// Not a backup, perhaps left over from before there was a history
+			continue
+		}
+
+		manifest := backupManifest{}
+		err = json.Unmarshal(b, &manifest)
+		if err != nil {
+			return nil, err
+		}
+
+		backups = append(backups, manifest)
+	}
+
+	sort.Sort(byBackupTime(backups))
+
+	return backups, nil
+}
+
+func findBackup(sandboxPath string, id string) (backupManifest, error) {
+	backups, err := listBackups(sandboxPath)
+	if err != nil {
+		return backupManifest{}, err
+	}
+
+	for _, backup := range backups {
+		if backup.Id == id {
+			return backup, nil
+		}
+	}
+
+	return backupManifest{}, simpleWarning("Backup with ID " + id + " not found. Use 'gojazz backups' to list them.")
+}
+
+// Remove the oldest backups so that only the newest ones are kept. The IDs
+// of the backups that were removed are returned.
+func pruneBackups(sandboxPath string, keep int) ([]string, error) {
+	backups, err := listBackups(sandboxPath)
+	if err != nil {
+		return nil, err
+	}
+
+	pruned := []string{}
+	for idx := 0; idx < len(backups)-keep; idx++ {
+		err = os.RemoveAll(filepath.Join(sandboxPath, backupFolder, backups[idx].Id))
+		if err != nil {
+			return pruned, err
+		}
+
+		pruned = append(pruned, backups[idx].Id)
+	}
+
+	return pruned, nil
+}
+
+type byBackupTime []backupManifest
+
+func (backups byBackupTime) Len() int {
+	return len(backups)
+}
+
+func (backups byBackupTime) Less(i, j int) bool {
+	return backups[i].Time.Before(backups[j].Time)
+}
+
+func (backups byBackupTime) Swap(i, j int) {
+	backups[i], backups[j] = backups[j], backups[i]
+}
+
+func backupsDefaults() {
+	fmt.Printf("gojazz backups [options]\n")
+	flag.PrintDefaults()
+}
+
+func backupsOp() {
+	sandboxPath := flag.String("sandbox", "", "Location of the sandbox")
+	prune := flag.Bool("prune", false, "Remove the oldest backups.")
+	keep := flag.Int("keep", defaultBackupRetention, "Number of backups to keep when pruning.")
+	flag.Usage = backupsDefaults
+	flag.Parse()
+
+	if *sandboxPath == "" {
+		path, err := os.Getwd()
+		if err != nil {
+			panic(err)
+		}
+
+		path = findSandbox(path)
+		sandboxPath = &path
+	}
+
+	if *prune {
+		pruned, err := pruneBackups(*sandboxPath, *keep)
+		if err != nil {
+			panic(err)
+		}
+
+		for _, id := range pruned {
+			fmt.Printf("%v (Removed)\n", id)
+		}
+		return
+	}
+
+	backups, err := listBackups(*sandboxPath)
+	if err != nil {
+		panic(err)
+	}
+
+	if len(backups) == 0 {
+		fmt.Println("No backups")
+		return
+	}
+
+	for _, backup := range backups {
+		fmt.Printf("%v  %v  before %v, %v\n", backup.Id, backup.Time.Format("2006-01-02 15:04:05"), backup.Operation, plural(len(backup.Changes), "change"))
+	}
+}
+
+func restoreDefaults() {
+	fmt.Printf("gojazz restore <backup ID> [options] [paths...]\n")
+	flag.PrintDefaults()
+}
+
+func restoreOp() {
+	operation := commandLine()
+	var id string
+
+	// Backup ID provided
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		id = os.Args[1]
+		os.Args = os.Args[1:]
+	}
+
+	sandboxPath := flag.String("sandbox", "", "Location of the sandbox")
+	wait := flag.Duration("wait", 0, "How long to wait for another operation on the sandbox to finish instead of failing right away.")
+	flag.Usage = restoreDefaults
+	flag.Parse()
+
+	if id == "" {
+		fmt.Println("Provide the ID of the backup to restore and try again. Use 'gojazz backups' to list them.")
+		restoreDefaults()
+		return
+	}
+
+	if *sandboxPath == "" {
+		path, err := os.Getwd()
+		if err != nil {
+			panic(err)
+		}
+
+		path = findSandbox(path)
+		sandboxPath = &path
+	}
+
+	lock, err := lockSandbox(*sandboxPath, operation, *wait)
+	if err != nil {
+		panic(err)
+	}
+	defer lock.unlock()
+
+	backup, err := findBackup(*sandboxPath, id)
+	if err != nil {
+		panic(err)
+	}
+
+	filter, err := sandboxRelativePaths(*sandboxPath, flag.Args())
+	if err != nil {
+		panic(err)
+	}
+
+	// Files about to be overwritten are backed up too
+	status, err := scmBackup(*sandboxPath, operation, filter)
+	if err != nil {
+		panic(err)
+	}
+
+	restored := scmRestore(*sandboxPath, backup, filter)
+	if len(restored) == 0 {
+		fmt.Println("Nothing to restore.")
+	}
+
+	if !status.unchanged() {
+		fmt.Printf("The previous contents of your sandbox have been backed up to this location: %v\n", status.copyPath)
+	}
+}
+
+// Copy the files in a backup back into the sandbox. If any paths (relative
+// to the sandbox) are provided then only those files and directories are
+// restored. The paths that were restored are returned.
+func scmRestore(sandboxPath string, backup backupManifest, filter []string) []string {
+	scope := &status{filter: filter}
+	backupPath := filepath.Join(sandboxPath, backupFolder, backup.Id)
+	restored := []string{}
+
+	for _, change := range backup.Changes {
+		// Deleted files weren't backed up
+		if change.Kind == "Deleted" {
+			continue
+		}
+
+		if inside, _ := scope.inScope(change.Path); !inside {
+			continue
+		}
+
+		source := filepath.Join(backupPath, change.Path)
+		target := filepath.Join(sandboxPath, change.Path)
+
+		info, err := os.Stat(source)
+		if err != nil {
+			fmt.Printf("%v (Missing from the backup)\n", change.Path)
+			continue
+		}
+
+		// A folder that was moved is recorded as a single change, everything
+		//  underneath it was backed up too
+		if info.IsDir() {
+			err = copyTree(source, target)
+		} else {
+			err = copyFile(source, target)
+		}
+		if err != nil {
+			panic(err)
+		}
+
+		fmt.Printf("%v (Restored)\n", change.Path)
+		restored = append(restored, change.Path)
+	}
+
+	return restored
+}
+
+// Copy a folder and everything underneath it
+func copyTree(source string, target string) error {
+	return filepath.Walk(source, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(source, p)
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			return os.MkdirAll(filepath.Join(target, rel), 0700)
+		}
+
+		return copyFile(p, filepath.Join(target, rel))
+	})
+}
+
+func copyFile(source string, target string) error {
+	err := os.MkdirAll(filepath.Dir(target), 0700)
+	if err != nil {
+		return err
+	}
+
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	return err
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	baseFolder = ".jazzbase"
+)
+
+// The base store keeps a pristine copy of each file as it was last loaded so
+// that local changes can be merged with incoming ones, compared and reverted
+// without contacting the server. Objects are named after the SHA-1 hash
+// recorded in the metadata, so identical files share a single copy, and are
+// compressed with gzip.
+func baseObjectPath(sandboxPath string, hash string) (string, error) {
+	sum, err := base64.StdEncoding.DecodeString(hash)
+	if err != nil {
+		return "", err
+	}
+
+	name := hex.EncodeToString(sum)
+	if len(name) < 3 {
+		return "", simpleWarning("Invalid content hash " + hash)
+	}
+
+	return filepath.Join(sandboxPath, baseFolder, name[:2], name[2:]), nil
+}
+
+// Writes a new object to a temporary file in the base store. Once the
+// contents are written and the hash is known it is moved into place with
+// commit.
+type baseWriter struct {
+	sandboxPath string
+	file        *os.File
+	compressor  *gzip.Writer
+}
+
+func createBaseWriter(sandboxPath string) (*baseWriter, error) {
+	dir := filepath.Join(sandboxPath, baseFolder)
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := ioutil.TempFile(dir, "tmp")
+	if err != nil {
+		return nil, err
+	}
+
+	return &baseWriter{sandboxPath: sandboxPath, file: file, compressor: gzip.NewWriter(file)}, nil
+}
+
+func (writer *baseWriter) Write(p []byte) (int, error) {
+	return writer.compressor.Write(p)
+}
+
+func (writer *baseWriter) commit(hash string) error {
+	err := writer.compressor.Close()
+	writer.file.Close()
+	if err != nil {
+		writer.abort()
+		return err
+	}
+
+	objectPath, err := baseObjectPath(writer.sandboxPath, hash)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(objectPath), 0700)
+	}
+	if err == nil {
+		err = os.Rename(writer.file.Name(), objectPath)
+	}
+	if err != nil {
+		writer.abort()
+	}
+
+	return err
+}
+
+func (writer *baseWriter) abort() {
+	writer.file.Close()
+	os.Remove(writer.file.Name())
+}
+
+// Store the contents with the given hash in the base store
+func storeBase(sandboxPath string, hash string, contents io.Reader) error {
+	writer, err := createBaseWriter(sandboxPath)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(writer, contents)
+	if err != nil {
+		writer.abort()
+		return err
+	}
+
+	return writer.commit(hash)
+}
+
+// Make sure that the base version of an unmodified file is in the store.
+// Sandboxes loaded before there was a base store fill it in gradually this way.
+func ensureBase(sandboxPath string, meta metaObject) error {
+	if meta.Hash == "" {
+		return nil
+	}
+
+	if hasBase(sandboxPath, meta.Hash) {
+		return nil
+	}
+
+	file, err := os.Open(meta.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return storeBase(sandboxPath, meta.Hash, file)
+}
+
+func readBase(sandboxPath string, hash string) ([]byte, error) {
+	objectPath, err := baseObjectPath(sandboxPath, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(objectPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader, err := gzip.NewReader(file)
+	if err == gzip.ErrHeader {
+		// Objects stored before compression was added
+		return ioutil.ReadFile(objectPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return ioutil.ReadAll(reader)
+}
+
+// Check whether the pristine copy of a file is available
+func hasBase(sandboxPath string, hash string) bool {
+	objectPath, err := baseObjectPath(sandboxPath, hash)
+	if err != nil {
+		return false
+	}
+
+	_, err = os.Stat(objectPath)
+	return err == nil
+}
+
+// Remove any objects from the base store that are no longer referenced
+// by the metadata or a stash, along with temporary files left behind by an
+// interrupted load. The whole store goes if the sandbox doesn't keep
+// pristine copies.
+func pruneBase(sandboxPath string, metadata *metaData) error {
+	if metadata.noPristine {
+		return os.RemoveAll(filepath.Join(sandboxPath, baseFolder))
+	}
+
+	hashes := []string{}
+	for _, meta := range metadata.pathMap {
+		hashes = append(hashes, meta.Hash)
+	}
+
+	// Stashes are applied by merging with the version they were stashed from
+	stashes, err := listStashes(sandboxPath)
+	if err != nil {
+		return err
+	}
+	for _, stash := range stashes {
+		for _, entry := range stash.Entries {
+			hashes = append(hashes, entry.BaseHash)
+		}
+	}
+
+	referenced := make(map[string]bool)
+	for _, hash := range hashes {
+		if hash == "" {
+			continue
+		}
+
+		objectPath, err := baseObjectPath(sandboxPath, hash)
+		if err != nil {
+			return err
+		}
+		referenced[objectPath] = true
+	}
+
+	storePath := filepath.Join(sandboxPath, baseFolder)
+
+	return filepath.Walk(storePath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if info.IsDir() || referenced[p] {
+			return nil
+		}
+
+		return os.Remove(p)
+	})
+}
@@ -1,16 +1,30 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/base64"
 	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"os/exec"
 	"path"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 var (
@@ -154,11 +168,11 @@ func TestLoadAndClobberChanges(t *testing.T) {
 		}
 	}
 
-	os.Args = []string{"load", "-sandbox=" + sandbox1}
+	os.Args = []string{"load", "-sandbox=" + sandbox1, "-clobber"}
 	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
 	loadOp()
 
-	status, err := scmStatus(sandbox1, NO_COPY)
+	status, err := scmStatus(sandbox1, NO_COPY, false)
 	if err != nil {
 		t.Fatalf("%v", err.Error())
 	}
@@ -167,10 +181,14 @@ func TestLoadAndClobberChanges(t *testing.T) {
 	}
 
 	// Check that all of the files and folders made their way into the backup
+	backups, err := listBackups(sandbox1)
+	if err != nil || len(backups) != 1 {
+		t.Fatalf("Expected one backup: %v %v", backups, err)
+	}
 	for _, file := range testContentsWithoutIgnoredStuff {
 		file = filepath.FromSlash(file)
 
-		path := filepath.Join(sandbox1, backupFolder, file)
+		path := filepath.Join(sandbox1, backupFolder, backups[len(backups)-1].Id, file)
 		s, _ := os.Stat(path)
 		if s == nil {
 			t.Fatalf("File not found in backup: %v", path)
@@ -494,11 +512,11 @@ func TestWorkspaceLoadAndClobberChanges(t *testing.T) {
 		}
 	}
 
-	os.Args = []string{"load", "-sandbox=" + sandbox1}
+	os.Args = []string{"load", "-sandbox=" + sandbox1, "-clobber"}
 	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
 	loadOp()
 
-	status, err := scmStatus(sandbox1, NO_COPY)
+	status, err := scmStatus(sandbox1, NO_COPY, false)
 	if err != nil {
 		t.Fatalf("%v", err.Error())
 	}
@@ -507,10 +525,14 @@ func TestWorkspaceLoadAndClobberChanges(t *testing.T) {
 	}
 
 	// Check that all of the files and folders made their way into the backup
+	backups, err := listBackups(sandbox1)
+	if err != nil || len(backups) != 1 {
+		t.Fatalf("Expected one backup: %v %v", backups, err)
+	}
 	for _, file := range testContentsWithoutIgnoredStuff {
 		file = filepath.FromSlash(file)
 
-		path := filepath.Join(sandbox1, backupFolder, file)
+		path := filepath.Join(sandbox1, backupFolder, backups[len(backups)-1].Id, file)
 		s, _ := os.Stat(path)
 		if s == nil {
 			t.Fatalf("File not found in backup: %v", path)
@@ -626,7 +648,7 @@ func TestLocalChangeDetection(t *testing.T) {
 		}
 	}
 
-	status, err := scmStatus(sandbox1, NO_COPY)
+	status, err := scmStatus(sandbox1, NO_COPY, false)
 	if err != nil {
 		panic(err)
 	}
@@ -741,7 +763,7 @@ func TestModificationSameSize(t *testing.T) {
 		return
 	}
 
-	status, err := scmStatus(sandbox1, NO_COPY)
+	status, err := scmStatus(sandbox1, NO_COPY, false)
 	if err != nil {
 		panic(err)
 	}
@@ -807,7 +829,7 @@ func TestModificationSameContents(t *testing.T) {
 	tmpFile.Close()
 	projectJson.Close()
 
-	status, err := scmStatus(sandbox1, NO_COPY)
+	status, err := scmStatus(sandbox1, NO_COPY, false)
 	if err != nil {
 		panic(err)
 	}
@@ -912,7 +934,7 @@ func TestCheckins(t *testing.T) {
 		}
 	}
 
-	status, err := scmStatus(sandbox1, NO_COPY)
+	status, err := scmStatus(sandbox1, NO_COPY, false)
 	if err != nil {
 		panic(err)
 	}
@@ -1028,7 +1050,7 @@ func TestCheckins(t *testing.T) {
 		panic(err)
 	}
 
-	status, err = scmStatus(sandbox1, NO_COPY)
+	status, err = scmStatus(sandbox1, NO_COPY, false)
 	if err != nil {
 		panic(err)
 	}
@@ -1037,6 +1059,73 @@ func TestCheckins(t *testing.T) {
 	}
 }
 
+func TestCheckinKeepsFastPath(t *testing.T) {
+	sandbox1 := createTestSandbox(map[string]string{"file1.txt": "file1\n"})
+	defer os.RemoveAll(sandbox1)
+
+	file1 := filepath.Join(sandbox1, "file1.txt")
+	err := ioutil.WriteFile(file1, []byte("changed\n"), 0600)
+	if err != nil {
+		panic(err)
+	}
+	past := time.Now().Add(-time.Minute)
+	err = os.Chtimes(file1, past, past)
+	if err != nil {
+		panic(err)
+	}
+
+	status, err := scmStatus(sandbox1, STAGE, false)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+	if !status.Modified["file1.txt"] {
+		t.Fatalf("Expected a modification, got: %v", status)
+	}
+
+	// The server answers the upload with the new state of the file
+	ccmBaseUrl := "https://hub.example.com/ccm"
+	remoteFile := &File{url: assembleOFSUrl(ccmBaseUrl, "_ws", "_comp", "/file1.txt")}
+	remoteFile.info.ScmInfo = ScmInfo{ComponentId: "_comp", ItemId: "item-file1.txt"}
+	client, err := NewClient("", "")
+	if err != nil {
+		panic(err)
+	}
+	client.httpClient.Transport = &syntheticTransport{responses: map[string]string{
+		"/ccm/service/com.ibm.team.filesystem.service.jazzhub.IOrionFilesystem/pa/_/_ws/_comp/file1.txt?op=writeContent": `{"Name": "file1.txt", "RTCSCM": {"ComponentId": "_comp", "ItemId": "item-file1.txt", "StateId": "_s2"}}`,
+	}}
+	remoteFile.client = client
+
+	newmeta := checkinFile(client, filepath.Join(sandbox1, stageFolder, "file1.txt"), status.staged["file1.txt"], remoteFile)
+	newmeta.Path = file1
+	if newmeta.StateId != "_s2" {
+		t.Errorf("Unexpected state: %v", newmeta.StateId)
+	}
+	status.metaData.simplePut(newmeta, sandbox1)
+	err = status.metaData.save(filepath.Join(sandbox1, metadataFileName))
+	if err != nil {
+		panic(err)
+	}
+
+	// Contents that change without a new size or modification time are
+	//  only missed if the stat information of the sandbox file was kept
+	err = ioutil.WriteFile(file1, []byte("CHANGED\n"), 0600)
+	if err != nil {
+		panic(err)
+	}
+	err = os.Chtimes(file1, past, past)
+	if err != nil {
+		panic(err)
+	}
+
+	status, err = scmStatus(sandbox1, NO_COPY, false)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+	if !status.unchanged() {
+		t.Errorf("The checked in file was hashed again: %v", status)
+	}
+}
+
 func TestUUIDUniqueness(t *testing.T) {
 	idMap := make(map[string]bool)
 
@@ -1051,3 +1140,2645 @@ func TestUUIDUniqueness(t *testing.T) {
 		}
 	}
 }
+
+func TestIgnorePolicy(t *testing.T) {
+	sandbox1, err := ioutil.TempDir(os.TempDir(), "gojazz-test")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(sandbox1)
+
+	files := map[string]int{
+		"bin/script.sh":      10,
+		"build/output.o":     10,
+		"src/main.o":         10,
+		"src/main.c":         10,
+		"src/big.dat":        2048,
+		"src/allowed.dat":    2048,
+		"folder/file.exe":    10,
+		"folder/file.txt~":   10,
+		"folder/notes.txt":   10,
+		metadataFileName:     10,
+		sandboxIgnoreFile:    0,
+		"deep/bin/other.txt": 10,
+		"src/main.c.remote":  10,
+		"lone.remote":        10,
+		"config":             10,
+		"config.remote":      10,
+	}
+
+	for file, size := range files {
+		p := filepath.Join(sandbox1, filepath.FromSlash(file))
+		err = os.MkdirAll(filepath.Dir(p), 0700)
+		if err != nil {
+			panic(err)
+		}
+		err = ioutil.WriteFile(p, make([]byte, size), 0600)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	err = ioutil.WriteFile(filepath.Join(sandbox1, sandboxIgnoreFile), []byte("# Test rules\n!bin\nbuild/\n*.o\n!src/allowed.dat\nmaxsize 1KB\n"), 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	policy, err := loadIgnorePolicy(sandbox1)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+	policy.conflicted = func(rel string) bool { return rel == filepath.Join("src", "main.c") }
+
+	expected := map[string]bool{
+		"bin/script.sh":      false,
+		"build/output.o":     true,
+		"src/main.o":         true,
+		"src/main.c":         false,
+		"src/big.dat":        true,
+		"src/allowed.dat":    false,
+		"folder/file.exe":    true,
+		"folder/file.txt~":   true,
+		"folder/notes.txt":   false,
+		metadataFileName:     true,
+		sandboxIgnoreFile:    false,
+		"deep/bin/other.txt": false,
+		"src/main.c.remote":  true,
+		"lone.remote":        false,
+		"config":             false,
+		"config.remote":      false,
+	}
+
+	for file, shouldIgnore := range expected {
+		ignored, reason, err := policy.check(filepath.Join(sandbox1, filepath.FromSlash(file)))
+		if err != nil {
+			t.Fatalf("%v", err.Error())
+		}
+		if ignored != shouldIgnore {
+			t.Errorf("Expected ignored=%v for %v but got %v (%v)", shouldIgnore, file, ignored, reason)
+		}
+	}
+
+	_, reason, _ := policy.check(filepath.Join(sandbox1, "src", "big.dat"))
+	if reason != policy.sizeReason() {
+		t.Errorf("Expected the size limit to be the reason for ignoring a large file, got %v", reason)
+	}
+}
+
+func TestConflictSideFiles(t *testing.T) {
+	sandbox1 := createTestSandbox(map[string]string{"config": "config\n"})
+	defer os.RemoveAll(sandbox1)
+
+	config := filepath.Join(sandbox1, "config")
+	for _, suffix := range []string{remoteSuffix, stashSuffix} {
+		err := ioutil.WriteFile(config+suffix, []byte("other\n"), 0600)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	// Files of the user that only look like the other version of a file
+	status, err := scmStatus(sandbox1, NO_COPY, false)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+	if !status.Added["config"+remoteSuffix] || !status.Added["config"+stashSuffix] {
+		t.Errorf("Files without a conflict were not reported as added: %v", status)
+	}
+
+	metadata := newMetaData()
+	err = metadata.load(filepath.Join(sandbox1, metadataFileName))
+	if err != nil {
+		panic(err)
+	}
+	meta := metadata.pathMap["config"]
+	meta.Conflict = true
+	metadata.pathMap["config"] = meta
+	err = metadata.save(filepath.Join(sandbox1, metadataFileName))
+	if err != nil {
+		panic(err)
+	}
+
+	status, err = scmStatus(sandbox1, NO_COPY, false)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+	if len(status.Added) != 0 || status.Ignored["config"+remoteSuffix] != conflictFileReason {
+		t.Errorf("The other versions of a file with a conflict were not ignored: %v", status)
+	}
+}
+
+// Create a sandbox with the provided files and metadata recording them as
+// loaded, without contacting the server.
+func createTestSandbox(files map[string]string) string {
+	sandbox, err := ioutil.TempDir(os.TempDir(), "gojazz-test")
+	if err != nil {
+		panic(err)
+	}
+
+	metadata := newMetaData()
+	past := time.Now().Add(-time.Hour)
+
+	for file, contents := range files {
+		p := filepath.Join(sandbox, filepath.FromSlash(file))
+
+		// Record the parent directories too, just like a load
+		for dir := filepath.Dir(p); dir != sandbox; dir = filepath.Dir(dir) {
+			metadata.simplePut(metaObject{Path: dir, ItemId: "dir-" + dir}, sandbox)
+		}
+
+		err = os.MkdirAll(filepath.Dir(p), 0700)
+		if err != nil {
+			panic(err)
+		}
+		err = ioutil.WriteFile(p, []byte(contents), 0600)
+		if err != nil {
+			panic(err)
+		}
+		err = os.Chtimes(p, past, past)
+		if err != nil {
+			panic(err)
+		}
+
+		hash := sha1.Sum([]byte(contents))
+		meta := metaObject{Path: p, ItemId: "item-" + file, StateId: "state-" + file, Hash: base64.StdEncoding.EncodeToString(hash[:])}
+		s, err := os.Stat(p)
+		if err != nil {
+			panic(err)
+		}
+		meta.setStat(s)
+		metadata.simplePut(meta, sandbox)
+
+		err = storeBase(sandbox, meta.Hash, strings.NewReader(contents))
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	err = metadata.save(filepath.Join(sandbox, metadataFileName))
+	if err != nil {
+		panic(err)
+	}
+
+	return sandbox
+}
+
+func TestStatusFastPath(t *testing.T) {
+	sandbox1 := createTestSandbox(map[string]string{
+		"README.md":        "readme",
+		"folder/file1.txt": "file1",
+		"folder/file2.txt": "file2",
+	})
+	defer os.RemoveAll(sandbox1)
+
+	status, err := scmStatus(sandbox1, NO_COPY, false)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+	if !status.unchanged() {
+		t.Fatalf("Expected no changes, got these instead: %v", status)
+	}
+
+	// Change the contents without changing the size or modification time.
+	//  The fast path trusts the stat information so this is not noticed
+	//  unless every file is hashed.
+	file1 := filepath.Join(sandbox1, "folder", "file1.txt")
+	s, err := os.Stat(file1)
+	if err != nil {
+		panic(err)
+	}
+	err = ioutil.WriteFile(file1, []byte("FILE1"), 0600)
+	if err != nil {
+		panic(err)
+	}
+	err = os.Chtimes(file1, s.ModTime(), s.ModTime())
+	if err != nil {
+		panic(err)
+	}
+
+	status, err = scmStatus(sandbox1, NO_COPY, false)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+	if !status.unchanged() {
+		t.Errorf("Expected the stat information to be trusted, got these changes: %v", status)
+	}
+
+	status, err = scmStatus(sandbox1, NO_COPY, true)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+	if !status.Modified[filepath.Join("folder", "file1.txt")] {
+		t.Errorf("Expected a modification with a full status, got: %v", status)
+	}
+
+	// A racy file has a modification time that isn't older than the metadata
+	//  so it must be hashed even when the stat information matches.
+	file2 := filepath.Join(sandbox1, "folder", "file2.txt")
+	err = ioutil.WriteFile(file2, []byte("FILE2"), 0600)
+	if err != nil {
+		panic(err)
+	}
+	future := time.Now().Add(time.Hour)
+	err = os.Chtimes(file2, future, future)
+	if err != nil {
+		panic(err)
+	}
+
+	metadata := newMetaData()
+	err = metadata.load(filepath.Join(sandbox1, metadataFileName))
+	if err != nil {
+		panic(err)
+	}
+	meta, _ := metadata.get(file2, sandbox1)
+	s, err = os.Stat(file2)
+	if err != nil {
+		panic(err)
+	}
+	meta.setStat(s)
+	metadata.simplePut(meta, sandbox1)
+	err = metadata.save(filepath.Join(sandbox1, metadataFileName))
+	if err != nil {
+		panic(err)
+	}
+
+	status, err = scmStatus(sandbox1, NO_COPY, false)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+	if !status.Modified[filepath.Join("folder", "file2.txt")] {
+		t.Errorf("Expected a modification of a racy file, got: %v", status)
+	}
+}
+
+func createLargeTestSandbox(numDirs int, filesPerDir int) string {
+	files := make(map[string]string)
+
+	for d := 0; d < numDirs; d++ {
+		for f := 0; f < filesPerDir; f++ {
+			files[fmt.Sprintf("dir%v/sub%v/file%v.txt", d, d%7, f)] = strings.Repeat(fmt.Sprintf("line %v %v\n", d, f), 200)
+		}
+	}
+
+	return createTestSandbox(files)
+}
+
+func TestStatusDeterministic(t *testing.T) {
+	sandbox1 := createLargeTestSandbox(20, 20)
+	defer os.RemoveAll(sandbox1)
+
+	err := ioutil.WriteFile(filepath.Join(sandbox1, "dir3", "sub3", "file4.txt"), []byte("modified"), 0600)
+	if err != nil {
+		panic(err)
+	}
+	err = os.Remove(filepath.Join(sandbox1, "dir5", "sub5", "file5.txt"))
+	if err != nil {
+		panic(err)
+	}
+	err = os.MkdirAll(filepath.Join(sandbox1, "dir7", "added"), 0700)
+	if err != nil {
+		panic(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(sandbox1, "dir7", "added", "new.txt"), []byte("new"), 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	defer func(workers int) {
+		numStatusGoroutines = workers
+	}(numStatusGoroutines)
+
+	var first *status
+
+	for _, workers := range []int{1, 2, 8, 1, 8} {
+		numStatusGoroutines = workers
+
+		status, err := scmStatus(sandbox1, NO_COPY, true)
+		if err != nil {
+			t.Fatalf("%v", err.Error())
+		}
+
+		if len(status.Added) != 2 || len(status.Modified) != 1 || len(status.Deleted) != 1 {
+			t.Errorf("Unexpected status with %v workers: %v", workers, status)
+		}
+
+		if first == nil {
+			first = status
+			continue
+		}
+
+		if !reflect.DeepEqual(first.Added, status.Added) || !reflect.DeepEqual(first.Modified, status.Modified) || !reflect.DeepEqual(first.Deleted, status.Deleted) {
+			t.Errorf("Status with %v workers differs:\n%v\n%v", workers, first, status)
+		}
+	}
+}
+
+func benchmarkStatus(b *testing.B, workers int, full bool) {
+	sandbox1 := createLargeTestSandbox(100, 50)
+	defer os.RemoveAll(sandbox1)
+
+	defer func(workers int) {
+		numStatusGoroutines = workers
+	}(numStatusGoroutines)
+	numStatusGoroutines = workers
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := scmStatus(sandbox1, NO_COPY, full)
+		if err != nil {
+			b.Fatalf("%v", err.Error())
+		}
+	}
+}
+
+func BenchmarkStatusFullSingleWorker(b *testing.B) {
+	benchmarkStatus(b, 1, true)
+}
+
+func BenchmarkStatusFull(b *testing.B) {
+	benchmarkStatus(b, runtime.NumCPU(), true)
+}
+
+func BenchmarkStatusFastSingleWorker(b *testing.B) {
+	benchmarkStatus(b, 1, false)
+}
+
+func BenchmarkStatusFast(b *testing.B) {
+	benchmarkStatus(b, runtime.NumCPU(), false)
+}
+
+func TestRenameDetection(t *testing.T) {
+	sandbox1 := createTestSandbox(map[string]string{
+		"README.md":            "readme",
+		"notes.txt":            "notes",
+		"folder/file1.txt":     "file1",
+		"folder/sub/file2.txt": "file2",
+		"other/file3.txt":      "file3",
+		"other/file4.txt":      "file4",
+	})
+	defer os.RemoveAll(sandbox1)
+
+	// A rename in the same folder
+	err := os.Rename(filepath.Join(sandbox1, "notes.txt"), filepath.Join(sandbox1, "notes.md"))
+	if err != nil {
+		panic(err)
+	}
+	// A whole folder moved somewhere else
+	err = os.Mkdir(filepath.Join(sandbox1, "moved"), 0700)
+	if err != nil {
+		panic(err)
+	}
+	err = os.Rename(filepath.Join(sandbox1, "folder"), filepath.Join(sandbox1, "moved", "folder"))
+	if err != nil {
+		panic(err)
+	}
+	// A file moved to a new folder and a delete and add with different contents
+	err = os.Rename(filepath.Join(sandbox1, "other", "file3.txt"), filepath.Join(sandbox1, "moved", "file3.txt"))
+	if err != nil {
+		panic(err)
+	}
+	err = os.Remove(filepath.Join(sandbox1, "other", "file4.txt"))
+	if err != nil {
+		panic(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(sandbox1, "other", "file5.txt"), []byte("file5"), 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	status, err := scmStatus(sandbox1, NO_COPY, false)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+
+	expected := map[string]string{
+		"notes.txt":                         "notes.md",
+		"folder":                            filepath.Join("moved", "folder"),
+		filepath.Join("other", "file3.txt"): filepath.Join("moved", "file3.txt"),
+	}
+
+	if !reflect.DeepEqual(expected, status.Renamed) {
+		t.Errorf("Expected renames %v but got %v", expected, status.Renamed)
+	}
+
+	output := status.String()
+	for _, line := range []string{
+		"notes.md (Renamed from notes.txt)",
+		filepath.Join("moved", "folder") + " (Moved from folder)",
+		filepath.Join("other", "file4.txt") + " (Deleted)",
+		filepath.Join("other", "file5.txt") + " (Added)",
+		"moved (Added)",
+	} {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("Expected '%v' in the status output:\n%v", line, output)
+		}
+	}
+
+	if strings.Contains(output, filepath.Join("folder", "file1.txt")) {
+		t.Errorf("Files in a moved folder should not be listed separately:\n%v", output)
+	}
+}
+
+func TestStatusOutput(t *testing.T) {
+	sandbox1 := createTestSandbox(map[string]string{
+		"b.txt":          "b",
+		"c.txt":          "c",
+		"d.txt":          "d",
+		"src/main.c":     "main",
+		"src/util.c":     "util",
+		"docs/readme.md": "readme",
+	})
+	defer os.RemoveAll(sandbox1)
+
+	err := ioutil.WriteFile(filepath.Join(sandbox1, "a.txt"), []byte("new"), 0600)
+	if err != nil {
+		panic(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(sandbox1, "c.txt"), []byte("changed"), 0600)
+	if err != nil {
+		panic(err)
+	}
+	err = os.Remove(filepath.Join(sandbox1, "b.txt"))
+	if err != nil {
+		panic(err)
+	}
+	err = os.Rename(filepath.Join(sandbox1, "d.txt"), filepath.Join(sandbox1, "e.txt"))
+	if err != nil {
+		panic(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(sandbox1, "src", "util.c"), []byte("changed util"), 0600)
+	if err != nil {
+		panic(err)
+	}
+	err = os.Remove(filepath.Join(sandbox1, "docs", "readme.md"))
+	if err != nil {
+		panic(err)
+	}
+
+	status, err := scmStatus(sandbox1, NO_COPY, false)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+
+	expected := "A a.txt\nD b.txt\nM c.txt\nD docs/readme.md\nR d.txt -> e.txt\nM src/util.c\n"
+	if status.porcelain() != expected {
+		t.Errorf("Expected porcelain output:\n%v\nGot:\n%v", expected, status.porcelain())
+	}
+
+	// The output must be the same every time
+	for i := 0; i < 10; i++ {
+		again, err := scmStatus(sandbox1, NO_COPY, false)
+		if err != nil {
+			t.Fatalf("%v", err.Error())
+		}
+		if again.String() != status.String() {
+			t.Fatalf("Status output changed between runs:\n%v\n%v", status, again)
+		}
+	}
+
+	if status.summary() != "1 added, 2 modified, 2 deleted, 1 renamed\n" {
+		t.Errorf("Unexpected summary: %v", status.summary())
+	}
+
+	status, err = scmStatusPaths(sandbox1, NO_COPY, false, []string{"src", filepath.Join("docs", "readme.md")})
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+
+	expected = "D docs/readme.md\nM src/util.c\n"
+	if status.porcelain() != expected {
+		t.Errorf("Expected filtered porcelain output:\n%v\nGot:\n%v", expected, status.porcelain())
+	}
+}
+
+func TestIncomingChanges(t *testing.T) {
+	sandbox1, err := ioutil.TempDir(os.TempDir(), "gojazz-test")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(sandbox1)
+
+	t.Logf("Loading test project into %v\n", sandbox1)
+	os.Args = []string{"load", "sirnewton | gojazz-test", "-sandbox=" + sandbox1}
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	loadOp()
+
+	// Make the sandbox look like it was loaded from an older version of the stream
+	metadataFile := filepath.Join(sandbox1, metadataFileName)
+	metadata := newMetaData()
+	err = metadata.load(metadataFile)
+	if err != nil {
+		panic(err)
+	}
+
+	readme := metadata.pathMap["README.md"]
+	readme.StateId = "_oldState"
+	metadata.pathMap["README.md"] = readme
+	projectJson := metadata.pathMap["project.json"]
+	projectJson.StateId = "_oldState"
+	metadata.pathMap["project.json"] = projectJson
+	delete(metadata.pathMap, filepath.Join("folder", "file1.txt"))
+	metadata.pathMap["gone.txt"] = metaObject{Path: "gone.txt", ItemId: "_gone", StateId: "_gone", ComponentId: readme.ComponentId}
+
+	err = metadata.save(metadataFile)
+	if err != nil {
+		panic(err)
+	}
+
+	// A local change to one of the incoming modifications is a conflict
+	err = ioutil.WriteFile(filepath.Join(sandbox1, "README.md"), []byte("local change"), 0600)
+	if err != nil {
+		panic(err)
+	}
+	err = os.Remove(filepath.Join(sandbox1, "folder", "file1.txt"))
+	if err != nil {
+		panic(err)
+	}
+
+	status, err := scmStatus(sandbox1, NO_WRITE, false)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+
+	client, err := NewClient("", "")
+	if err != nil {
+		panic(err)
+	}
+
+	incoming, err := scmIncoming(client, status)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+
+	if !incoming.Modified["README.md"] || !incoming.Modified["project.json"] || len(incoming.Modified) != 2 {
+		t.Errorf("Unexpected incoming modifications: %v", incoming.Modified)
+	}
+	if !incoming.Added[filepath.Join("folder", "file1.txt")] || len(incoming.Added) != 1 {
+		t.Errorf("Unexpected incoming additions: %v", incoming.Added)
+	}
+	if !incoming.Deleted["gone.txt"] || len(incoming.Deleted) != 1 {
+		t.Errorf("Unexpected incoming deletions: %v", incoming.Deleted)
+	}
+	if incoming.Conflicts["README.md"] != "Modified" || len(incoming.Conflicts) != 1 {
+		t.Errorf("Unexpected conflicts: %v", incoming.Conflicts)
+	}
+
+	// Nothing in the sandbox should have been touched
+	contents, err := ioutil.ReadFile(filepath.Join(sandbox1, "README.md"))
+	if err != nil || string(contents) != "local change" {
+		t.Errorf("Incoming changes should not modify the sandbox")
+	}
+	s, _ := os.Stat(filepath.Join(sandbox1, "folder", "file1.txt"))
+	if s != nil {
+		t.Errorf("Incoming changes should not modify the sandbox")
+	}
+}
+
+func TestUnchangedComponentSkipped(t *testing.T) {
+	sandbox1, err := ioutil.TempDir(os.TempDir(), "gojazz-test")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(sandbox1)
+
+	t.Logf("Loading test project into %v\n", sandbox1)
+	os.Args = []string{"load", "sirnewton | gojazz-test", "-sandbox=" + sandbox1}
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	loadOp()
+
+	metadata := newMetaData()
+	err = metadata.load(filepath.Join(sandbox1, metadataFileName))
+	if err != nil {
+		panic(err)
+	}
+
+	if len(metadata.componentEtag) == 0 {
+		t.Fatalf("Component ETags were not recorded during the load")
+	}
+
+	// A local change must invalidate the optimization so that the file is restored
+	readme := filepath.Join(sandbox1, "README.md")
+	err = os.Remove(readme)
+	if err != nil {
+		panic(err)
+	}
+
+	os.Args = []string{"load", "-sandbox=" + sandbox1}
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	loadOp()
+
+	s, _ := os.Stat(readme)
+	if s == nil {
+		t.Fatalf("Deleted file was not restored by the load")
+	}
+
+	// Nothing changed so the component is skipped and the metadata carried forward
+	os.Args = []string{"load", "-sandbox=" + sandbox1}
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	loadOp()
+
+	reloaded := newMetaData()
+	err = reloaded.load(filepath.Join(sandbox1, metadataFileName))
+	if err != nil {
+		panic(err)
+	}
+
+	if !reflect.DeepEqual(metadata.componentEtag, reloaded.componentEtag) {
+		t.Errorf("Component ETags changed without any changes: %v %v", metadata.componentEtag, reloaded.componentEtag)
+	}
+	if len(metadata.pathMap) != len(reloaded.pathMap) {
+		t.Errorf("Metadata was not carried forward for the skipped component: %v %v", len(metadata.pathMap), len(reloaded.pathMap))
+	}
+
+	status, err := scmStatus(sandbox1, NO_COPY, false)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+	if !status.unchanged() {
+		t.Errorf("Expected no changes to the sandbox, got these instead: %v\n", status)
+	}
+}
+
+func TestThreeWayMerge(t *testing.T) {
+	tests := []struct {
+		base, local, remote string
+		merged              string
+		conflict            bool
+	}{
+		// Only one side changed
+		{"a\nb\nc\n", "a\nb\nc\n", "a\nB\nc\n", "a\nB\nc\n", false},
+		{"a\nb\nc\n", "a\nB\nc\n", "a\nb\nc\n", "a\nB\nc\n", false},
+		// Changes to different parts of the file
+		{"a\nb\nc\nd\ne\n", "A\nb\nc\nd\ne\n", "a\nb\nc\nd\nE\n", "A\nb\nc\nd\nE\n", false},
+		{"a\nb\nc\n", "a\nb\nc\nlocal\n", "remote\na\nb\nc\n", "remote\na\nb\nc\nlocal\n", false},
+		{"a\nb\nc\n", "a\nc\n", "a\nb\nc\nd\n", "a\nc\nd\n", false},
+		// The same change on both sides
+		{"a\nb\nc\n", "a\nX\nc\n", "a\nX\nc\n", "a\nX\nc\n", false},
+		// Overlapping changes
+		{"a\nb\nc\n", "a\nlocal\nc\n", "a\nremote\nc\n", "a\n" + conflictStart + "\nlocal\n" + conflictSep + "\nremote\n" + conflictEnd + "\nc\n", true},
+		// Added on both sides
+		{"", "same\n", "same\n", "same\n", false},
+		{"", "local", "remote", conflictStart + "\nlocal\n" + conflictSep + "\nremote\n" + conflictEnd + "\n", true},
+	}
+
+	for _, test := range tests {
+		merged, conflict, ok := mergeFile([]byte(test.base), []byte(test.local), []byte(test.remote))
+		if !ok {
+			t.Errorf("Text files could not be merged: %q %q %q", test.base, test.local, test.remote)
+			continue
+		}
+		if string(merged) != test.merged {
+			t.Errorf("Merge of %q %q %q gave %q, expected %q", test.base, test.local, test.remote, string(merged), test.merged)
+		}
+		if conflict != test.conflict {
+			t.Errorf("Merge of %q %q %q reported conflict %v", test.base, test.local, test.remote, conflict)
+		}
+		if conflict != hasConflictMarkers(merged) {
+			t.Errorf("Conflict markers don't match the reported conflict: %q", string(merged))
+		}
+	}
+
+	_, _, ok := mergeFile([]byte("a\n"), []byte("a\x00b"), []byte("b\n"))
+	if ok {
+		t.Errorf("Binary files should not be merged")
+	}
+
+	// Larger files with scattered changes
+	base := []string{}
+	for i := 0; i < 500; i++ {
+		base = append(base, fmt.Sprintf("line %v\n", i))
+	}
+	local := append([]string{}, base...)
+	remote := append([]string{}, base...)
+	expected := append([]string{}, base...)
+	for i := 0; i < 500; i += 50 {
+		local[i] = "local\n"
+		remote[i+25] = "remote\n"
+		expected[i] = "local\n"
+		expected[i+25] = "remote\n"
+	}
+
+	merged, numConflicts := merge3(base, local, remote, "local", "remote")
+	if numConflicts != 0 || !reflect.DeepEqual(merged, expected) {
+		t.Errorf("Scattered changes were not merged cleanly, %v conflicts", numConflicts)
+	}
+}
+
+// Simulate an incoming change by pointing the metadata for a file at a
+// different base version and then load the sandbox again.
+func fakeIncomingChange(sandbox string, rel string, base string) {
+	metadata := newMetaData()
+	err := metadata.load(filepath.Join(sandbox, metadataFileName))
+	if err != nil {
+		panic(err)
+	}
+
+	hash := sha1.Sum([]byte(base))
+	meta := metadata.pathMap[rel]
+	meta.Hash = base64.StdEncoding.EncodeToString(hash[:])
+	meta.StateId = "previous"
+	metadata.pathMap[rel] = meta
+
+	err = storeBase(sandbox, meta.Hash, strings.NewReader(base))
+	if err != nil {
+		panic(err)
+	}
+
+	err = metadata.save(filepath.Join(sandbox, metadataFileName))
+	if err != nil {
+		panic(err)
+	}
+}
+
+func TestLoadMergesChanges(t *testing.T) {
+	sandbox1, err := ioutil.TempDir(os.TempDir(), "gojazz-test")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(sandbox1)
+
+	t.Logf("Loading test project into %v\n", sandbox1)
+	os.Args = []string{"load", "sirnewton | gojazz-test", "-sandbox=" + sandbox1}
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	loadOp()
+
+	readme := filepath.Join(sandbox1, "README.md")
+	remote, err := ioutil.ReadFile(readme)
+	if err != nil {
+		panic(err)
+	}
+
+	// The remote removed the first line, the local change is at the end
+	fakeIncomingChange(sandbox1, "README.md", "obsolete\n"+string(remote))
+	err = ioutil.WriteFile(readme, []byte("obsolete\n"+string(remote)+"local change\n"), 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	// Both changed the first line
+	project := filepath.Join(sandbox1, "project.json")
+	projectRemote, err := ioutil.ReadFile(project)
+	if err != nil {
+		panic(err)
+	}
+	fakeIncomingChange(sandbox1, "project.json", "base\n"+string(projectRemote))
+	err = ioutil.WriteFile(project, []byte("local\n"+string(projectRemote)), 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	// A local file added where nothing was before
+	added := filepath.Join(sandbox1, "added.txt")
+	err = ioutil.WriteFile(added, []byte("added"), 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	os.Args = []string{"load", "-sandbox=" + sandbox1}
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	loadOp()
+
+	contents, err := ioutil.ReadFile(readme)
+	if err != nil {
+		panic(err)
+	}
+	if string(contents) != string(remote)+"local change\n" {
+		t.Errorf("Changes were not merged: %q", string(contents))
+	}
+
+	contents, err = ioutil.ReadFile(project)
+	if err != nil {
+		panic(err)
+	}
+	if !hasConflictMarkers(contents) {
+		t.Errorf("Conflict markers were not written: %q", string(contents))
+	}
+
+	_, err = os.Stat(added)
+	if err != nil {
+		t.Errorf("Locally added file was removed by the load")
+	}
+
+	status, err := scmStatus(sandbox1, NO_COPY, false)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+	if !status.Modified["README.md"] || !status.Modified["project.json"] || !status.Added["added.txt"] {
+		t.Errorf("Merged changes are not shown in the status: %v", status)
+	}
+
+	unresolved := unresolvedConflicts(status)
+	if !reflect.DeepEqual(unresolved, []string{"project.json"}) {
+		t.Errorf("Unexpected unresolved conflicts: %v", unresolved)
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	old := ""
+	for i := 1; i <= 20; i++ {
+		old = old + fmt.Sprintf("line %v\n", i)
+	}
+	current := strings.Replace(old, "line 2\n", "line two\n", 1)
+	current = strings.Replace(current, "line 18\n", "", 1) + "end"
+
+	expected := `--- a/file.txt
++++ b/file.txt
+@@ -1,5 +1,5 @@
+ line 1
+-line 2
++line two
+ line 3
+ line 4
+ line 5
+@@ -15,6 +15,6 @@
+ line 15
+ line 16
+ line 17
+-line 18
+ line 19
+ line 20
++end
+\ No newline at end of file
+`
+
+	diff := unifiedDiff("file.txt", "file.txt", []byte(old), []byte(current))
+	if diff != expected {
+		t.Errorf("Unexpected diff:\n%v", diff)
+	}
+
+	if unifiedDiff("file.txt", "file.txt", []byte(old), []byte(old)) != "" {
+		t.Errorf("Identical files should have an empty diff")
+	}
+
+	diff = unifiedDiff("", "new.txt", []byte{}, []byte("new\n"))
+	if diff != "--- /dev/null\n+++ b/new.txt\n@@ -0,0 +1,1 @@\n+new\n" {
+		t.Errorf("Unexpected diff for an added file:\n%v", diff)
+	}
+
+	stat := diffStat([]fileDiff{
+		{OldName: "file.txt", NewName: "file.txt", Old: []byte(old), New: []byte(current)},
+		{NewName: "new.txt", New: []byte("new\n")},
+		{OldName: "same.txt", NewName: "same.txt", Old: []byte("same\n"), New: []byte("same\n")},
+	})
+	expectedStat := ` file.txt | 4 ++--
+ new.txt  | 1 +
+ 2 files changed, 3 insertions(+), 2 deletions(-)
+`
+	if stat != expectedStat {
+		t.Errorf("Unexpected diff stat:\n%v", stat)
+	}
+}
+
+func TestPristineDiffAndRevert(t *testing.T) {
+	sandbox1 := createTestSandbox(map[string]string{
+		"README.md":        "readme\n",
+		"folder/file1.txt": "file1\n",
+		"folder/file2.txt": "file2\n",
+	})
+	defer os.RemoveAll(sandbox1)
+
+	err := ioutil.WriteFile(filepath.Join(sandbox1, "README.md"), []byte("changed\n"), 0600)
+	if err != nil {
+		panic(err)
+	}
+	err = os.RemoveAll(filepath.Join(sandbox1, "folder"))
+	if err != nil {
+		panic(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(sandbox1, "added.txt"), []byte("added\n"), 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	status, err := scmStatus(sandbox1, NO_COPY, false)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+
+	expected := `--- a/README.md
++++ b/README.md
+@@ -1,1 +1,1 @@
+-readme
++changed
+--- /dev/null
++++ b/added.txt
+@@ -0,0 +1,1 @@
++added
+--- a/folder/file1.txt
++++ /dev/null
+@@ -1,1 +0,0 @@
+-file1
+--- a/folder/file2.txt
++++ /dev/null
+@@ -1,1 +0,0 @@
+-file2
+`
+	diff := ""
+	for _, fileDiff := range scmDiff(status) {
+		diff = diff + fileDiff.unified()
+	}
+	if diff != expected {
+		t.Errorf("Unexpected diff:\n%v", diff)
+	}
+
+	reverted := scmRevert(status)
+	if len(reverted) != 5 {
+		t.Errorf("Unexpected files reverted: %v", reverted)
+	}
+
+	contents, err := ioutil.ReadFile(filepath.Join(sandbox1, "folder", "file2.txt"))
+	if err != nil || string(contents) != "file2\n" {
+		t.Errorf("Deleted file was not restored: %q", string(contents))
+	}
+
+	status, err = scmStatus(sandbox1, NO_COPY, false)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+	if !status.unchanged() {
+		t.Errorf("Unexpected changes after the revert: %v", status)
+	}
+}
+
+func TestRemoteDiff(t *testing.T) {
+	sandbox1, err := ioutil.TempDir(os.TempDir(), "gojazz-test")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(sandbox1)
+
+	t.Logf("Loading test project into %v\n", sandbox1)
+	os.Args = []string{"load", "sirnewton | gojazz-test", "-sandbox=" + sandbox1}
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	loadOp()
+
+	readme := filepath.Join(sandbox1, "README.md")
+	remote, err := ioutil.ReadFile(readme)
+	if err != nil {
+		panic(err)
+	}
+	err = ioutil.WriteFile(readme, append(remote, []byte("local change\n")...), 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	status, err := scmStatus(sandbox1, NO_WRITE, false)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+
+	client := newClientForSandbox(status.metaData)
+	diffs, err := scmRemoteDiff(client, status, status.metaData.workspaceId)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+
+	if len(diffs) != 1 || diffs[0].name() != "README.md" {
+		t.Fatalf("Unexpected differences with the stream: %v", diffs)
+	}
+	if string(diffs[0].Old) != string(remote) {
+		t.Errorf("Remote contents weren't fetched for the diff")
+	}
+	if !strings.Contains(diffs[0].unified(), "+local change\n") {
+		t.Errorf("Local change is missing from the diff:\n%v", diffs[0].unified())
+	}
+}
+
+func TestRevertWithoutPristineCopies(t *testing.T) {
+	sandbox1, err := ioutil.TempDir(os.TempDir(), "gojazz-test")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(sandbox1)
+
+	t.Logf("Loading test project into %v\n", sandbox1)
+	os.Args = []string{"load", "sirnewton | gojazz-test", "-sandbox=" + sandbox1, "-pristine=false"}
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	loadOp()
+
+	s, _ := os.Stat(filepath.Join(sandbox1, baseFolder))
+	if s != nil {
+		t.Errorf("Pristine copies were kept when they were turned off")
+	}
+
+	readme := filepath.Join(sandbox1, "README.md")
+	original, err := ioutil.ReadFile(readme)
+	if err != nil {
+		panic(err)
+	}
+	err = ioutil.WriteFile(readme, []byte("changed"), 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	os.Args = []string{"revert", "-sandbox=" + sandbox1, "-dry-run", readme}
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	revertOp()
+
+	contents, err := ioutil.ReadFile(readme)
+	if err != nil || string(contents) != "changed" {
+		t.Errorf("Dry run changed the file")
+	}
+
+	os.Args = []string{"revert", "-sandbox=" + sandbox1, readme}
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	revertOp()
+
+	contents, err = ioutil.ReadFile(readme)
+	if err != nil || string(contents) != string(original) {
+		t.Errorf("File was not fetched from the stream: %q", string(contents))
+	}
+
+	status, err := scmStatus(sandbox1, NO_COPY, false)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+	if !status.unchanged() {
+		t.Errorf("Unexpected changes after the revert: %v", status)
+	}
+}
+
+func TestBackupHistory(t *testing.T) {
+	sandbox1 := createTestSandbox(map[string]string{
+		"README.md":        "readme\n",
+		"folder/file1.txt": "file1\n",
+	})
+	defer os.RemoveAll(sandbox1)
+
+	readme := filepath.Join(sandbox1, "README.md")
+	err := ioutil.WriteFile(readme, []byte("first\n"), 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	status, err := scmBackup(sandbox1, "load -force", nil)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+	first := filepath.Base(status.copyPath)
+
+	// A second backup must not overwrite the first one
+	err = ioutil.WriteFile(readme, []byte("second\n"), 0600)
+	if err != nil {
+		panic(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(sandbox1, "folder", "added.txt"), []byte("added\n"), 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	status, err = scmBackup(sandbox1, "sync", nil)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+	second := filepath.Base(status.copyPath)
+
+	if first == second {
+		t.Fatalf("Backups share the same ID %v", first)
+	}
+
+	backups, err := listBackups(sandbox1)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+	if len(backups) != 2 || backups[0].Id != first || backups[1].Id != second {
+		t.Fatalf("Unexpected backups: %v", backups)
+	}
+	if backups[0].Operation != "load -force" || backups[1].Operation != "sync" || len(backups[0].Changes) != 1 || len(backups[1].Changes) != 2 {
+		t.Errorf("Unexpected backup manifests: %v", backups)
+	}
+
+	contents, err := ioutil.ReadFile(filepath.Join(sandbox1, backupFolder, first, "README.md"))
+	if err != nil || string(contents) != "first\n" {
+		t.Errorf("First backup was overwritten: %q", string(contents))
+	}
+
+	// Restore some of the files from the first backup
+	restored := scmRestore(sandbox1, backups[0], []string{"README.md"})
+	if len(restored) != 1 {
+		t.Errorf("Unexpected files restored: %v", restored)
+	}
+	contents, err = ioutil.ReadFile(readme)
+	if err != nil || string(contents) != "first\n" {
+		t.Errorf("File was not restored: %q", string(contents))
+	}
+
+	// Nothing changed so no backup is taken
+	status, err = scmBackup(sandbox1, "revert", []string{"nothing"})
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+
+	pruned, err := pruneBackups(sandbox1, 1)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+	if !reflect.DeepEqual(pruned, []string{first}) {
+		t.Errorf("Unexpected backups pruned: %v", pruned)
+	}
+
+	backups, err = listBackups(sandbox1)
+	if err != nil || len(backups) != 1 || backups[0].Id != second {
+		t.Errorf("Unexpected backups after pruning: %v", backups)
+	}
+}
+
+func TestRestoreMovedFolder(t *testing.T) {
+	sandbox1 := createTestSandbox(map[string]string{
+		"folder/file1.txt":     "file1\n",
+		"folder/sub/file2.txt": "file2\n",
+	})
+	defer os.RemoveAll(sandbox1)
+
+	err := os.Rename(filepath.Join(sandbox1, "folder"), filepath.Join(sandbox1, "moved"))
+	if err != nil {
+		panic(err)
+	}
+
+	status, err := scmBackup(sandbox1, "load", nil)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+
+	backups, err := listBackups(sandbox1)
+	if err != nil || len(backups) != 1 {
+		t.Fatalf("Unexpected backups: %v %v", backups, err)
+	}
+	restorable := []string{}
+	for _, change := range backups[0].Changes {
+		if change.Kind != "Deleted" {
+			restorable = append(restorable, change.Path)
+		}
+	}
+	if !reflect.DeepEqual(restorable, []string{"moved"}) {
+		t.Errorf("Expected the moved folder to be a single change: %v", backups[0].Changes)
+	}
+
+	// The load puts the folder back where it was
+	err = os.RemoveAll(filepath.Join(sandbox1, "moved"))
+	if err != nil {
+		panic(err)
+	}
+
+	restored := scmRestore(sandbox1, backups[0], nil)
+	if !reflect.DeepEqual(restored, []string{"moved"}) {
+		t.Errorf("Unexpected paths restored: %v", restored)
+	}
+
+	for file, expected := range map[string]string{"moved/file1.txt": "file1\n", "moved/sub/file2.txt": "file2\n"} {
+		contents, err := ioutil.ReadFile(filepath.Join(sandbox1, filepath.FromSlash(file)))
+		if err != nil || string(contents) != expected {
+			t.Errorf("%v was not restored from %v: %q %v", file, status.copyPath, string(contents), err)
+		}
+	}
+}
+
+func TestStash(t *testing.T) {
+	sandbox1 := createTestSandbox(map[string]string{
+		"README.md":        "one\ntwo\nthree\nfour\nfive\nsix\nseven\n",
+		"folder/file1.txt": "file1\n",
+		"folder/file2.txt": "file2\n",
+	})
+	defer os.RemoveAll(sandbox1)
+
+	readme := filepath.Join(sandbox1, "README.md")
+	err := ioutil.WriteFile(readme, []byte("one\ntwo\nthree\nfour\nfive\nsix\nseven stashed\n"), 0600)
+	if err != nil {
+		panic(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(sandbox1, "folder", "added.txt"), []byte("added\n"), 0600)
+	if err != nil {
+		panic(err)
+	}
+	err = os.Remove(filepath.Join(sandbox1, "folder", "file2.txt"))
+	if err != nil {
+		panic(err)
+	}
+
+	status, err := scmStatus(sandbox1, NO_COPY, false)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+
+	manifest := scmStash(status, "wip", "work in progress")
+	if len(manifest.Entries) != 3 {
+		t.Errorf("Unexpected stash entries: %v", manifest.Entries)
+	}
+
+	status, err = scmStatus(sandbox1, NO_COPY, false)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+	if !status.unchanged() {
+		t.Fatalf("Sandbox has changes after stashing: %v", status)
+	}
+
+	// A stash with the same name isn't allowed
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("Stash with a duplicate name was created")
+			}
+		}()
+
+		ioutil.WriteFile(readme, []byte("changed\n"), 0600)
+		status, _ := scmStatus(sandbox1, NO_COPY, false)
+		scmStash(status, "wip", "")
+	}()
+	err = ioutil.WriteFile(readme, []byte("one\ntwo\nthree\nfour\nfive\nsix\nseven\n"), 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	// Change another part of the stashed file before applying it
+	err = ioutil.WriteFile(readme, []byte("one changed\ntwo\nthree\nfour\nfive\nsix\nseven\n"), 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	found, err := findStash(sandbox1, "")
+	if err != nil || found.Name != "wip" || found.Message != "work in progress" {
+		t.Fatalf("Stash not found: %v %v", found, err)
+	}
+
+	status, err = scmStatus(sandbox1, NO_COPY, false)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+
+	conflicts := scmStashApply(status, found)
+	if !conflicts.empty() {
+		t.Errorf("Unexpected conflicts: %v", conflicts)
+	}
+
+	contents, err := ioutil.ReadFile(readme)
+	if err != nil || string(contents) != "one changed\ntwo\nthree\nfour\nfive\nsix\nseven stashed\n" {
+		t.Errorf("Stash was not merged: %q", string(contents))
+	}
+	contents, err = ioutil.ReadFile(filepath.Join(sandbox1, "folder", "added.txt"))
+	if err != nil || string(contents) != "added\n" {
+		t.Errorf("Added file was not applied: %q", string(contents))
+	}
+	_, err = os.Stat(filepath.Join(sandbox1, "folder", "file2.txt"))
+	if !os.IsNotExist(err) {
+		t.Errorf("Deleted file was not removed")
+	}
+
+	// The stash and the pristine copies it depends on are kept
+	err = pruneBase(sandbox1, status.metaData)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+	stashes, err := listStashes(sandbox1)
+	if err != nil || len(stashes) != 1 {
+		t.Fatalf("Unexpected stashes: %v %v", stashes, err)
+	}
+	for _, entry := range stashes[0].Entries {
+		if entry.BaseHash != "" && !hasBase(sandbox1, entry.BaseHash) {
+			t.Errorf("Pristine copy of %v was pruned", entry.Path)
+		}
+	}
+}
+
+func TestStashWithoutPristineCopies(t *testing.T) {
+	sandbox1 := createTestSandbox(map[string]string{
+		"README.md": "one\ntwo\n",
+	})
+	defer os.RemoveAll(sandbox1)
+
+	readme := filepath.Join(sandbox1, "README.md")
+	err := ioutil.WriteFile(readme, []byte("one\ntwo stashed\n"), 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	status, err := scmStatus(sandbox1, NO_COPY, false)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+	manifest := scmStash(status, "wip", "")
+
+	// Loaded with -pristine=false, or the copies were pruned
+	err = os.RemoveAll(filepath.Join(sandbox1, baseFolder))
+	if err != nil {
+		panic(err)
+	}
+
+	status, err = scmStatus(sandbox1, NO_COPY, false)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+	conflicts := scmStashApply(status, manifest)
+	if !conflicts.empty() {
+		t.Errorf("Unexpected conflicts applying to an unchanged file: %v", conflicts)
+	}
+
+	contents, err := ioutil.ReadFile(readme)
+	if err != nil || string(contents) != "one\ntwo stashed\n" {
+		t.Errorf("Stash was not applied: %q", string(contents))
+	}
+	_, err = os.Stat(readme + stashSuffix)
+	if !os.IsNotExist(err) {
+		t.Errorf("The stashed version was written next to the file")
+	}
+
+	for _, name := range []string{"../outside", "a/b", "a\\b", ".."} {
+		if checkStashName(name) == nil {
+			t.Errorf("Stash name %v was accepted", name)
+		}
+	}
+	if checkStashName("wip-2") != nil {
+		t.Errorf("Valid stash name was rejected")
+	}
+}
+
+func TestSandboxLock(t *testing.T) {
+	sandbox1 := createTestSandbox(map[string]string{
+		"README.md": "readme\n",
+	})
+	defer os.RemoveAll(sandbox1)
+
+	lock, err := lockSandbox(sandbox1, "sync -force", 0)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+
+	// The lock file is not a change to the sandbox
+	status, err := scmStatus(sandbox1, NO_COPY, false)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+	if !status.unchanged() {
+		t.Errorf("Lock file shows up in the status: %v", status)
+	}
+
+	_, err = lockSandbox(sandbox1, "load", 0)
+	if err == nil || !strings.Contains(err.Error(), "'sync -force'") {
+		t.Fatalf("Lock was acquired twice: %v", err)
+	}
+
+	// Wait for the lock to be released
+	go func() {
+		time.Sleep(3 * lockPollInterval)
+		lock.unlock()
+	}()
+	lock, err = lockSandbox(sandbox1, "load", 10*lockPollInterval)
+	if err != nil {
+		t.Fatalf("Lock was not acquired after waiting: %v", err.Error())
+	}
+	lock.unlock()
+
+	// Operations running at the same time take turns
+	running := 0
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			lock, err := lockSandbox(sandbox1, "revert", time.Minute)
+			if err != nil {
+				t.Errorf("%v", err.Error())
+				return
+			}
+			defer lock.unlock()
+
+			mutex.Lock()
+			running++
+			if running > 1 {
+				t.Errorf("Operations are running at the same time")
+			}
+			mutex.Unlock()
+
+			time.Sleep(lockPollInterval / 2)
+
+			mutex.Lock()
+			running--
+			mutex.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	// A lock left behind by a process that has finished is stale
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	err = cmd.Start()
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+	cmd.Wait()
+
+	host, err := os.Hostname()
+	if err != nil {
+		panic(err)
+	}
+
+	lockPath := filepath.Join(sandbox1, lockFileName)
+	err = ioutil.WriteFile(lockPath, []byte(fmt.Sprintf(`{"Pid": %v, "Host": %q, "Operation": "build"}`, cmd.Process.Pid, host)), 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	lock, err = lockSandbox(sandbox1, "load", 0)
+	if err != nil {
+		t.Fatalf("Stale lock was not removed: %v", err.Error())
+	}
+
+	// A lock taken after the stale one was read is put back
+	err = ioutil.WriteFile(lockPath, []byte(fmt.Sprintf(`{"Pid": %v, "Host": %q, "Operation": "build"}`, cmd.Process.Pid, host)), 0600)
+	if err != nil {
+		panic(err)
+	}
+	holder, err := readLock(lockPath)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+	lock.Time = time.Now()
+	err = ioutil.WriteFile(lockPath, []byte(fmt.Sprintf(`{"Pid": %v, "Host": %q, "Operation": "load", "Time": %q}`, os.Getpid(), host, lock.Time.Format(time.RFC3339Nano))), 0600)
+	if err != nil {
+		panic(err)
+	}
+	err = lock.breakStale(holder)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+	current, err := readLock(lockPath)
+	if err != nil || current.Pid != os.Getpid() {
+		t.Fatalf("The new lock was removed with the stale one: %v %v", current, err)
+	}
+	lock.unlock()
+
+	// Operations that find the same stale lock don't remove each other's
+	//  new locks
+	err = ioutil.WriteFile(lockPath, []byte(fmt.Sprintf(`{"Pid": %v, "Host": %q, "Operation": "build"}`, cmd.Process.Pid, host)), 0600)
+	if err != nil {
+		panic(err)
+	}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			lock, err := lockSandbox(sandbox1, "sync", time.Minute)
+			if err != nil {
+				t.Errorf("%v", err.Error())
+				return
+			}
+			defer lock.unlock()
+
+			mutex.Lock()
+			running++
+			if running > 1 {
+				t.Errorf("Operations are running at the same time after removing a stale lock")
+			}
+			mutex.Unlock()
+
+			time.Sleep(lockPollInterval / 2)
+
+			mutex.Lock()
+			running--
+			mutex.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	// Processes on other hosts can't be checked
+	err = ioutil.WriteFile(lockPath, []byte(fmt.Sprintf(`{"Pid": %v, "Host": "elsewhere", "Operation": "build"}`, cmd.Process.Pid)), 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = lockSandbox(sandbox1, "load", 0)
+	if err == nil {
+		t.Errorf("Lock held on another host was removed")
+	}
+}
+
+// Fails part way through like a dropped connection
+type failingReader struct {
+	contents io.Reader
+}
+
+func (reader *failingReader) Read(p []byte) (int, error) {
+	n, err := reader.contents.Read(p)
+	if err == io.EOF {
+		return n, errors.New("Connection reset")
+	}
+	return n, err
+}
+
+func TestAtomicDownload(t *testing.T) {
+	sandbox1 := createTestSandbox(map[string]string{
+		"README.md":        "readme\n",
+		"folder/file1.txt": "file1\n",
+	})
+	defer os.RemoveAll(sandbox1)
+
+	readme := filepath.Join(sandbox1, "README.md")
+
+	err := writeDownload(readme, &failingReader{strings.NewReader("partial")})
+	if err == nil {
+		t.Fatalf("Failed download was not reported")
+	}
+
+	contents, err := ioutil.ReadFile(readme)
+	if err != nil || string(contents) != "readme\n" {
+		t.Errorf("Failed download replaced the file: %q", string(contents))
+	}
+
+	status, err := scmStatus(sandbox1, NO_COPY, false)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+	if !status.unchanged() {
+		t.Errorf("Failed download left changes behind: %v", status)
+	}
+
+	err = writeDownload(readme, strings.NewReader("new readme\n"))
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+
+	contents, err = ioutil.ReadFile(readme)
+	if err != nil || string(contents) != "new readme\n" {
+		t.Errorf("Download didn't replace the file: %q", string(contents))
+	}
+
+	// Downloads that don't check out are thrown away
+	sum := sha1.Sum([]byte("new contents\n"))
+	expected := base64.StdEncoding.EncodeToString(sum[:])
+	for idx, check := range []func(writer *downloadWriter) error{
+		// Fewer bytes than the server said there were
+		func(writer *downloadWriter) error { return writer.commit(100, "") },
+		// Not the contents that were expected
+		func(writer *downloadWriter) error { return writer.commit(-1, "bad") },
+		// Changed on the disk after they were written
+		func(writer *downloadWriter) error {
+			err := ioutil.WriteFile(writer.file.Name(), []byte("bad contents\n"), 0600)
+			if err != nil {
+				panic(err)
+			}
+			return writer.commit(-1, "")
+		},
+	} {
+		writer, err := createDownloadWriter(readme)
+		if err != nil {
+			t.Fatalf("%v", err.Error())
+		}
+		writer.Write([]byte("new contents\n"))
+		writer.file.Sync()
+
+		if check(writer) == nil {
+			t.Errorf("Bad download %v was accepted", idx)
+		}
+		if _, err := os.Stat(writer.file.Name()); !os.IsNotExist(err) {
+			t.Errorf("Bad download %v was not cleaned up", idx)
+		}
+		contents, err = ioutil.ReadFile(readme)
+		if err != nil || string(contents) != "new readme\n" {
+			t.Errorf("Bad download %v replaced the file: %q", idx, string(contents))
+		}
+	}
+
+	writer, err := createDownloadWriter(readme)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+	writer.Write([]byte("new contents\n"))
+	err = writer.commit(int64(len("new contents\n")), expected)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+	contents, err = ioutil.ReadFile(readme)
+	if err != nil || string(contents) != "new contents\n" {
+		t.Errorf("Verified download didn't replace the file: %q", string(contents))
+	}
+
+	// A download that was interrupted before it could clean up
+	writer, err = createDownloadWriter(filepath.Join(sandbox1, "folder", "file1.txt"))
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+	writer.Write([]byte("fil"))
+	writer.file.Close()
+
+	status, err = scmStatus(sandbox1, NO_COPY, false)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+	if len(status.Added) != 0 {
+		t.Errorf("Temporary download shows up as an added file: %v", status)
+	}
+
+	// Only the paths being loaded are cleaned
+	err = cleanDownloads(sandbox1, []string{"other"})
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+	_, err = os.Stat(writer.file.Name())
+	if err != nil {
+		t.Errorf("Temporary download outside of the paths was cleaned up")
+	}
+
+	err = cleanDownloads(sandbox1, []string{"folder"})
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+
+	_, err = os.Stat(writer.file.Name())
+	if !os.IsNotExist(err) {
+		t.Errorf("Temporary download was not cleaned up")
+	}
+
+	contents, err = ioutil.ReadFile(filepath.Join(sandbox1, "folder", "file1.txt"))
+	if err != nil || string(contents) != "file1\n" {
+		t.Errorf("Interrupted download replaced the file: %q", string(contents))
+	}
+}
+
+func TestLoadJournal(t *testing.T) {
+	sandbox1, err := ioutil.TempDir(os.TempDir(), "gojazz-test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(sandbox1)
+
+	header := journalHeader{CcmBaseUrl: "https://example.com/ccm", ProjectName: "sirnewton | gojazz-test", WorkspaceId: "workspace", IsStream: true}
+	journal, err := createJournal(sandbox1, header)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+
+	// Loaded items are journaled as they go into the metadata
+	metadata := newMetaData()
+	metadata.journal = journal
+	metadata.initConcurrentWrite()
+	metadata.put(metaObject{Path: filepath.Join(sandbox1, "folder"), ItemId: "folder", StateId: "1", ComponentId: "comp1"}, sandbox1)
+	metadata.put(metaObject{Path: filepath.Join(sandbox1, "folder", "file1.txt"), ItemId: "file1", StateId: "1", ComponentId: "comp1", Hash: "hash1"}, sandbox1)
+	metadata.put(metaObject{Path: filepath.Join(sandbox1, "README.md"), ItemId: "readme", StateId: "2", ComponentId: "comp2", Hash: "hash2"}, sandbox1)
+	journal.finishComponent("comp1", "etag1")
+
+	// The load is interrupted part way through writing an entry
+	journal.file.Write([]byte(`{"Item": {"Path": "bin`))
+	journal.file.Close()
+
+	err = os.MkdirAll(filepath.Join(sandbox1, "folder"), 0700)
+	if err != nil {
+		panic(err)
+	}
+	if findSandbox(filepath.Join(sandbox1, "folder")) != sandbox1 {
+		t.Errorf("Sandbox with an interrupted load was not found")
+	}
+
+	journal, err = readJournal(sandbox1)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+
+	if !reflect.DeepEqual(journal.header, header) {
+		t.Errorf("Unexpected journal header: %v", journal.header)
+	}
+	if len(journal.items) != 3 || journal.items[filepath.Join("folder", "file1.txt")].Hash != "hash1" || journal.items["README.md"].ComponentId != "comp2" {
+		t.Errorf("Unexpected journal items: %v", journal.items)
+	}
+	if !reflect.DeepEqual(journal.components, map[string]string{"comp1": "etag1"}) {
+		t.Errorf("Unexpected journal components: %v", journal.components)
+	}
+
+	// Resuming appends to the same journal
+	journal, err = resumeJournal(sandbox1)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+	journal.finishComponent("comp2", "etag2")
+
+	resumed, err := readJournal(sandbox1)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+	if len(resumed.components) != 2 || len(resumed.items) != 3 {
+		t.Errorf("Entries were lost after resuming: %v %v", resumed.components, resumed.items)
+	}
+
+	err = journal.remove()
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+
+	_, err = readJournal(sandbox1)
+	if !os.IsNotExist(err) {
+		t.Errorf("Journal was not removed: %v", err)
+	}
+}
+
+func TestResumeMergeLoad(t *testing.T) {
+	sandbox1 := createTestSandbox(map[string]string{
+		"README.md":        "one\ntwo\nthree\n",
+		"folder/file1.txt": "a\nb\nc\nd\ne\n",
+	})
+	defer os.RemoveAll(sandbox1)
+
+	readme := filepath.Join(sandbox1, "README.md")
+	file1 := filepath.Join(sandbox1, "folder", "file1.txt")
+	err := ioutil.WriteFile(readme, []byte("one local\ntwo\nthree\n"), 0600)
+	if err != nil {
+		panic(err)
+	}
+	err = ioutil.WriteFile(file1, []byte("a local\nb\nc\nd\ne\n"), 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	status, err := scmStatus(sandbox1, NO_COPY, false)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+
+	// The load starts merging and replaces the metadata
+	header := journalHeader{CcmBaseUrl: "https://example.com/ccm", ProjectName: "sirnewton | gojazz-test", WorkspaceId: "workspace"}
+	header.recordMerge(status)
+	journal, err := createJournal(sandbox1, header)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+	err = os.Remove(filepath.Join(sandbox1, metadataFileName))
+	if err != nil {
+		panic(err)
+	}
+
+	remoteFile := func(itemId string, contents string) *File {
+		return &File{info: FileInfo{ScmInfo: ScmInfo{ComponentId: "comp", ItemId: itemId, StateId: "remote"}}, reading: ioutil.NopCloser(strings.NewReader(contents))}
+	}
+
+	meta := mergeRemoteFile(remoteFile("item-README.md", "one\ntwo\nthree remote\n"), readme, "README.md", sandbox1, status, false, newConflicts())
+	meta.Path = "README.md"
+	journal.record(meta)
+
+	// Interrupted before it got to the other file
+	journal.file.Close()
+
+	_, err = scmStatus(sandbox1, NO_COPY, false)
+	if err == nil {
+		t.Fatalf("The sandbox still has its metadata")
+	}
+
+	journal, err = resumeJournal(sandbox1)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+	defer journal.file.Close()
+
+	if !journal.header.Merge {
+		t.Fatalf("The journal doesn't record that the load was merging")
+	}
+	resumed := journal.mergeStatus(sandbox1)
+	if !reflect.DeepEqual(resumed.Modified, status.Modified) {
+		t.Errorf("Unexpected local changes after resuming: %v", resumed.Modified)
+	}
+
+	// The rest of the local changes are merged rather than downloaded over
+	merged := filepath.Join("folder", "file1.txt")
+	conflicts := newConflicts()
+	mergeRemoteFile(remoteFile("item-folder/file1.txt", "a\nb\nc\nd\ne remote\n"), file1, merged, sandbox1, resumed, false, conflicts)
+	if !conflicts.empty() {
+		t.Errorf("Unexpected conflicts: %v", conflicts)
+	}
+
+	for file, expected := range map[string]string{readme: "one local\ntwo\nthree remote\n", file1: "a local\nb\nc\nd\ne remote\n"} {
+		contents, err := ioutil.ReadFile(file)
+		if err != nil || string(contents) != expected {
+			t.Errorf("Local changes to %v were lost: %q", file, string(contents))
+		}
+	}
+
+	if journal.items["README.md"].StateId != "remote" {
+		t.Errorf("The file merged by the interrupted load is not in the journal: %v", journal.items)
+	}
+}
+
+func TestSparseStatus(t *testing.T) {
+	sandbox1 := createTestSandbox(map[string]string{
+		"README.md":        "readme\n",
+		"folder/file1.txt": "file1\n",
+		"folder/file2.txt": "file2\n",
+		"other/file3.txt":  "file3\n",
+	})
+	defer os.RemoveAll(sandbox1)
+
+	sparse, err := sparsePaths([]string{"/folder/", "docs/../other"})
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+	if !reflect.DeepEqual(sparse, []string{"folder", "other"}) {
+		t.Errorf("Unexpected sparse paths: %v", sparse)
+	}
+
+	sparse, err = sparsePaths([]string{"folder", "."})
+	if err != nil || len(sparse) != 0 {
+		t.Errorf("Loading the whole sandbox is not sparse: %v", sparse)
+	}
+
+	_, err = sparsePaths([]string{"../elsewhere"})
+	if err == nil {
+		t.Errorf("Path outside of the sandbox was accepted")
+	}
+
+	// Narrow the sandbox down to the folder, as if it was loaded that way
+	status, err := scmStatus(sandbox1, NO_COPY, false)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+	err = ioutil.WriteFile(filepath.Join(sandbox1, "other", "file3.txt"), []byte("changed\n"), 0600)
+	if err != nil {
+		panic(err)
+	}
+	status.Modified[filepath.Join("other", "file3.txt")] = true
+
+	removeOutsideSparse(sandbox1, status, []string{"folder"})
+
+	_, err = os.Stat(filepath.Join(sandbox1, "README.md"))
+	if !os.IsNotExist(err) {
+		t.Errorf("File outside of the sparse paths was not removed")
+	}
+	_, err = os.Stat(filepath.Join(sandbox1, "other", "file3.txt"))
+	if err != nil {
+		t.Errorf("Modified file outside of the sparse paths was removed")
+	}
+
+	metadata := status.metaData
+	metadata.sparse = []string{"folder"}
+	for rel, _ := range metadata.pathMap {
+		if inside, _ := pathInScope(metadata.sparse, rel); !inside {
+			delete(metadata.pathMap, rel)
+		}
+	}
+	err = metadata.save(filepath.Join(sandbox1, metadataFileName))
+	if err != nil {
+		panic(err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(sandbox1, "added.txt"), []byte("added\n"), 0600)
+	if err != nil {
+		panic(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(sandbox1, "folder", "added.txt"), []byte("added\n"), 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	status, err = scmStatus(sandbox1, NO_COPY, false)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+
+	if !reflect.DeepEqual(status.metaData.sparse, []string{"folder"}) {
+		t.Errorf("Sparse paths were not saved: %v", status.metaData.sparse)
+	}
+	if !reflect.DeepEqual(status.Added, map[string]bool{filepath.Join("folder", "added.txt"): true}) || len(status.Modified) != 0 || len(status.Deleted) != 0 {
+		t.Errorf("Changes outside of the sparse paths were found: %v", status)
+	}
+	if !strings.Contains(status.String(), "Loaded paths: folder") {
+		t.Errorf("Sparse paths are not shown: %v", status)
+	}
+}
+
+func TestComponentLayout(t *testing.T) {
+	components := []FileInfo{
+		FileInfo{Name: "Web", ScmInfo: ScmInfo{ItemId: "_web"}},
+		FileInfo{Name: "Server: Core", ScmInfo: ScmInfo{ItemId: "_core"}},
+		FileInfo{Name: "Web", ScmInfo: ScmInfo{ItemId: "_web2"}},
+		FileInfo{Name: "Project Default Component", ScmInfo: ScmInfo{ItemId: "_default"}},
+	}
+
+	if selected := selectedComponents(components, []string{"_core", "_default"}); len(selected) != 2 || selected[0].Name != "Server: Core" {
+		t.Errorf("Unexpected components selected: %v", selected)
+	}
+	if selected := selectedComponents(components, nil); len(selected) != len(components) {
+		t.Errorf("All components should be selected when none are given: %v", selected)
+	}
+
+	dirs := assignComponentDirs(components, map[string]string{"_web2": "Web"})
+	expected := map[string]string{"_web": "Web-2", "_core": "Server_ Core", "_web2": "Web", "_default": "Project Default Component"}
+	if !reflect.DeepEqual(dirs, expected) {
+		t.Errorf("Unexpected component directories: %v", dirs)
+	}
+
+	collisions := componentCollisions(map[string][]FileInfo{
+		"Web":    []FileInfo{FileInfo{Name: "README.md"}, FileInfo{Name: "web"}},
+		"Server": []FileInfo{FileInfo{Name: "README.md"}, FileInfo{Name: "server"}},
+	})
+	if !reflect.DeepEqual(collisions, []string{"README.md (in Server, Web)"}) {
+		t.Errorf("Unexpected collisions: %v", collisions)
+	}
+
+	// Not even a component named like the default one is picked when
+	//  there's a choice
+	id, err := checkinComponent(components, "")
+	if err == nil {
+		t.Errorf("A component was picked when there is a choice: %v", id)
+	}
+	id, err = checkinComponent(components[:1], "")
+	if err != nil || id != components[0].ScmInfo.ItemId {
+		t.Errorf("The only component was not picked: %v %v", id, err)
+	}
+	id, err = checkinComponent(components[:2], "Server: Core")
+	if err != nil || id != "_core" {
+		t.Errorf("The named component was not picked: %v %v", id, err)
+	}
+
+	// Paths map between the sandbox and the components
+	metadata := newMetaData()
+	metadata.components = []string{"_web", "_core"}
+	metadata.componentDirs = map[string]string{"_web": "Web-2", "_core": "Server_ Core"}
+	metadata.pathMap["Web-2"] = metaObject{Path: "Web-2", ComponentId: "_web"}
+
+	if p := metadata.remotePath("_web", filepath.Join("Web-2", "src", "main.js")); p != "src/main.js" {
+		t.Errorf("Unexpected remote path: %v", p)
+	}
+	if p := metadata.remotePath("_web", "Web-2"); p != "." {
+		t.Errorf("The component folder is not the root of the component: %v", p)
+	}
+	if p := metadata.localPath("_core", "src/main.go"); p != filepath.Join("Server_ Core", "src", "main.go") {
+		t.Errorf("Unexpected local path: %v", p)
+	}
+	if p := metadata.loadedParent(filepath.Join("Web-2", "new", "file.txt")); p != "Web-2" {
+		t.Errorf("Unexpected loaded parent: %v", p)
+	}
+	if p := metadata.loadedParent(filepath.Join("new", "file.txt")); p != "." {
+		t.Errorf("Unexpected loaded parent: %v", p)
+	}
+
+	sandbox1 := createTestSandbox(map[string]string{})
+	defer os.RemoveAll(sandbox1)
+
+	err = metadata.save(filepath.Join(sandbox1, metadataFileName))
+	if err != nil {
+		panic(err)
+	}
+	loaded := newMetaData()
+	err = loaded.load(filepath.Join(sandbox1, metadataFileName))
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+	if !reflect.DeepEqual(loaded.components, metadata.components) || !reflect.DeepEqual(loaded.componentDirs, metadata.componentDirs) {
+		t.Errorf("Components were not saved: %v %v", loaded.components, loaded.componentDirs)
+	}
+}
+
+func TestSnapshotMetadata(t *testing.T) {
+	metadata := newMetaData()
+	if metadata.readOnly() || metadata.configurationString() != "" {
+		t.Errorf("A sandbox without a snapshot should not be read-only")
+	}
+	if ref := metadata.componentRef("_web"); ref != "_web" {
+		t.Errorf("Unexpected component reference: %v", ref)
+	}
+
+	metadata.snapshot = "Release 1.0"
+	metadata.baselines = map[string]baseline{
+		"_web":  baseline{ItemId: "_bl1", Name: "1.0 Web", Component: "Web"},
+		"_core": baseline{ItemId: "_bl2", Name: "1.0 Core", Component: "Core"},
+	}
+
+	if !metadata.readOnly() {
+		t.Errorf("A sandbox with a snapshot should be read-only")
+	}
+	if ref := metadata.componentRef("_web"); ref != "_web@_bl1" {
+		t.Errorf("Unexpected component reference: %v", ref)
+	}
+	if ref := metadata.componentRef("_other"); ref != "_other" {
+		t.Errorf("Unexpected component reference: %v", ref)
+	}
+	if s := metadata.configurationString(); s != "Snapshot: Release 1.0\nBaselines: Core=1.0 Core, Web=1.0 Web\n" {
+		t.Errorf("Unexpected configuration: %v", s)
+	}
+	if ids := baselineComponents(metadata.baselines); !reflect.DeepEqual(ids, []string{"_core", "_web"}) {
+		t.Errorf("Unexpected components: %v", ids)
+	}
+
+	sandbox1 := createTestSandbox(map[string]string{})
+	defer os.RemoveAll(sandbox1)
+
+	err := metadata.save(filepath.Join(sandbox1, metadataFileName))
+	if err != nil {
+		panic(err)
+	}
+	loaded := newMetaData()
+	err = loaded.load(filepath.Join(sandbox1, metadataFileName))
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+	if loaded.snapshot != metadata.snapshot || !reflect.DeepEqual(loaded.baselines, metadata.baselines) {
+		t.Errorf("Snapshot was not saved: %v %v", loaded.snapshot, loaded.baselines)
+	}
+
+	status, err := scmStatus(sandbox1, NO_COPY, false)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+	if !strings.Contains(status.String(), "Snapshot: Release 1.0") {
+		t.Errorf("Snapshot is not shown: %v", status)
+	}
+}
+
+// Serves hand-written responses by the path and query of the request,
+// remembering which paths were requested
+type syntheticTransport struct {
+	responses map[string]string
+	requested []string
+}
+
+func (transport *syntheticTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	key := request.URL.EscapedPath()
+	if request.URL.RawQuery != "" {
+		key = key + "?" + request.URL.RawQuery
+	}
+	transport.requested = append(transport.requested, key)
+
+	body, ok := transport.responses[key]
+	if !ok {
+		return &http.Response{StatusCode: 404, Status: "404 Not Found", Body: ioutil.NopCloser(strings.NewReader("")), Request: request}, nil
+	}
+	// The filesystem service tags its items with the time of the component
+	header := http.Header{}
+	header.Set("ETag", `W/"c 1400000000000"`)
+	return &http.Response{StatusCode: 200, Status: "200 OK", Header: header, Body: ioutil.NopCloser(strings.NewReader(body)), Request: request}, nil
+}
+
+func TestSnapshotConfiguration(t *testing.T) {
+	const (
+		filesystem = "/ccm/service/com.ibm.team.filesystem.service.jazzhub.IOrionFilesystem/pa/_/"
+		scmRest    = "/ccm/service/com.ibm.team.scm.common.internal.rest.IScmRestService/"
+	)
+
+	// These responses are synthetic, written in the shape that the code
+	//  expects rather than captured from a server. The test covers how the
+	//  configuration is resolved from them, not what the server sends.
+	transport := &syntheticTransport{responses: map[string]string{
+		filesystem + "_ws": `{"Name": "My Workspace", "Directory": true, "Children": [
+			{"Name": "Web", "Directory": true, "RTCSCM": {"ComponentId": "_web", "ItemId": "_web", "StateId": "_s1"}},
+			{"Name": "Core", "Directory": true, "RTCSCM": {"ComponentId": "_core", "ItemId": "_core", "StateId": "_s2"}}]}`,
+		scmRest + "baselineSets?workspaceItemId=_ws": `{"soapenv:Body": {"response": {"returnValue": {"type": "com.ibm.team.scm.common.internal.rest.dto.BaselineSetsDTO", "value": {"items": [
+			{"baselineSet": {"name": "Release 0.9", "itemId": "_set1", "baselines": [
+				{"name": "0.9 Web", "itemId": "_bl0", "component": {"itemId": "_web"}}]}},
+			{"baselineSet": {"name": "Release 1.0", "itemId": "_set2", "baselines": [
+				{"name": "1.0 Web", "itemId": "_bl1", "component": {"itemId": "_web"}},
+				{"name": "1.0 Core", "itemId": "_bl2", "component": {"itemId": "_core"}},
+				{"name": "1.0 Old", "itemId": "_bl3", "component": {"itemId": "_removed"}}]}}]}}}}}`,
+		scmRest + "baselines?componentItemId=_core": `{"soapenv:Body": {"response": {"returnValue": {"type": "com.ibm.team.scm.common.internal.rest.dto.BaselinesDTO", "value": {"items": [
+			{"baseline": {"name": "1.1 Core", "itemId": "_bl4", "component": {"itemId": "_core"}}}]}}}}}`,
+		filesystem + "_ws/_web@_bl1": `{"Name": "Web", "Directory": true, "RTCSCM": {"ComponentId": "_web", "ItemId": "_web", "StateId": "_s0"}}`,
+	}}
+
+	client, err := NewClient("", "")
+	if err != nil {
+		panic(err)
+	}
+	client.httpClient.Transport = transport
+	ccmBaseUrl := "https://hub.example.com/ccm"
+
+	baselines, err := findConfiguration(client, ccmBaseUrl, "_ws", "Release 1.0", []string{})
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+	expected := map[string]baseline{
+		"_web":  baseline{ItemId: "_bl1", Name: "1.0 Web", Component: "Web"},
+		"_core": baseline{ItemId: "_bl2", Name: "1.0 Core", Component: "Core"},
+	}
+	if !reflect.DeepEqual(baselines, expected) {
+		t.Errorf("Unexpected baselines of the snapshot: %v", baselines)
+	}
+
+	// A baseline given by name replaces the one of the snapshot
+	baselines, err = findConfiguration(client, ccmBaseUrl, "_ws", "_set2", []string{"Core=1.1 Core"})
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+	if b := baselines["_core"]; b.ItemId != "_bl4" || baselines["_web"].ItemId != "_bl1" {
+		t.Errorf("Unexpected baselines: %v", baselines)
+	}
+
+	for _, missing := range [][]string{{"Release 2.0"}, {"", "Core=2.0 Core"}, {"", "Other=1.0"}, {"", "Core"}} {
+		_, err = findConfiguration(client, ccmBaseUrl, "_ws", missing[0], missing[1:])
+		if _, ok := err.(*JazzError); !ok {
+			t.Errorf("Configuration %v should not be found: %v", missing, err)
+		}
+	}
+
+	// The filesystem service is asked for the component at its baseline
+	metadata := newMetaData()
+	metadata.baselines = expected
+	root, err := Open(client, ccmBaseUrl, "_ws", metadata.componentRef("_web"), "/")
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+	if root.info.ScmInfo.StateId != "_s0" {
+		t.Errorf("Unexpected state of the baseline: %v", root.info.ScmInfo)
+	}
+	if last := transport.requested[len(transport.requested)-1]; last != filesystem+"_ws/_web@_bl1" {
+		t.Errorf("Unexpected request: %v", last)
+	}
+}
+
+func TestExportArchive(t *testing.T) {
+	modTime := time.Date(2014, 10, 18, 9, 30, 0, 0, time.UTC)
+
+	for _, name := range []string{"src.tar", "src.tar.gz", "src.zip"} {
+		buffer := &bytes.Buffer{}
+		archive, err := createArchive(name, buffer)
+		if err != nil {
+			t.Fatalf("%v", err.Error())
+		}
+
+		err = archive.addDir("folder", modTime)
+		if err != nil {
+			t.Fatalf("%v", err.Error())
+		}
+		err = archive.addFile("folder/file.txt", 6, modTime, strings.NewReader("hello\n"))
+		if err != nil {
+			t.Fatalf("%v", err.Error())
+		}
+		err = archive.Close()
+		if err != nil {
+			t.Fatalf("%v", err.Error())
+		}
+
+		entries := make(map[string]string)
+		if strings.HasSuffix(name, ".zip") {
+			reader, err := zip.NewReader(bytes.NewReader(buffer.Bytes()), int64(buffer.Len()))
+			if err != nil {
+				t.Fatalf("%v", err.Error())
+			}
+			for _, f := range reader.File {
+				if !f.ModTime().Equal(modTime) {
+					t.Errorf("Wrong time for %v: %v", f.Name, f.ModTime())
+				}
+				r, err := f.Open()
+				if err != nil {
+					t.Fatalf("%v", err.Error())
+				}
+				b, _ := ioutil.ReadAll(r)
+				r.Close()
+				entries[f.Name] = string(b)
+			}
+		} else {
+			var r io.Reader = buffer
+			if strings.HasSuffix(name, ".gz") {
+				r, err = gzip.NewReader(buffer)
+				if err != nil {
+					t.Fatalf("%v", err.Error())
+				}
+			}
+			reader := tar.NewReader(r)
+			for {
+				header, err := reader.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("%v", err.Error())
+				}
+				if !header.ModTime.Equal(modTime) {
+					t.Errorf("Wrong time for %v: %v", header.Name, header.ModTime)
+				}
+				b, _ := ioutil.ReadAll(reader)
+				entries[header.Name] = string(b)
+			}
+		}
+
+		if !reflect.DeepEqual(entries, map[string]string{"folder/": "", "folder/file.txt": "hello\n"}) {
+			t.Errorf("Unexpected entries in %v: %v", name, entries)
+		}
+	}
+
+	// The size of a tar entry is known up front
+	archive, _ := createArchive("src.tar", &bytes.Buffer{})
+	err := archive.addFile("short.txt", 10, modTime, strings.NewReader("hello\n"))
+	if err == nil {
+		t.Errorf("A file with the wrong size was archived")
+	}
+
+	_, err = createArchive("src.rar", &bytes.Buffer{})
+	if err == nil {
+		t.Errorf("Unknown archive format was accepted")
+	}
+}
+
+func TestRemoteItem(t *testing.T) {
+	component := FileInfo{Name: "Web", ScmInfo: ScmInfo{ItemId: "_web"}}
+	info := FileInfo{Name: "main.js", Length: 42, LocalTimeStamp: 1413624600000, ScmInfo: ScmInfo{ItemId: "_item", StateId: "_state"}}
+
+	item := newRemoteItem("/src/main.js", info, component)
+	expected := remoteItem{Path: "src/main.js", Size: 42, Modified: time.Unix(1413624600, 0).Format(time.RFC3339), Component: "Web", ComponentId: "_web", ItemId: "_item", StateId: "_state"}
+	if !reflect.DeepEqual(item, expected) {
+		t.Errorf("Unexpected item: %v", item)
+	}
+	if !strings.Contains(item.String(), "State ID: _state\n") || !strings.Contains(item.String(), "Size: 42\n") {
+		t.Errorf("Unexpected description: %v", item)
+	}
+
+	root := newRemoteItem("/", FileInfo{Directory: true}, component)
+	if root.Path != "." || root.Modified != "" || strings.Contains(root.String(), "Size") {
+		t.Errorf("Unexpected root: %v", root)
+	}
+
+	items := []remoteItem{item, root}
+	sort.Sort(remoteItemsByPath(items))
+	if items[0].Path != "." {
+		t.Errorf("Items were not sorted: %v", items)
+	}
+}
+
+func TestGrep(t *testing.T) {
+	re := regexp.MustCompile("Open\\(")
+
+	matches, err := grepReader(strings.NewReader("package main\r\n\nf, err := Open(path)\nOpen(other)"), re)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+	expected := []grepMatch{grepMatch{line: 3, text: "f, err := Open(path)"}, grepMatch{line: 4, text: "Open(other)"}}
+	if !reflect.DeepEqual(matches, expected) {
+		t.Errorf("Unexpected matches: %v", matches)
+	}
+
+	matches, err = grepReader(strings.NewReader("Open(\x00binary"), re)
+	if err != nil || len(matches) != 0 {
+		t.Errorf("Binary contents were searched: %v %v", matches, err)
+	}
+
+	// Lines longer than the buffer
+	long := strings.Repeat("x", 3*grepBinaryCheckSize) + "Open("
+	matches, err = grepReader(strings.NewReader("first\n"+long+"\n"), re)
+	if err != nil || len(matches) != 1 || matches[0].line != 2 || matches[0].text != long {
+		t.Errorf("Long line was not matched: %v %v", len(matches), err)
+	}
+
+	filter := newGrepFilter([]string{"*.go", "/docs/*.md"}, []string{"vendor"})
+	for rel, included := range map[string]bool{
+		filepath.Join("src", "main.go"):      true,
+		filepath.Join("docs", "README.md"):   true,
+		filepath.Join("src", "docs", "x.md"): false,
+		filepath.Join("src", "main.js"):      false,
+		// Excluded folders are skipped by the walk
+		filepath.Join("vendor", "lib.go"): true,
+		filepath.Join("src", "vendor"):    false,
+	} {
+		if filter.included(rel) != included {
+			t.Errorf("Wrong filter result for %v", rel)
+		}
+	}
+	if !filter.excluded("vendor", true) {
+		t.Errorf("Excluded folder was not excluded")
+	}
+	if !newGrepFilter(nil, nil).included("anything.bin") {
+		t.Errorf("All files should be searched without includes")
+	}
+}
+
+func TestDownloadCache(t *testing.T) {
+	cacheDir, err := ioutil.TempDir(os.TempDir(), "gojazz-test-cache")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	sandbox1 := createTestSandbox(map[string]string{})
+	defer os.RemoveAll(sandbox1)
+
+	cache, err := openDownloadCache(cacheDir)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+	if !cache.enabled || cache.maxSize != defaultCacheSize || cache.hardlink {
+		t.Errorf("Unexpected default settings: %v", cache)
+	}
+
+	// Nothing is cached yet
+	localPath := filepath.Join(sandbox1, "file.txt")
+	_, ok := cache.fetch("_item", "_state", localPath, sandbox1, false)
+	if ok {
+		t.Errorf("File was found in an empty cache")
+	}
+
+	contents := "cached contents\n"
+	writer, err := cache.createWriter()
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+	writer.Write([]byte(contents))
+	sum := sha1.Sum([]byte(contents))
+	hash := base64.StdEncoding.EncodeToString(sum[:])
+	err = writer.commit("_item", "_state", hash)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+
+	fetched, ok := cache.fetch("_item", "_state", localPath, sandbox1, false)
+	if !ok || fetched != hash {
+		t.Fatalf("File was not found in the cache")
+	}
+	b, _ := ioutil.ReadFile(localPath)
+	if string(b) != contents {
+		t.Errorf("Unexpected contents: %v", string(b))
+	}
+	if !hasBase(sandbox1, hash) {
+		t.Errorf("Pristine copy was not stored")
+	}
+
+	// Linked into the sandbox instead of copied
+	cache.hardlink = true
+	linkedPath := filepath.Join(sandbox1, "linked.txt")
+	_, ok = cache.fetch("_item", "_state", linkedPath, sandbox1, true)
+	if !ok {
+		t.Fatalf("File was not linked from the cache")
+	}
+	objectPath, _ := cache.objectPath(hash)
+	linkedStat, _ := os.Stat(linkedPath)
+	objectStat, _ := os.Stat(objectPath)
+	if linkedStat == nil || objectStat == nil || !os.SameFile(linkedStat, objectStat) {
+		t.Fatalf("File was not hard linked")
+	}
+	if linkedStat.Mode()&0222 != 0 {
+		t.Errorf("Linked file can be written into: %v", linkedStat.Mode())
+	}
+
+	// Using the object again leaves the files of the sandboxes alone
+	past := time.Now().Add(-time.Hour)
+	err = os.Chtimes(linkedPath, past, past)
+	if err != nil {
+		panic(err)
+	}
+	_, ok = cache.fetch("_item", "_state", filepath.Join(sandbox1, "linked2.txt"), sandbox1, true)
+	if !ok {
+		t.Fatalf("File was not linked from the cache")
+	}
+	if s, _ := os.Stat(linkedPath); s == nil || !s.ModTime().Equal(past) {
+		t.Errorf("Linked file was touched: %v", s)
+	}
+	if s, _ := os.Stat(cache.keyPath("_item", "_state")); s == nil || s.ModTime().Before(past.Add(time.Minute)) {
+		t.Errorf("The use was not recorded on the key")
+	}
+	cache.hardlink = false
+
+	// Damaged contents are thrown away
+	err = os.Chmod(linkedPath, 0600)
+	if err == nil {
+		err = ioutil.WriteFile(linkedPath, []byte("changed in place\n"), 0600)
+	}
+	if err != nil {
+		panic(err)
+	}
+	_, ok = cache.fetch("_item", "_state", filepath.Join(sandbox1, "other.txt"), sandbox1, true)
+	if ok {
+		t.Errorf("Damaged contents were used")
+	}
+	if _, err := os.Stat(objectPath); !os.IsNotExist(err) {
+		t.Errorf("Damaged contents were not removed")
+	}
+	if _, err := os.Stat(filepath.Join(sandbox1, "other.txt")); !os.IsNotExist(err) {
+		t.Errorf("Damaged contents were put into the sandbox")
+	}
+
+	// The least recently used files are evicted first
+	for idx, s := range []string{"first file\n", "second file\n", "third file\n"} {
+		sum := sha1.Sum([]byte(s))
+		h := base64.StdEncoding.EncodeToString(sum[:])
+		writer, err := cache.createWriter()
+		if err != nil {
+			t.Fatalf("%v", err.Error())
+		}
+		writer.Write([]byte(s))
+		err = writer.commit(fmt.Sprintf("_item%v", idx), "_state", h)
+		if err != nil {
+			t.Fatalf("%v", err.Error())
+		}
+		used := time.Now().Add(time.Duration(idx-10) * time.Minute)
+		os.Chtimes(cache.keyPath(fmt.Sprintf("_item%v", idx), "_state"), used, used)
+	}
+
+	removed, freed, err := cache.prune(int64(len("second file\n") + len("third file\n")))
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+	if removed != 1 || freed != int64(len("first file\n")) {
+		t.Errorf("Unexpected eviction: %v %v", removed, freed)
+	}
+	if _, err := os.Stat(cache.keyPath("_item0", "_state")); !os.IsNotExist(err) {
+		t.Errorf("Key of an evicted file was kept")
+	}
+	if _, err := os.Stat(cache.keyPath("_item1", "_state")); err != nil {
+		t.Errorf("Key of a cached file was removed")
+	}
+
+	// Settings are kept
+	cache.maxSize = 500 * 1024 * 1024
+	cache.hardlink = true
+	cache.enabled = false
+	err = cache.saveSettings()
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+	reopened, err := openDownloadCache(cacheDir)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+	if !reflect.DeepEqual(reopened, cache) {
+		t.Errorf("Settings were not kept: %v", reopened)
+	}
+}
+
+func TestSandboxRegistry(t *testing.T) {
+	sandbox1 := createTestSandbox(map[string]string{"file1.txt": "file1\n"})
+	defer os.RemoveAll(sandbox1)
+	sandbox2 := createTestSandbox(map[string]string{})
+	defer os.RemoveAll(sandbox2)
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "gojazz-test-data")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dataDir)
+	registry := filepath.Join(dataDir, registryFile)
+
+	sandboxes, err := registeredSandboxes(registry)
+	if err != nil || len(sandboxes) != 0 {
+		t.Errorf("Unexpected sandboxes without a registry: %v %v", sandboxes, err)
+	}
+
+	for _, p := range []string{sandbox1, sandbox2, sandbox1} {
+		err = registerSandbox(registry, p)
+		if err != nil {
+			t.Fatalf("%v", err.Error())
+		}
+	}
+
+	sandboxes, err = registeredSandboxes(registry)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+	expected := []string{sandbox1, sandbox2}
+	sort.Strings(expected)
+	if !reflect.DeepEqual(sandboxes, expected) {
+		t.Errorf("Unexpected sandboxes: %v", sandboxes)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(sandbox1, "file1.txt"), []byte("changed\n"), 0600)
+	if err != nil {
+		panic(err)
+	}
+	if d := describeSandbox(sandbox1, true); !strings.Contains(d, "1 change") {
+		t.Errorf("Unexpected description: %v", d)
+	}
+	if d := describeSandbox(sandbox2, true); !strings.Contains(d, "no changes") {
+		t.Errorf("Unexpected description: %v", d)
+	}
+	if d := describeSandbox(sandbox1, false); strings.Contains(d, "change") {
+		t.Errorf("Changes were counted: %v", d)
+	}
+
+	err = unregisterSandboxes(registry, []string{sandbox2})
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+	sandboxes, _ = registeredSandboxes(registry)
+	if !reflect.DeepEqual(sandboxes, []string{sandbox1}) {
+		t.Errorf("Sandbox was not removed: %v", sandboxes)
+	}
+
+	// Sandboxes added while others are removed are kept
+	added := []string{}
+	for i := 0; i < 10; i++ {
+		added = append(added, filepath.Join(dataDir, fmt.Sprintf("sandbox%v", i)))
+	}
+	var wg sync.WaitGroup
+	for _, p := range added {
+		wg.Add(2)
+		go func(p string) {
+			defer wg.Done()
+			if err := registerSandbox(registry, p); err != nil {
+				t.Errorf("%v", err.Error())
+			}
+		}(p)
+		go func() {
+			defer wg.Done()
+			if err := unregisterSandboxes(registry, []string{sandbox1}); err != nil {
+				t.Errorf("%v", err.Error())
+			}
+		}()
+	}
+	wg.Wait()
+
+	sandboxes, _ = registeredSandboxes(registry)
+	sort.Strings(added)
+	if !reflect.DeepEqual(sandboxes, added) {
+		t.Errorf("Unexpected sandboxes: %v", sandboxes)
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, lockFileName)); !os.IsNotExist(err) {
+		t.Errorf("The registry is still locked")
+	}
+}
+
+// Answers every request with the same body without a server
+type fakeTransport struct {
+	body string
+}
+
+func (transport *fakeTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if request.Body != nil {
+		ioutil.ReadAll(request.Body)
+		request.Body.Close()
+	}
+
+	return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(transport.body)), Request: request}, nil
+}
+
+func TestTransferLimits(t *testing.T) {
+	downloads, walkers, uploads, rate, bandwidth := numDownloadGoroutines, numWalkGoroutines, numUploadGoroutines, requestRateLimit, bandwidthLimit
+	defer func() {
+		numDownloadGoroutines, numWalkGoroutines, numUploadGoroutines, requestRateLimit, bandwidthLimit = downloads, walkers, uploads, rate, bandwidth
+	}()
+
+	dataDir, err := ioutil.TempDir(os.TempDir(), "gojazz-test-data")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dataDir)
+	settings := filepath.Join(dataDir, transferSettingsFile)
+
+	err = ioutil.WriteFile(settings, []byte("# Slow connection\ndownloads 3\nwalkers 2\nuploads 1\nrate 20\nbandwidth 1KB\n"), 0600)
+	if err != nil {
+		panic(err)
+	}
+	err = parseTransferSettings(settings)
+	if err != nil {
+		t.Fatalf("%v", err.Error())
+	}
+	if numDownloadGoroutines != 3 || numWalkGoroutines != 2 || numUploadGoroutines != 1 || requestRateLimit != 20 || bandwidthLimit != 1024 {
+		t.Errorf("Unexpected settings: %v %v %v %v %v", numDownloadGoroutines, numWalkGoroutines, numUploadGoroutines, requestRateLimit, bandwidthLimit)
+	}
+
+	for _, invalid := range []string{"downloads 0\n", "rate fast\n", "speed 10\n", "walkers\n"} {
+		err = ioutil.WriteFile(settings, []byte(invalid), 0600)
+		if err != nil {
+			panic(err)
+		}
+		if parseTransferSettings(settings) == nil {
+			t.Errorf("Invalid setting was accepted: %v", invalid)
+		}
+	}
+
+	// A burst is spread out over time
+	p := newPacer(10)
+	if d := p.reserve(1); d != 0 {
+		t.Errorf("The first use should not wait: %v", d)
+	}
+	p.reserve(1)
+	if d := p.reserve(5); d < 150*time.Millisecond || d > 200*time.Millisecond {
+		t.Errorf("Unexpected wait: %v", d)
+	}
+	if newPacer(0) != nil {
+		t.Errorf("No limit should not need a pacer")
+	}
+
+	stats := &transferStats{start: time.Now()}
+	transport := &limitedTransport{transport: &fakeTransport{body: strings.Repeat("x", 100)}, requests: newPacer(50), bandwidth: newPacer(1000), stats: stats}
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		request, err := http.NewRequest("PUT", "https://example.com/file", strings.NewReader("uploaded"))
+		if err != nil {
+			panic(err)
+		}
+
+		body, getBody := request.Body, request.GetBody
+		response, err := transport.RoundTrip(request)
+		if err != nil {
+			t.Fatalf("%v", err.Error())
+		}
+		if request.Body != body || getBody == nil {
+			t.Errorf("The request of the caller was changed")
+		}
+		b, err := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil || len(b) != 100 {
+			t.Errorf("Unexpected body: %v %v", len(b), err)
+		}
+	}
+
+	if stats.requests != 3 || stats.bytesDown != 300 || stats.bytesUp != 24 {
+		t.Errorf("Unexpected statistics: %v", stats)
+	}
+	// The last read waits for the 224 bytes before it to use the bandwidth
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("The transfers were not limited: %v", elapsed)
+	}
+	if s := stats.String(); !strings.HasPrefix(s, "3 requests") {
+		t.Errorf("Unexpected statistics: %v", s)
+	}
+}
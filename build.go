@@ -1076,6 +1076,7 @@ func buildDefaults() {
 }
 
 func buildOp() {
+	operation := commandLine()
 	commandIndex := -1
 	for idx, arg := range os.Args {
 		if arg == "--" {
@@ -1092,6 +1093,7 @@ func buildOp() {
 	os.Args = os.Args[:commandIndex]
 
 	sandboxPath := flag.String("sandbox", "", "Location of the sandbox to sync the files")
+	wait := flag.Duration("wait", 0, "How long to wait for another operation on the sandbox to finish instead of failing right away.")
 	flag.Usage = buildDefaults
 	flag.Parse()
 
@@ -1105,12 +1107,18 @@ func buildOp() {
 		sandboxPath = &path
 	}
 
+	lock, err := lockSandbox(*sandboxPath, operation, *wait)
+	if err != nil {
+		panic(err)
+	}
+	defer lock.unlock()
+
 	// Hack to allow bootstrapping of non-Jazz SCM projects
 	projectName := os.Getenv("GOJAZZ_PROJECT")
 	var status *status = nil
 
 	if projectName == "" {
-		status, _ = scmStatus(*sandboxPath, NO_COPY)
+		status, _ = scmStatus(*sandboxPath, NO_COPY, false)
 		if status == nil {
 			// No sandbox here, fail
 			panic(simpleWarning("Sorry, there is no source code here to build. Run 'gojazz load' first to load the project's stream."))
@@ -1136,7 +1144,10 @@ func buildOp() {
 
 	if status != nil {
 		fmt.Printf("Loading the latest changes into the build sandbox...\n")
-		scmLoad(client, ccmBaseUrl, projectName, status.metaData.workspaceId, status.metaData.isstream, userId, *sandboxPath, status, true)
+		options := status.metaData.loadOptions()
+		options.force = true
+		options.clobber = true
+		scmLoad(client, ccmBaseUrl, projectName, status.metaData.workspaceId, status.metaData.isstream, userId, *sandboxPath, status, options)
 	}
 
 	// Find the build engine and build definition for the project
@@ -0,0 +1,596 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	cacheFolder       = "cache"
+	cacheSettingsFile = "settings.txt"
+	defaultCacheSize  = 2 * 1024 * 1024 * 1024
+)
+
+// The download cache keeps the contents of the files that were loaded into
+// any of the user's sandboxes so that loading the same version of a file
+// again doesn't download it. Objects are stored by their SHA-1 hash, like
+// the base store of a sandbox, and keys map the item and state IDs of a
+// file to the hash. The contents are checked against the hash whenever
+// they are taken from the cache. Objects are evicted when the cache grows
+// past its size limit, the least recently used first. The use is recorded
+// on the keys, hard linked objects are shared with the sandboxes and their
+// times belong to the sandboxes.
+type downloadCache struct {
+	dir string
+
+	enabled bool
+	maxSize int64
+
+	// Link the files into the sandboxes instead of copying them
+	hardlink bool
+}
+
+// The cache in the gojazz data directory, nil if it is turned off or can't
+// be used. Loads work without the cache.
+func openUserCache() *downloadCache {
+	usr, err := user.Current()
+	if err != nil {
+		return nil
+	}
+
+	cache, err := openDownloadCache(filepath.Join(usr.HomeDir, gojazzDataDir, cacheFolder))
+	if err != nil {
+		fmt.Printf("Warning: The download cache can't be used: %v\n", err.Error())
+		return nil
+	}
+
+	if !cache.enabled {
+		return nil
+	}
+
+	return cache
+}
+
+// Open the cache in the directory with its settings
+func openDownloadCache(dir string) (*downloadCache, error) {
+	cache := &downloadCache{dir: dir, enabled: true, maxSize: defaultCacheSize}
+
+	file, err := os.Open(filepath.Join(dir, cacheSettingsFile))
+	if os.IsNotExist(err) {
+		return cache, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+
+		switch fields[0] {
+		case "enabled":
+			cache.enabled = fields[1] == "true"
+		case "maxsize":
+			size, err := parseSize(fields[1])
+			if err != nil {
+				return nil, err
+			}
+			cache.maxSize = size
+		case "link":
+			cache.hardlink = fields[1] == "hardlink"
+		}
+	}
+
+	return cache, scanner.Err()
+}
+
+func (cache *downloadCache) saveSettings() error {
+	err := os.MkdirAll(cache.dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	link := "copy"
+	if cache.hardlink {
+		link = "hardlink"
+	}
+
+	settings := fmt.Sprintf("enabled %v\nmaxsize %vB\nlink %v\n", cache.enabled, cache.maxSize, link)
+	return ioutil.WriteFile(filepath.Join(cache.dir, cacheSettingsFile), []byte(settings), 0600)
+}
+
+func (cache *downloadCache) objectPath(hash string) (string, error) {
+	sum, err := base64.StdEncoding.DecodeString(hash)
+	if err != nil {
+		return "", err
+	}
+
+	name := hex.EncodeToString(sum)
+	if len(name) < 3 {
+		return "", simpleWarning("Invalid content hash " + hash)
+	}
+
+	return filepath.Join(cache.dir, "objects", name[:2], name[2:]), nil
+}
+
+func (cache *downloadCache) keyPath(itemId string, stateId string) string {
+	return filepath.Join(cache.dir, "keys", itemId, stateId)
+}
+
+// Forget the contents of a file that turned out to be damaged
+func (cache *downloadCache) discard(itemId string, stateId string, objectPath string) {
+	os.Remove(objectPath)
+	os.Remove(cache.keyPath(itemId, stateId))
+}
+
+// Put the cached contents of the version of the file into the sandbox, and
+// into the base store unless there are no pristine copies. Returns the hash
+// of the contents and whether they were in the cache.
+func (cache *downloadCache) fetch(itemId string, stateId string, localPath string, sandboxPath string, noPristine bool) (string, bool) {
+	b, err := ioutil.ReadFile(cache.keyPath(itemId, stateId))
+	if err != nil {
+		return "", false
+	}
+	hash := strings.TrimSpace(string(b))
+
+	objectPath, err := cache.objectPath(hash)
+	if err != nil {
+		return "", false
+	}
+
+	if cache.hardlink {
+		linked, err := cache.link(itemId, stateId, hash, objectPath, localPath, sandboxPath, noPristine)
+		if err != nil {
+			return "", false
+		}
+		if linked {
+			return hash, true
+		}
+
+		// Sandboxes on another file system get a copy
+	}
+
+	object, err := os.Open(objectPath)
+	if err != nil {
+		return "", false
+	}
+	defer object.Close()
+
+	localFile, err := createDownloadWriter(localPath)
+	if err != nil {
+		return "", false
+	}
+	var tee io.Writer = localFile
+
+	var baseFile *baseWriter
+	if !noPristine {
+		baseFile, err = createBaseWriter(sandboxPath)
+		if err != nil {
+			localFile.abort()
+			return "", false
+		}
+		tee = io.MultiWriter(localFile, baseFile)
+	}
+
+	_, err = io.Copy(tee, object)
+	if err == nil && localFile.sum() != hash {
+		cache.discard(itemId, stateId, objectPath)
+		err = simpleWarning("The cached contents are damaged")
+	}
+	if err == nil {
+		err = localFile.commit(-1, hash)
+	}
+	if err != nil {
+		localFile.abort()
+		if baseFile != nil {
+			baseFile.abort()
+		}
+		return "", false
+	}
+
+	if baseFile != nil {
+		err = baseFile.commit(hash)
+		if err != nil {
+			return "", false
+		}
+	}
+
+	cache.touch(itemId, stateId)
+	return hash, true
+}
+
+// Hard link the cached contents into the sandbox after checking them. The
+// contents aren't linked if the file system doesn't allow it, such as when
+// the sandbox is on a different one.
+func (cache *downloadCache) link(itemId string, stateId string, hash string, objectPath string, localPath string, sandboxPath string, noPristine bool) (bool, error) {
+	verified, err := hashFile(objectPath)
+	if err != nil {
+		return false, err
+	}
+	if verified != hash {
+		cache.discard(itemId, stateId, objectPath)
+		return false, simpleWarning("The cached contents are damaged")
+	}
+
+	// Files that are linked can't be written into, which would change the
+	//  cached contents for every sandbox. Editors that save by replacing
+	//  the file break the link instead.
+	err = os.Chmod(objectPath, 0444)
+	if err != nil {
+		return false, err
+	}
+
+	err = linkDownload(localPath, objectPath)
+	if err != nil {
+		return false, nil
+	}
+
+	if !noPristine && !hasBase(sandboxPath, hash) {
+		object, err := os.Open(objectPath)
+		if err != nil {
+			return false, err
+		}
+		defer object.Close()
+
+		err = storeBase(sandboxPath, hash, object)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	cache.touch(itemId, stateId)
+	return true, nil
+}
+
+// Record the use of an object on its key so that it is evicted last
+func (cache *downloadCache) touch(itemId string, stateId string) {
+	now := time.Now()
+	os.Chtimes(cache.keyPath(itemId, stateId), now, now)
+}
+
+// Writes downloaded contents into the cache. They are only added to the
+// cache by commit, once the download is complete and verified. A cache that
+// can't be written doesn't stop the download.
+type cacheWriter struct {
+	cache  *downloadCache
+	file   *os.File
+	failed bool
+}
+
+func (cache *downloadCache) createWriter() (*cacheWriter, error) {
+	dir := filepath.Join(cache.dir, "tmp")
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := ioutil.TempFile(dir, "tmp")
+	if err != nil {
+		return nil, err
+	}
+
+	return &cacheWriter{cache: cache, file: file}, nil
+}
+
+func (writer *cacheWriter) Write(p []byte) (int, error) {
+	if !writer.failed {
+		_, err := writer.file.Write(p)
+		writer.failed = err != nil
+	}
+
+	return len(p), nil
+}
+
+func (writer *cacheWriter) commit(itemId string, stateId string, hash string) error {
+	err := writer.file.Close()
+	if err == nil && writer.failed {
+		err = simpleWarning("The contents could not be written to the cache")
+	}
+	if err != nil {
+		writer.abort()
+		return err
+	}
+
+	objectPath, err := writer.cache.objectPath(hash)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(objectPath), 0700)
+	}
+	if err == nil {
+		err = os.Rename(writer.file.Name(), objectPath)
+	}
+	if err != nil {
+		writer.abort()
+		return err
+	}
+
+	// The key is written in one go so that it is never seen half written
+	keyPath := writer.cache.keyPath(itemId, stateId)
+	err = os.MkdirAll(filepath.Dir(keyPath), 0700)
+	if err != nil {
+		return err
+	}
+
+	key, err := ioutil.TempFile(filepath.Join(writer.cache.dir, "tmp"), "key")
+	if err != nil {
+		return err
+	}
+	_, err = key.WriteString(hash)
+	key.Close()
+	if err == nil {
+		err = os.Rename(key.Name(), keyPath)
+	}
+	if err != nil {
+		os.Remove(key.Name())
+	}
+
+	return err
+}
+
+func (writer *cacheWriter) abort() {
+	writer.file.Close()
+	os.Remove(writer.file.Name())
+}
+
+// An object in the cache
+type cacheObject struct {
+	path string
+	size int64
+	used time.Time
+}
+
+// The objects in the cache, the least recently used first. An object was
+// last used when any of its keys was, or when it was added if it has none.
+func (cache *downloadCache) objects() ([]cacheObject, error) {
+	objects := []cacheObject{}
+
+	used := make(map[string]time.Time)
+	err := filepath.Walk(filepath.Join(cache.dir, "keys"), func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil
+		}
+
+		objectPath, err := cache.objectPath(strings.TrimSpace(string(b)))
+		if err == nil && info.ModTime().After(used[objectPath]) {
+			used[objectPath] = info.ModTime()
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = filepath.Walk(filepath.Join(cache.dir, "objects"), func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if !info.IsDir() {
+			object := cacheObject{path: p, size: info.Size(), used: info.ModTime()}
+			if t, ok := used[p]; ok {
+				object.used = t
+			}
+			objects = append(objects, object)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Sort(cacheObjectsByUse(objects))
+
+	return objects, nil
+}
+
+type cacheObjectsByUse []cacheObject
+
+func (objects cacheObjectsByUse) Len() int           { return len(objects) }
+func (objects cacheObjectsByUse) Swap(i, j int)      { objects[i], objects[j] = objects[j], objects[i] }
+func (objects cacheObjectsByUse) Less(i, j int) bool { return objects[i].used.Before(objects[j].used) }
+
+// Evict the least recently used objects until the cache fits into the size
+// and remove the keys of the objects that are gone. Returns the number of
+// objects removed and their size.
+func (cache *downloadCache) prune(maxSize int64) (int, int64, error) {
+	objects, err := cache.objects()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	total := int64(0)
+	for _, object := range objects {
+		total += object.size
+	}
+
+	removed := 0
+	freed := int64(0)
+	for _, object := range objects {
+		if total-freed <= maxSize {
+			break
+		}
+
+		err = os.Remove(object.path)
+		if err != nil && !os.IsNotExist(err) {
+			return removed, freed, err
+		}
+
+		removed++
+		freed += object.size
+	}
+
+	if removed == 0 {
+		return 0, 0, nil
+	}
+
+	err = filepath.Walk(filepath.Join(cache.dir, "keys"), func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil
+		}
+
+		objectPath, err := cache.objectPath(strings.TrimSpace(string(b)))
+		if err != nil {
+			return os.Remove(p)
+		}
+		if _, err := os.Stat(objectPath); os.IsNotExist(err) {
+			return os.Remove(p)
+		}
+
+		return nil
+	})
+
+	return removed, freed, err
+}
+
+func (cache *downloadCache) String() string {
+	link := "copied into sandboxes"
+	if cache.hardlink {
+		link = "hard linked into sandboxes"
+	}
+
+	result := "Location: " + cache.dir + "\n"
+	if !cache.enabled {
+		result = result + "The cache is turned off\n"
+	}
+
+	objects, err := cache.objects()
+	if err != nil {
+		panic(err)
+	}
+	total := int64(0)
+	for _, object := range objects {
+		total += object.size
+	}
+
+	result = result + fmt.Sprintf("Files: %v\n", len(objects))
+	result = result + fmt.Sprintf("Size: %v of %v\n", formatSize(total), formatSize(cache.maxSize))
+	result = result + "Files are " + link + "\n"
+
+	return result
+}
+
+func cacheDefaults() {
+	fmt.Printf("gojazz cache [options]\n")
+	flag.PrintDefaults()
+}
+
+func cacheOp() {
+	maxSize := flag.String("max-size", "", "Limit the size of the cache, such as 500MB or 5GB. The least recently used files are removed first.")
+	link := flag.String("link", "", "How files are put into sandboxes, 'copy' or 'hardlink'. Hard links save disk space. Linked files are read-only because writing into one would change it in every sandbox, so edits must replace the file rather than write into it. Use them for sandboxes that aren't edited such as those of builds.")
+	enabled := flag.Bool("enabled", true, "Use the cache for loads.")
+	prune := flag.Bool("prune", false, "Remove the least recently used files until the cache fits into its size limit.")
+	clear := flag.Bool("clear", false, "Remove all of the files in the cache.")
+	flag.Usage = cacheDefaults
+	flag.Parse()
+
+	usr, err := user.Current()
+	if err != nil {
+		panic(err)
+	}
+
+	cache, err := openDownloadCache(filepath.Join(usr.HomeDir, gojazzDataDir, cacheFolder))
+	if err != nil {
+		panic(err)
+	}
+
+	changed := false
+	enabledSet := false
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "max-size", "link":
+			changed = true
+		case "enabled":
+			changed = true
+			enabledSet = true
+		}
+	})
+
+	if changed {
+		if *maxSize != "" {
+			cache.maxSize, err = parseSize(*maxSize)
+			if err != nil {
+				panic(simpleWarning("Invalid size " + *maxSize))
+			}
+		}
+
+		switch *link {
+		case "":
+		case "copy":
+			cache.hardlink = false
+		case "hardlink":
+			cache.hardlink = true
+		default:
+			panic(simpleWarning("Files can be put into sandboxes with 'copy' or 'hardlink', not " + strconv.Quote(*link)))
+		}
+
+		if enabledSet {
+			cache.enabled = *enabled
+		}
+
+		err = cache.saveSettings()
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if *prune || *clear || changed {
+		limit := cache.maxSize
+		if *clear {
+			limit = 0
+		}
+
+		removed, freed, err := cache.prune(limit)
+		if err != nil {
+			panic(err)
+		}
+		if removed > 0 {
+			fmt.Printf("Removed %v files (%v)\n", removed, formatSize(freed))
+		}
+	}
+
+	fmt.Printf("%v", cache)
+}
@@ -12,6 +12,7 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 )
 
 func checkinDefaults() {
@@ -20,9 +21,14 @@ func checkinDefaults() {
 }
 
 func checkinOp() {
+	operation := commandLine()
 	sandboxPath := flag.String("sandbox", "", "Location of the sandbox to load the files")
+	componentName := flag.String("component", "", "Component that new files and folders at the top of the sandbox are added to. Needed when there is more than one component.")
+	wait := flag.Duration("wait", 0, "How long to wait for another operation on the sandbox to finish instead of failing right away.")
+	applyTransferFlags := transferFlags()
 	flag.Usage = checkinDefaults
 	flag.Parse()
+	applyTransferFlags()
 
 	if *sandboxPath == "" {
 		path, err := os.Getwd()
@@ -34,7 +40,13 @@ func checkinOp() {
 		sandboxPath = &path
 	}
 
-	status, err := scmStatus(*sandboxPath, STAGE)
+	lock, err := lockSandbox(*sandboxPath, operation, *wait)
+	if err != nil {
+		panic(err)
+	}
+	defer lock.unlock()
+
+	status, err := scmStatus(*sandboxPath, STAGE, false)
 	if err != nil {
 		panic(err)
 	}
@@ -44,6 +56,8 @@ func checkinOp() {
 		return
 	}
 
+	fmt.Fprintf(os.Stderr, "%v", status.largeFileWarnings())
+
 	if status.unchanged() {
 		panic(simpleWarning("Sandbox is unchanged. Nothing was checked in."))
 		return
@@ -59,7 +73,8 @@ func checkinOp() {
 		panic(err)
 	}
 
-	scmCheckin(client, status, *sandboxPath)
+	scmCheckin(client, status, *sandboxPath, *componentName)
+	fmt.Printf("Transferred %v\n", client.Statistics())
 
 	// Force a load/reload of the jazzhub sandbox to avoid out of sync when
 	//  looking at the changes page
@@ -72,12 +87,25 @@ func checkinOp() {
 	fmt.Printf("https://login.jazz.net/psso/proxy/jazzlogin?redirect_uri=%v\n", url.QueryEscape(redirect))
 }
 
-func scmCheckin(client *Client, status *status, sandboxPath string) {
+// Check in the changes in the status. New items at the top of the sandbox
+// are added to the named component, which can be left empty if there is
+// only one component.
+func scmCheckin(client *Client, status *status, sandboxPath string, componentName string) {
 	// Get the workspace in order to force the authentication to happen
 	//  and get the list of components.
 	workspaceId := status.metaData.workspaceId
 	ccmBaseUrl := status.metaData.ccmBaseUrl
 
+	if status.metaData.readOnly() {
+		panic(simpleWarning("This sandbox was loaded from a snapshot or baselines, changes to it can't be checked in. Load the latest with 'gojazz load -snapshot=' first."))
+	}
+
+	// Merge conflicts must be resolved first
+	unresolved := unresolvedConflicts(status)
+	if len(unresolved) > 0 {
+		panic(simpleWarning("These files still have conflicts from a merge, resolve them and try again:\n" + strings.Join(unresolved, "\n")))
+	}
+
 	components, err := FindComponents(client, status.metaData.ccmBaseUrl, status.metaData.workspaceId)
 	if err != nil {
 		panic(err)
@@ -89,67 +117,27 @@ func scmCheckin(client *Client, status *status, sandboxPath string) {
 	//      to attach the local changes
 	//   - Ask them if they wish to proceed
 
-	defaultComponentId := ""
-	for idx, component := range components {
-		if idx == 0 || strings.HasSuffix(component.Name, "Default Component") {
-			defaultComponentId = component.ScmInfo.ItemId
-			break
-		}
-	}
-	if defaultComponentId == "" {
-		panic(simpleWarning("There are no components in your repository workspace."))
+	defaultComponentId, componentErr := checkinComponent(selectedComponents(components, status.metaData.components), componentName)
+	if componentErr != nil && componentName != "" {
+		panic(componentErr)
 	}
 
-	for modifiedpath, _ := range status.Modified {
-		fmt.Printf("%v (Modified)\n", modifiedpath)
-
-		localpath := filepath.Join(sandboxPath, modifiedpath)
-		stagepath := filepath.Join(sandboxPath, stageFolder, modifiedpath)
-		remotepath := filepath.ToSlash(modifiedpath)
-
-		meta, ok := status.metaData.get(localpath, sandboxPath)
-		componentId := ""
-		if !ok {
-			// This shouldn't happen. Log the stack if it does.
-			panic(&JazzError{Msg: "Metadata not found for file that was found in the metadata", Log: true})
-		} else {
-			componentId = meta.ComponentId
+	// Make sure that new items have somewhere to go before anything is checked in
+	for addedpath, _ := range status.Added {
+		if _, ok := status.renamedFrom(addedpath); ok || status.metaData.loadedParent(addedpath) != "." {
+			continue
 		}
 
-		remoteFile, err := Open(client, ccmBaseUrl, workspaceId, componentId, remotepath)
-		if err != nil {
-			// First, check to see if this is a 404 (Not Found). This can occur when one or more of the
-			//  parent directories are not there.
-			fileerror, ok := err.(*JazzError)
-
-			if ok && fileerror.StatusCode == 404 {
-				fmt.Printf("Cannot check-in file at path %v since it no longer exists at the same location on the remote.\n", remotepath)
-				fmt.Printf("The file has been temporarily backed up in the following location: %v\n", stagepath)
-				continue
-			}
-
-			panic(err)
+		if len(status.metaData.componentDirs) > 0 {
+			panic(simpleWarning(fmt.Sprintf("%v is not inside of the folder of a component. Move it into one of them and try again.", addedpath)))
 		}
-
-		// TODO better checking and matching for the file, perhaps by item ID?
-		if remoteFile.info.Directory {
-			fmt.Printf("Cannot check-in file at path %v. There is a folder at this location on the remote.\n", modifiedpath)
-			fmt.Printf("The file has been temporarily backed up in the following location: %v\n", stagepath)
-			continue
+		if componentErr != nil {
+			panic(componentErr)
 		}
-		// Ooops, this is the wrong file
-		if remoteFile.info.ScmInfo.ItemId != meta.ItemId {
-			fmt.Printf("Cannot check-in file at path %v. It is not the same as the one that was originally loaded.\n", modifiedpath)
-			fmt.Printf("The file has been temporarily backed up in the following location: %v\n", stagepath)
-			continue
-		}
-
-		newmeta := checkinFile(client, stagepath, remoteFile)
-		newmeta.Path = localpath
-
-		status.metaData.simplePut(newmeta, sandboxPath)
 	}
 
+	checkinModified(client, status, sandboxPath)
+
 	addedFiles := make([]string, len(status.Added))
 	idx := 0
 
@@ -161,10 +149,21 @@ func scmCheckin(client *Client, status *status, sandboxPath string) {
 	sort.StringSlice(addedFiles).Sort()
 
 	for _, addedpath := range addedFiles {
-		fmt.Printf("%v (Added)\n", addedpath)
-
 		localpath := filepath.Join(sandboxPath, addedpath)
-		remotepath := filepath.ToSlash(addedpath)
+
+		// Move the existing item when this was renamed so that it keeps its history
+		if oldpath, ok := status.renamedFrom(addedpath); ok {
+			fmt.Printf("%v (%v from %v)\n", addedpath, renameKind(oldpath, addedpath), oldpath)
+
+			if checkinMove(client, status, sandboxPath, oldpath, addedpath) {
+				continue
+			}
+		} else if _, ok := status.metaData.get(localpath, sandboxPath); ok {
+			// This came along with a directory that was moved
+			continue
+		} else {
+			fmt.Printf("%v (Added)\n", addedpath)
+		}
 
 		info, err := os.Stat(localpath)
 		if err != nil {
@@ -177,9 +176,12 @@ func scmCheckin(client *Client, status *status, sandboxPath string) {
 		componentId := ""
 		if ok {
 			componentId = parentMeta.ComponentId
-		} else {
+		} else if defaultComponentId != "" {
 			componentId = defaultComponentId
+		} else {
+			panic(componentErr)
 		}
+		remotepath := status.metaData.remotePath(componentId, addedpath)
 
 		if info.IsDir() {
 			remoteFolder, err := Mkdir(client, ccmBaseUrl, workspaceId, componentId, remotepath)
@@ -239,7 +241,7 @@ func scmCheckin(client *Client, status *status, sandboxPath string) {
 			}
 
 			stagepath := filepath.Join(sandboxPath, stageFolder, addedpath)
-			newmeta := checkinFile(client, stagepath, remoteFile)
+			newmeta := checkinFile(client, stagepath, status.staged[addedpath], remoteFile)
 			newmeta.Path = localpath
 			status.metaData.simplePut(newmeta, sandboxPath)
 		}
@@ -256,21 +258,26 @@ func scmCheckin(client *Client, status *status, sandboxPath string) {
 
 	for idx = len(deletedFiles) - 1; idx >= 0; idx-- {
 		deletedpath := deletedFiles[idx]
-		remotepath := filepath.ToSlash(deletedpath)
-
-		fmt.Printf("%v (Deleted)\n", deletedpath)
 		deletedpath = filepath.Join(sandboxPath, deletedpath)
 
 		componentId := ""
 
 		meta, ok := status.metaData.get(deletedpath, sandboxPath)
 		if !ok {
-			// This should never really happen but log it if it does.
-			panic(&JazzError{Msg: "Metadata not found for deleted item discovered in the metadata.", Log: true})
+			// The item was moved somewhere else, there's nothing to delete
+			continue
 		} else {
 			componentId = meta.ComponentId
 		}
 
+		remotepath := status.metaData.remotePath(componentId, deletedFiles[idx])
+		if remotepath == "." {
+			fmt.Printf("Cannot delete %v, it is the folder of a component. Remove the component from the repository workspace on the website instead.\n", deletedFiles[idx])
+			continue
+		}
+
+		fmt.Printf("%v (Deleted)\n", deletedFiles[idx])
+
 		remotePath, err := filepath.Rel(sandboxPath, deletedpath)
 		if err != nil {
 			panic(err)
@@ -298,7 +305,190 @@ func scmCheckin(client *Client, status *status, sandboxPath string) {
 	fmt.Println("Checkin Complete")
 }
 
-func checkinFile(client *Client, localPath string, remoteFile *File) metaObject {
+// Move an item that was renamed in the sandbox to its new location in the
+// repository workspace. If the item can't be moved then false is returned and
+// it should be checked in as a new item instead.
+func checkinMove(client *Client, status *status, sandboxPath string, oldpath string, newpath string) bool {
+	workspaceId := status.metaData.workspaceId
+	ccmBaseUrl := status.metaData.ccmBaseUrl
+	stagepath := filepath.Join(sandboxPath, stageFolder, newpath)
+
+	oldmeta, ok := status.metaData.pathMap[oldpath]
+	if !ok {
+		// This shouldn't happen. Log the stack if it does.
+		panic(&JazzError{Msg: "Metadata not found for renamed item that was found in the metadata", Log: true})
+	}
+
+	// Items can't be moved between components
+	componentId := oldmeta.ComponentId
+	parentMeta, ok := status.metaData.get(filepath.Dir(filepath.Join(sandboxPath, newpath)), sandboxPath)
+	if (ok && parentMeta.ComponentId != componentId) || (!ok && len(status.metaData.componentDirs) > 0) {
+		fmt.Printf("Cannot move %v to a different component, it will be checked in as a new item instead.\n", oldpath)
+		return false
+	}
+
+	remoteFile, err := Open(client, ccmBaseUrl, workspaceId, componentId, status.metaData.remotePath(componentId, oldpath))
+	if err != nil {
+		// The item may have been moved or deleted on the remote
+		fileerror, ok := err.(*JazzError)
+
+		if ok && fileerror.StatusCode == 404 {
+			fmt.Printf("Cannot move %v since it no longer exists at the same location on the remote. It will be checked in as a new item instead.\n", oldpath)
+			return false
+		}
+
+		panic(err)
+	}
+
+	// Ooops, this is the wrong item
+	if remoteFile.info.ScmInfo.ItemId != oldmeta.ItemId {
+		fmt.Printf("Cannot move %v. It is not the same as the one that was originally loaded. It will be checked in as a new item instead.\n", oldpath)
+		return false
+	}
+
+	remoteFile, err = Move(client, ccmBaseUrl, workspaceId, componentId, status.metaData.remotePath(componentId, oldpath), status.metaData.remotePath(componentId, newpath))
+	if err != nil {
+		panic(err)
+	}
+
+	// Everything underneath the item moves along with it. The children are
+	//  collected first since adding to the map while ranging over it may
+	//  visit the moved entries again.
+	prefix := oldpath + string(filepath.Separator)
+	children := []string{}
+	for p, _ := range status.metaData.pathMap {
+		if strings.HasPrefix(p, prefix) {
+			children = append(children, p)
+		}
+	}
+	for _, p := range children {
+		meta := status.metaData.pathMap[p]
+		delete(status.metaData.pathMap, p)
+		meta.Path = filepath.Join(newpath, p[len(prefix):])
+		status.metaData.pathMap[meta.Path] = meta
+	}
+
+	delete(status.metaData.pathMap, oldpath)
+	oldmeta.Path = newpath
+	oldmeta.StateId = remoteFile.info.ScmInfo.StateId
+	status.metaData.pathMap[newpath] = oldmeta
+
+	// Contents are the same so the staged copy isn't needed
+	os.RemoveAll(stagepath)
+
+	return true
+}
+
+// Upload the modified files, several at a time. The first failure stops
+// the rest of the files from being uploaded and is raised once the files
+// already being uploaded are done.
+func checkinModified(client *Client, status *status, sandboxPath string) {
+	queue := make(chan string, len(status.Modified))
+	for modifiedpath, _ := range status.Modified {
+		queue <- modifiedpath
+	}
+	close(queue)
+
+	// Guards the metadata and the failure
+	metaMutex := &sync.Mutex{}
+	var failure interface{}
+
+	uploaders := &sync.WaitGroup{}
+	for i := 0; i < numUploadGoroutines; i++ {
+		uploaders.Add(1)
+		go func() {
+			defer uploaders.Done()
+			defer func() {
+				r := recover()
+				if r != nil {
+					metaMutex.Lock()
+					if failure == nil {
+						failure = r
+					}
+					metaMutex.Unlock()
+				}
+			}()
+
+			for modifiedpath := range queue {
+				metaMutex.Lock()
+				failed := failure != nil
+				metaMutex.Unlock()
+				if failed {
+					return
+				}
+
+				checkinModifiedFile(client, status, sandboxPath, modifiedpath, metaMutex)
+			}
+		}()
+	}
+	uploaders.Wait()
+
+	if failure != nil {
+		panic(failure)
+	}
+}
+
+func checkinModifiedFile(client *Client, status *status, sandboxPath string, modifiedpath string, metaMutex *sync.Mutex) {
+	workspaceId := status.metaData.workspaceId
+	ccmBaseUrl := status.metaData.ccmBaseUrl
+
+	fmt.Printf("%v (Modified)\n", modifiedpath)
+
+	localpath := filepath.Join(sandboxPath, modifiedpath)
+	stagepath := filepath.Join(sandboxPath, stageFolder, modifiedpath)
+
+	metaMutex.Lock()
+	meta, ok := status.metaData.get(localpath, sandboxPath)
+	metaMutex.Unlock()
+	componentId := ""
+	if !ok {
+		// This shouldn't happen. Log the stack if it does.
+		panic(&JazzError{Msg: "Metadata not found for file that was found in the metadata", Log: true})
+	} else {
+		componentId = meta.ComponentId
+	}
+	remotepath := status.metaData.remotePath(componentId, modifiedpath)
+
+	remoteFile, err := Open(client, ccmBaseUrl, workspaceId, componentId, remotepath)
+	if err != nil {
+		// First, check to see if this is a 404 (Not Found). This can occur when one or more of the
+		//  parent directories are not there.
+		fileerror, ok := err.(*JazzError)
+
+		if ok && fileerror.StatusCode == 404 {
+			fmt.Printf("Cannot check-in file at path %v since it no longer exists at the same location on the remote.\n", remotepath)
+			fmt.Printf("The file has been temporarily backed up in the following location: %v\n", stagepath)
+			return
+		}
+
+		panic(err)
+	}
+
+	// TODO better checking and matching for the file, perhaps by item ID?
+	if remoteFile.info.Directory {
+		fmt.Printf("Cannot check-in file at path %v. There is a folder at this location on the remote.\n", modifiedpath)
+		fmt.Printf("The file has been temporarily backed up in the following location: %v\n", stagepath)
+		return
+	}
+	// Ooops, this is the wrong file
+	if remoteFile.info.ScmInfo.ItemId != meta.ItemId {
+		fmt.Printf("Cannot check-in file at path %v. It is not the same as the one that was originally loaded.\n", modifiedpath)
+		fmt.Printf("The file has been temporarily backed up in the following location: %v\n", stagepath)
+		return
+	}
+
+	newmeta := checkinFile(client, stagepath, status.staged[modifiedpath], remoteFile)
+	newmeta.Path = localpath
+
+	metaMutex.Lock()
+	status.metaData.simplePut(newmeta, sandboxPath)
+	metaMutex.Unlock()
+}
+
+// Upload the staged copy of a file. The metadata gets the stat information
+// of the sandbox file from when it was staged, so that the status of the
+// file takes the fast path until it is edited again.
+func checkinFile(client *Client, localPath string, sandboxInfo os.FileInfo, remoteFile *File) metaObject {
 	file, err := os.Open(localPath)
 	if err != nil {
 		panic(err)
@@ -314,14 +504,10 @@ func checkinFile(client *Client, localPath string, remoteFile *File) metaObject
 
 	newmeta.ComponentId = remoteFile.info.ScmInfo.ComponentId
 
-	info, err := os.Stat(localPath)
-	if err != nil {
-		panic(err)
+	if sandboxInfo != nil {
+		newmeta.setStat(sandboxInfo)
 	}
 
-	newmeta.LastModified = info.ModTime().Unix()
-	newmeta.Size = info.Size()
-
 	err = remoteFile.Write(tee)
 	if err != nil {
 		panic(err)
@@ -10,6 +10,7 @@ import (
 	"net/http/cookiejar"
 	"net/url"
 	"sync"
+	"time"
 
 	"code.google.com/p/go.net/publicsuffix"
 )
@@ -28,6 +29,8 @@ type Client struct {
 	jazzIDmutex sync.Mutex
 	jazzID2     string
 
+	stats *transferStats
+
 	Log *log.Logger
 }
 
@@ -51,7 +54,9 @@ func NewClient(userID string, password string) (*Client, error) {
 	tr := &http.Transport{
 		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
 	}
-	client.Transport = tr
+	// Requests are paced and counted according to the transfer settings
+	jClient.stats = &transferStats{start: time.Now()}
+	client.Transport = &limitedTransport{transport: tr, requests: newPacer(requestRateLimit), bandwidth: newPacer(float64(bandwidthLimit)), stats: jClient.stats}
 	client.CheckRedirect = nil
 
 	jClient.httpClient = &client
@@ -62,6 +67,11 @@ func NewClient(userID string, password string) (*Client, error) {
 	return jClient, nil
 }
 
+// The number of requests and bytes sent and received so far
+func (jClient *Client) Statistics() string {
+	return jClient.stats.String()
+}
+
 func (jClient *Client) GetJazzId() string {
 	jClient.jazzIDmutex.Lock()
 	defer jClient.jazzIDmutex.Unlock()
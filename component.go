@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Find the components of the workspace or stream with the given names or
+// IDs. An error lists the available components if any of them is missing.
+func findComponentsByName(client *Client, ccmBaseUrl string, workspaceId string, names []string) ([]string, error) {
+	components, err := FindComponents(client, ccmBaseUrl, workspaceId)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	for _, name := range names {
+		// All of the components
+		if name == "*" {
+			return []string{}, nil
+		}
+
+		found := false
+		for _, component := range components {
+			if component.Name == name || component.ScmInfo.ItemId == name {
+				ids = append(ids, component.ScmInfo.ItemId)
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return nil, simpleWarning(fmt.Sprintf("Component %v was not found. The available components are %v.", name, componentNames(components)))
+		}
+	}
+
+	return ids, nil
+}
+
+// Narrow the components down to the ones that were selected, all of them if
+// none were selected.
+func selectedComponents(components []FileInfo, selected []string) []FileInfo {
+	if len(selected) == 0 {
+		return components
+	}
+
+	result := []FileInfo{}
+	for _, component := range components {
+		for _, id := range selected {
+			if component.ScmInfo.ItemId == id {
+				result = append(result, component)
+				break
+			}
+		}
+	}
+
+	return result
+}
+
+// Pick the directory of the sandbox that each component is loaded into when
+// every component gets its own. Components keep the directory they were
+// given before, new ones are named after the component.
+func assignComponentDirs(components []FileInfo, previous map[string]string) map[string]string {
+	dirs := make(map[string]string)
+	used := make(map[string]bool)
+
+	for _, component := range components {
+		if dir, ok := previous[component.ScmInfo.ItemId]; ok {
+			dirs[component.ScmInfo.ItemId] = dir
+			used[dir] = true
+		}
+	}
+
+	for _, component := range components {
+		id := component.ScmInfo.ItemId
+		if _, ok := dirs[id]; ok {
+			continue
+		}
+
+		base := strings.Map(func(r rune) rune {
+			if strings.ContainsRune(`/\:*?"<>|`, r) {
+				return '_'
+			}
+			return r
+		}, strings.TrimSpace(component.Name))
+		if base == "" || base == "." || base == ".." {
+			base = id
+		}
+
+		dir := base
+		for i := 2; used[dir]; i++ {
+			dir = fmt.Sprintf("%v-%v", base, i)
+		}
+
+		dirs[id] = dir
+		used[dir] = true
+	}
+
+	return dirs
+}
+
+// Find the top-level items that more than one of the components have. They
+// can't be loaded on top of each other into the sandbox root. The roots
+// are the children of each component's root folder, by component name.
+func componentCollisions(roots map[string][]FileInfo) []string {
+	owners := make(map[string][]string)
+	for componentName, children := range roots {
+		for _, child := range children {
+			owners[child.Name] = append(owners[child.Name], componentName)
+		}
+	}
+
+	collisions := []string{}
+	for name, componentNames := range owners {
+		if len(componentNames) > 1 {
+			sort.Strings(componentNames)
+			collisions = append(collisions, fmt.Sprintf("%v (in %v)", name, strings.Join(componentNames, ", ")))
+		}
+	}
+	sort.Strings(collisions)
+
+	return collisions
+}
+
+// Make sure that the components can all be loaded into the root of the
+// sandbox without their items landing on top of each other
+func checkComponentRoots(client *Client, ccmBaseUrl string, workspaceId string, metadata *metaData, components []FileInfo) error {
+	if len(components) < 2 {
+		return nil
+	}
+
+	roots := make(map[string][]FileInfo)
+	for _, component := range components {
+		root, err := Open(client, ccmBaseUrl, workspaceId, metadata.componentRef(component.ScmInfo.ItemId), "/")
+		if err != nil {
+			return err
+		}
+
+		name := component.Name
+		if _, ok := roots[name]; ok {
+			name = name + " (" + component.ScmInfo.ItemId + ")"
+		}
+		roots[name] = root.info.Children
+	}
+
+	collisions := componentCollisions(roots)
+	if len(collisions) > 0 {
+		return simpleWarning("These items are in more than one component so they can't all be loaded into the root of the sandbox:\n" + strings.Join(collisions, "\n") + "\nLoad each component into its own folder with -component-dirs or pick the components to load with -component.")
+	}
+
+	return nil
+}
+
+// Pick the component that new items at the top of the sandbox are added to.
+// It has to be named if there's a choice.
+func checkinComponent(components []FileInfo, name string) (string, error) {
+	if name != "" {
+		for _, component := range components {
+			if component.Name == name || component.ScmInfo.ItemId == name {
+				return component.ScmInfo.ItemId, nil
+			}
+		}
+
+		return "", simpleWarning(fmt.Sprintf("Component %v was not found. The available components are %v.", name, componentNames(components)))
+	}
+
+	if len(components) == 0 {
+		return "", simpleWarning("There are no components in your repository workspace.")
+	}
+
+	if len(components) == 1 {
+		return components[0].ScmInfo.ItemId, nil
+	}
+
+	return "", simpleWarning(fmt.Sprintf("There are new files and folders at the top of the sandbox and more than one component they could go into. Pick one of %v with -component.", componentNames(components)))
+}
+
+func componentNames(components []FileInfo) string {
+	names := []string{}
+	for _, component := range components {
+		names = append(names, "'"+component.Name+"'")
+	}
+
+	return strings.Join(names, ", ")
+}
+
+// The closest directory above a path relative to the sandbox that was
+// loaded, "." if there isn't one.
+func (metadata *metaData) loadedParent(rel string) string {
+	for parent := filepath.Dir(rel); parent != "."; parent = filepath.Dir(parent) {
+		if _, ok := metadata.pathMap[parent]; ok {
+			return parent
+		}
+	}
+
+	return "."
+}
+
+// The path of an item inside of its component for a path relative to the
+// sandbox. Components that are loaded into their own directory have it
+// removed, "." is the root of the component.
+func (metadata *metaData) remotePath(componentId string, rel string) string {
+	if dir, ok := metadata.componentDirs[componentId]; ok {
+		inner, err := filepath.Rel(dir, rel)
+		if err == nil {
+			rel = inner
+		}
+	}
+
+	return filepath.ToSlash(rel)
+}
+
+// The path relative to the sandbox of an item in a component
+func (metadata *metaData) localPath(componentId string, remotePath string) string {
+	return filepath.Join(metadata.componentDirs[componentId], filepath.FromSlash(remotePath))
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// Lines of unchanged context around each hunk of a unified diff
+	diffContext = 3
+
+	// Widest bar of +'s and -'s shown by diff -stat
+	maxStatWidth = 50
+)
+
+func diffDefaults() {
+	fmt.Printf("gojazz diff [options] [paths...]\n")
+	flag.PrintDefaults()
+}
+
+func diffOp() {
+	sandboxPath := flag.String("sandbox", "", "Location of the sandbox")
+	remote := flag.Bool("remote", false, "Compare the sandbox with what is currently in the repository workspace or stream instead of what was loaded.")
+	stream := flag.String("stream", "", "Compare the sandbox with another stream of the project.")
+	stat := flag.Bool("stat", false, "Only summarize the number of lines changed in each file.")
+	flag.Usage = diffDefaults
+	flag.Parse()
+
+	if *sandboxPath == "" {
+		path, err := os.Getwd()
+		if err != nil {
+			panic(err)
+		}
+
+		path = findSandbox(path)
+		sandboxPath = &path
+	}
+
+	filter, err := sandboxRelativePaths(*sandboxPath, flag.Args())
+	if err != nil {
+		panic(err)
+	}
+
+	m := NO_COPY
+	if *remote || *stream != "" {
+		m = NO_WRITE
+	}
+	status, err := scmStatusPaths(*sandboxPath, m, false, filter)
+	if err != nil {
+		panic(err)
+	}
+
+	var diffs []fileDiff
+
+	if *remote || *stream != "" {
+		client := newClientForSandbox(status.metaData)
+		workspaceId := status.metaData.workspaceId
+
+		if *stream != "" {
+			workspaceId, err = FindStream(client, status.metaData.ccmBaseUrl, status.metaData.projectName, *stream)
+			if err != nil {
+				panic(err)
+			}
+			if workspaceId == "" {
+				panic(simpleWarning("Stream with name " + *stream + " not found"))
+			}
+		}
+
+		diffs, err = scmRemoteDiff(client, status, workspaceId)
+		if err != nil {
+			panic(err)
+		}
+	} else {
+		if status.metaData.noPristine {
+			panic(simpleWarning("This sandbox doesn't keep pristine copies of the loaded files. Load again with '-pristine=true' to use diff, or compare with the remote using '-remote'."))
+		}
+
+		diffs = scmDiff(status)
+	}
+
+	if *stat {
+		fmt.Printf("%v", diffStat(diffs))
+	} else {
+		for _, diff := range diffs {
+			fmt.Printf("%v", diff.unified())
+		}
+	}
+}
+
+// The two versions of a file to compare. An empty name stands for a file that
+// doesn't exist. Changes that can't be shown as a diff only have a note.
+type fileDiff struct {
+	OldName string
+	NewName string
+	Old     []byte
+	New     []byte
+	Note    string
+}
+
+func (diff fileDiff) unified() string {
+	if diff.Note != "" {
+		return diff.Note + "\n"
+	}
+
+	return unifiedDiff(diff.OldName, diff.NewName, diff.Old, diff.New)
+}
+
+func (diff fileDiff) name() string {
+	if diff.NewName != "" {
+		return filepath.ToSlash(diff.NewName)
+	}
+
+	return filepath.ToSlash(diff.OldName)
+}
+
+// The local changes in the sandbox compared with the pristine copies of the
+// files as they were loaded
+func scmDiff(status *status) []fileDiff {
+	diffs := []fileDiff{}
+
+	for _, change := range status.changes() {
+		var diff fileDiff
+
+		switch change.Kind {
+		case "Modified":
+			diff = diffPristine(status, change.Path, change.Path)
+		case "Added":
+			diff = diffPristine(status, "", change.Path)
+		case "Deleted":
+			diff = diffPristine(status, change.Path, "")
+		default:
+			// Renamed or moved, the contents are the same
+			diff = fileDiff{OldName: change.OldPath, NewName: change.Path, Note: fmt.Sprintf("%v %v -> %v", change.Kind, change.OldPath, change.Path)}
+		}
+
+		if diff.OldName != "" || diff.NewName != "" {
+			diffs = append(diffs, diff)
+		}
+	}
+
+	return diffs
+}
+
+// Compare the pristine copy of the old path with the file at the new path in
+// the sandbox. Directories are skipped by returning an empty diff.
+func diffPristine(status *status, oldPath string, newPath string) fileDiff {
+	diff := fileDiff{OldName: oldPath, NewName: newPath}
+
+	if oldPath != "" {
+		meta, ok := status.metaData.pathMap[oldPath]
+		if !ok || meta.Hash == "" {
+			// Directories have no contents
+			return fileDiff{}
+		}
+
+		var err error
+		diff.Old, err = readBase(status.sandboxPath, meta.Hash)
+		if err != nil {
+			diff.Note = fmt.Sprintf("%v: No pristine copy is available, load again to restore it", oldPath)
+			return diff
+		}
+	}
+
+	if newPath != "" {
+		contents, isDir := readLocal(status, newPath)
+		if isDir {
+			return fileDiff{}
+		}
+		diff.New = contents
+	}
+
+	return diff
+}
+
+// Read a file in the sandbox, directories have no contents
+func readLocal(status *status, rel string) ([]byte, bool) {
+	fullpath := filepath.Join(status.sandboxPath, rel)
+
+	info, err := os.Stat(fullpath)
+	if err != nil {
+		panic(err)
+	}
+	if info.IsDir() {
+		return nil, true
+	}
+
+	contents, err := ioutil.ReadFile(fullpath)
+	if err != nil {
+		panic(err)
+	}
+
+	return contents, false
+}
+
+// Compare the sandbox with the current contents of a repository workspace or
+// stream. The files that changed on either side since the sandbox was loaded
+// are fetched and compared with the files in the sandbox.
+func scmRemoteDiff(client *Client, status *status, workspaceId string) ([]fileDiff, error) {
+	remote, err := scmCompare(client, status, workspaceId, false)
+	if err != nil {
+		return nil, err
+	}
+
+	changed := make(map[string]bool)
+	for _, changes := range []map[string]bool{status.Added, status.Modified, status.Deleted, remote.Added, remote.Modified, remote.Deleted} {
+		for rel, _ := range changes {
+			changed[rel] = true
+		}
+	}
+
+	diffs := []fileDiff{}
+
+	for _, rel := range sortedKeys(changed) {
+		diff := fileDiff{}
+
+		meta, tracked := status.metaData.pathMap[rel]
+		existsRemotely := remote.Added[rel] || (tracked && !remote.Deleted[rel])
+
+		if existsRemotely {
+			componentId, ok := remote.componentIds[rel]
+			if !ok {
+				componentId = meta.ComponentId
+			}
+
+			componentRef := componentId
+			if workspaceId == status.metaData.workspaceId {
+				componentRef = status.metaData.componentRef(componentId)
+			}
+
+			remoteFile, err := Open(client, status.metaData.ccmBaseUrl, workspaceId, componentRef, status.metaData.remotePath(componentId, rel))
+			if err != nil {
+				return nil, err
+			}
+
+			if remoteFile.info.Directory {
+				remoteFile.Close()
+				continue
+			}
+
+			diff.OldName = rel
+			diff.Old, err = ioutil.ReadAll(remoteFile)
+			remoteFile.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		_, err := os.Lstat(filepath.Join(status.sandboxPath, rel))
+		if err == nil {
+			contents, isDir := readLocal(status, rel)
+			if isDir {
+				continue
+			}
+
+			diff.NewName = rel
+			diff.New = contents
+		}
+
+		if diff.OldName != "" || diff.NewName != "" {
+			diffs = append(diffs, diff)
+		}
+	}
+
+	return diffs, nil
+}
+
+// Summarize the number of lines added and removed in each file, much like
+// git diff --stat
+func diffStat(diffs []fileDiff) string {
+	type fileStat struct {
+		name       string
+		insertions int
+		deletions  int
+		binary     bool
+	}
+
+	stats := []fileStat{}
+	nameWidth, maxChanges := 0, 0
+	insertions, deletions := 0, 0
+
+	for _, diff := range diffs {
+		stat := fileStat{name: diff.name()}
+
+		if diff.Note != "" {
+			// Renames have no line changes
+		} else if isBinary(diff.Old) || isBinary(diff.New) {
+			stat.binary = true
+		} else {
+			for _, edit := range diffEdits(splitLines(diff.Old), splitLines(diff.New)) {
+				if edit.op == '+' {
+					stat.insertions++
+				} else if edit.op == '-' {
+					stat.deletions++
+				}
+			}
+
+			// Identical contents
+			if stat.insertions == 0 && stat.deletions == 0 {
+				continue
+			}
+		}
+
+		stats = append(stats, stat)
+
+		if len(stat.name) > nameWidth {
+			nameWidth = len(stat.name)
+		}
+		if stat.insertions+stat.deletions > maxChanges {
+			maxChanges = stat.insertions + stat.deletions
+		}
+		insertions += stat.insertions
+		deletions += stat.deletions
+	}
+
+	if len(stats) == 0 {
+		return ""
+	}
+
+	// Scale the bar of +'s and -'s for files with lots of changes
+	scale := 1.0
+	if maxChanges > maxStatWidth {
+		scale = float64(maxStatWidth) / float64(maxChanges)
+	}
+
+	result := ""
+	for _, stat := range stats {
+		if stat.binary {
+			result = result + fmt.Sprintf(" %-*v | Bin\n", nameWidth, stat.name)
+			continue
+		}
+
+		plus := int(float64(stat.insertions)*scale + 0.5)
+		minus := int(float64(stat.deletions)*scale + 0.5)
+		result = result + fmt.Sprintf(" %-*v | %v %v%v\n", nameWidth, stat.name, stat.insertions+stat.deletions, strings.Repeat("+", plus), strings.Repeat("-", minus))
+	}
+
+	result = result + fmt.Sprintf(" %v changed, %v(+), %v(-)\n", plural(len(stats), "file"), plural(insertions, "insertion"), plural(deletions, "deletion"))
+
+	return result
+}
+
+func plural(count int, noun string) string {
+	if count == 1 {
+		return fmt.Sprintf("%v %v", count, noun)
+	}
+
+	return fmt.Sprintf("%v %vs", count, noun)
+}
+
+// Format the differences between two versions of a file as a unified diff
+// with the usual a/ and b/ prefixes. Empty names are shown as /dev/null.
+func unifiedDiff(oldName string, newName string, old []byte, current []byte) string {
+	header := "--- " + diffName("a/", oldName) + "\n+++ " + diffName("b/", newName) + "\n"
+
+	if isBinary(old) || isBinary(current) {
+		return fmt.Sprintf("Binary files %v and %v differ\n", diffName("a/", oldName), diffName("b/", newName))
+	}
+
+	a := splitLines(old)
+	b := splitLines(current)
+	edits := diffEdits(a, b)
+
+	var result bytes.Buffer
+	for start := 0; start < len(edits); {
+		// Find the next change
+		for start < len(edits) && edits[start].op == ' ' {
+			start++
+		}
+		if start == len(edits) {
+			break
+		}
+
+		// Extend the hunk until there is a long enough run of unchanged lines
+		end := start
+		for end < len(edits) {
+			if edits[end].op != ' ' {
+				end++
+				continue
+			}
+
+			run := end
+			for run < len(edits) && edits[run].op == ' ' {
+				run++
+			}
+			if run == len(edits) || run-end > 2*diffContext {
+				break
+			}
+			end = run
+		}
+
+		hunkStart := start - diffContext
+		if hunkStart < 0 {
+			hunkStart = 0
+		}
+		hunkEnd := end + diffContext
+		if hunkEnd > len(edits) {
+			hunkEnd = len(edits)
+		}
+
+		formatHunk(&result, edits[hunkStart:hunkEnd])
+		start = hunkEnd
+	}
+
+	if result.Len() == 0 {
+		return ""
+	}
+
+	return header + result.String()
+}
+
+func diffName(prefix string, name string) string {
+	if name == "" {
+		return "/dev/null"
+	}
+
+	return prefix + filepath.ToSlash(name)
+}
+
+// A line that is unchanged (' '), removed ('-') or added ('+') along with its
+// line number in the old and new versions
+type diffEdit struct {
+	op      byte
+	line    string
+	oldLine int
+	newLine int
+}
+
+func diffEdits(a []string, b []string) []diffEdit {
+	matches := matchLines(a, b)
+	edits := []diffEdit{}
+
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && matches[i] == -1:
+			edits = append(edits, diffEdit{'-', a[i], i, j})
+			i++
+		case i == len(a) || j < matches[i]:
+			edits = append(edits, diffEdit{'+', b[j], i, j})
+			j++
+		default:
+			edits = append(edits, diffEdit{' ', a[i], i, j})
+			i++
+			j++
+		}
+	}
+
+	return edits
+}
+
+func formatHunk(result *bytes.Buffer, edits []diffEdit) {
+	oldCount, newCount := 0, 0
+	for _, edit := range edits {
+		if edit.op != '+' {
+			oldCount++
+		}
+		if edit.op != '-' {
+			newCount++
+		}
+	}
+
+	// Ranges start at line 1, or the line before when they're empty
+	oldStart, newStart := edits[0].oldLine, edits[0].newLine
+	if oldCount > 0 {
+		oldStart++
+	}
+	if newCount > 0 {
+		newStart++
+	}
+
+	fmt.Fprintf(result, "@@ -%v,%v +%v,%v @@\n", oldStart, oldCount, newStart, newCount)
+	for _, edit := range edits {
+		result.WriteByte(edit.op)
+		result.WriteString(edit.line)
+		if !strings.HasSuffix(edit.line, "\n") {
+			result.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	// Downloads are written to temporary files with this prefix next to
+	//  the file that they replace
+	downloadTempPrefix = ".jazzdownload-"
+)
+
+var downloadCounter uint32
+
+// Writes a downloaded file to a temporary file in the same directory as the
+// target. The target is only replaced by commit, once all of the contents
+// have arrived and were verified, so that a failed download never leaves a
+// truncated file in the sandbox.
+type downloadWriter struct {
+	path    string
+	file    *os.File
+	hash    hash.Hash
+	written int64
+}
+
+func createDownloadWriter(localPath string) (*downloadWriter, error) {
+	dir := filepath.Dir(localPath)
+
+	for {
+		name := fmt.Sprintf("%v%v-%v", downloadTempPrefix, os.Getpid(), atomic.AddUint32(&downloadCounter, 1))
+
+		// Same permissions as a file created in the usual way
+		file, err := os.OpenFile(filepath.Join(dir, name), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return &downloadWriter{path: localPath, file: file, hash: sha1.New()}, nil
+	}
+}
+
+func (writer *downloadWriter) Write(p []byte) (int, error) {
+	n, err := writer.file.Write(p)
+	writer.hash.Write(p[:n])
+	writer.written += int64(n)
+	return n, err
+}
+
+// The hash of the contents written so far
+func (writer *downloadWriter) sum() string {
+	return base64.StdEncoding.EncodeToString(writer.hash.Sum(nil))
+}
+
+// Check the contents and move them into place. They must have the length,
+// unless it is negative, and the hash, unless it is empty. Without a hash to
+// compare with, the file is read back to check that the contents made it to
+// the disk intact.
+func (writer *downloadWriter) commit(length int64, expectedHash string) error {
+	err := writer.file.Close()
+	if err != nil {
+		writer.abort()
+		return err
+	}
+
+	if length >= 0 && writer.written != length {
+		writer.abort()
+		return simpleWarning(fmt.Sprintf("Only %v of the %v bytes of %v were received", writer.written, length, writer.path))
+	}
+
+	if expectedHash == "" {
+		expectedHash, err = hashFile(writer.file.Name())
+		if err != nil {
+			writer.abort()
+			return err
+		}
+	}
+	if expectedHash != writer.sum() {
+		writer.abort()
+		return simpleWarning("The contents of " + writer.path + " were corrupted while they were written")
+	}
+
+	err = os.Rename(writer.file.Name(), writer.path)
+	if err != nil {
+		writer.abort()
+	}
+
+	return err
+}
+
+func (writer *downloadWriter) abort() {
+	writer.file.Close()
+	os.Remove(writer.file.Name())
+}
+
+// Replace a sandbox file with new contents in the same way as a download
+func writeDownload(localPath string, contents io.Reader) error {
+	writer, err := createDownloadWriter(localPath)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(writer, contents)
+	if err != nil {
+		writer.abort()
+		return err
+	}
+
+	return writer.commit(-1, "")
+}
+
+// Replace a sandbox file with a hard link to another file, in the same way
+// as a download
+func linkDownload(localPath string, source string) error {
+	dir := filepath.Dir(localPath)
+
+	for {
+		name := filepath.Join(dir, fmt.Sprintf("%v%v-%v", downloadTempPrefix, os.Getpid(), atomic.AddUint32(&downloadCounter, 1)))
+
+		err := os.Link(source, name)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		err = os.Rename(name, localPath)
+		if err != nil {
+			os.Remove(name)
+		}
+
+		return err
+	}
+}
+
+// Remove the temporary files of downloads that were interrupted. If any
+// paths (relative to the sandbox) are provided then only those files and
+// directories are cleaned.
+func cleanDownloads(sandboxPath string, scope []string) error {
+	return filepath.Walk(sandboxPath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		rel, err := filepath.Rel(sandboxPath, p)
+		if err != nil {
+			return err
+		}
+		inside, descend := pathInScope(scope, rel)
+
+		if info.IsDir() {
+			switch info.Name() {
+			case stageFolder, backupFolder, baseFolder, stashFolder:
+				return filepath.SkipDir
+			}
+			if rel != "." && !inside && !descend {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if inside && strings.HasPrefix(info.Name(), downloadTempPrefix) {
+			return os.Remove(p)
+		}
+
+		return nil
+	})
+}
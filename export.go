@@ -0,0 +1,300 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+func exportDefaults() {
+	fmt.Printf("gojazz export <project name> -o <archive> [options]\n")
+	flag.PrintDefaults()
+}
+
+func exportOp() {
+	if len(os.Args) < 2 || strings.HasPrefix(os.Args[1], "-") {
+		fmt.Println("Provide a project to export and try again.")
+		exportDefaults()
+		return
+	}
+	projectName := os.Args[1]
+	os.Args = os.Args[1:]
+
+	output := flag.String("o", "", "The archive to write, a .zip, .tar, .tar.gz or .tgz file.")
+	stream := flag.String("stream", "", "Alternate stream to export")
+	workspace := flag.Bool("workspace", false, "Export your repository workspace for the stream instead (requires authentication).")
+	snapshot := flag.String("snapshot", "", "Export the components as they were in this snapshot.")
+	var baselineSpecs stringList
+	flag.Var(&baselineSpecs, "baseline", "Export a component as it was in a baseline, given as <component>=<baseline>. Repeat for several components.")
+	var componentNames stringList
+	flag.Var(&componentNames, "component", "Only export the component with this name. Repeat to export several components.")
+	componentDirs := flag.Bool("component-dirs", false, "Put each component into its own folder of the archive named after the component.")
+	var paths stringList
+	flag.Var(&paths, "path", "Only export this path. Repeat to export several paths.")
+	applyTransferFlags := transferFlags()
+	flag.Usage = exportDefaults
+	flag.Parse()
+	applyTransferFlags()
+
+	if *output == "" {
+		fmt.Println("Provide the archive to write with -o and try again.")
+		exportDefaults()
+		return
+	}
+
+	sparse, err := sparsePaths(paths)
+	if err != nil {
+		panic(err)
+	}
+
+	file, err := os.Create(*output)
+	if err != nil {
+		panic(err)
+	}
+
+	// Don't leave a partial archive behind
+	exported := false
+	defer func() {
+		if !exported {
+			file.Close()
+			os.Remove(*output)
+		}
+	}()
+
+	archive, err := createArchive(*output, file)
+	if err != nil {
+		panic(err)
+	}
+
+	client, ccmBaseUrl, workspaceId := findRemoteWorkspace(projectName, *stream, *workspace)
+
+	// The metadata is only used to lay out the archive like a sandbox, it is
+	//  never saved
+	metadata := newMetaData()
+	metadata.snapshot = *snapshot
+	metadata.sparse = sparse
+	metadata.baselines, err = findConfiguration(client, ccmBaseUrl, workspaceId, *snapshot, baselineSpecs)
+	if err != nil {
+		panic(err)
+	}
+
+	if len(componentNames) > 0 {
+		metadata.components, err = findComponentsByName(client, ccmBaseUrl, workspaceId, componentNames)
+		if err != nil {
+			panic(err)
+		}
+	} else if len(metadata.baselines) > 0 {
+		metadata.components = baselineComponents(metadata.baselines)
+	}
+
+	allComponents, err := FindComponents(client, ccmBaseUrl, workspaceId)
+	if err != nil {
+		panic(err)
+	}
+	components := selectedComponents(allComponents, metadata.components)
+
+	if *componentDirs {
+		metadata.componentDirs = assignComponentDirs(components, nil)
+	} else {
+		err = checkComponentRoots(client, ccmBaseUrl, workspaceId, metadata, components)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	count := 0
+	for _, component := range components {
+		fmt.Printf("Exporting %v...\n", component.Name)
+
+		n, err := exportComponent(client, ccmBaseUrl, workspaceId, component.ScmInfo.ItemId, metadata, archive)
+		if err != nil {
+			panic(err)
+		}
+		count += n
+	}
+
+	err = archive.Close()
+	if err != nil {
+		panic(err)
+	}
+	err = file.Close()
+	if err != nil {
+		panic(err)
+	}
+	exported = true
+
+	fmt.Printf("Exported %v files to %v\n", count, *output)
+	fmt.Printf("Transferred %v\n", client.Statistics())
+}
+
+// Write the files and directories of a component into the archive at the
+// paths that they would have in a sandbox. Returns the number of files.
+func exportComponent(client *Client, ccmBaseUrl string, workspaceId string, componentId string, metadata *metaData, archive archiveWriter) (int, error) {
+	componentRef := metadata.componentRef(componentId)
+	exportTime := time.Now()
+
+	// The walk is concurrent but the archive is written in order
+	mutex := &sync.Mutex{}
+	items := make(map[string]File)
+
+	if dir := metadata.componentDirs[componentId]; dir != "" {
+		if inside, descend := pathInScope(metadata.sparse, dir); inside || descend {
+			root, err := Open(client, ccmBaseUrl, workspaceId, componentRef, "/")
+			if err != nil {
+				return 0, err
+			}
+			items[dir] = *root
+		}
+	}
+
+	err := Walk(client, ccmBaseUrl, workspaceId, componentRef, func(p string, file File) error {
+		rel := metadata.localPath(componentId, p)
+
+		// The folders leading to the paths are exported too
+		if inside, descend := pathInScope(metadata.sparse, rel); !inside && (!descend || !file.info.Directory) {
+			return filepath.SkipDir
+		}
+
+		mutex.Lock()
+		items[rel] = file
+		mutex.Unlock()
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	paths := []string{}
+	for rel, _ := range items {
+		paths = append(paths, rel)
+	}
+	sort.Strings(paths)
+
+	count := 0
+	for _, rel := range paths {
+		file := items[rel]
+		name := filepath.ToSlash(rel)
+
+		modTime := exportTime
+		if file.info.LocalTimeStamp > 0 {
+			modTime = time.Unix(0, file.info.LocalTimeStamp*int64(time.Millisecond))
+		}
+
+		if file.info.Directory {
+			err = archive.addDir(name, modTime)
+		} else {
+			err = archive.addFile(name, file.info.Length, modTime, &file)
+			file.Close()
+			count++
+		}
+		if err != nil {
+			return count, err
+		}
+	}
+
+	return count, nil
+}
+
+// Writes the entries of an archive. Directories are added before the
+// files in them.
+type archiveWriter interface {
+	addDir(name string, modTime time.Time) error
+	addFile(name string, size int64, modTime time.Time, contents io.Reader) error
+	Close() error
+}
+
+// Pick the format of the archive from its file name
+func createArchive(name string, w io.Writer) (archiveWriter, error) {
+	lower := strings.ToLower(name)
+
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return &zipArchive{writer: zip.NewWriter(w)}, nil
+	case strings.HasSuffix(lower, ".tar.gz") || strings.HasSuffix(lower, ".tgz"):
+		compressed := gzip.NewWriter(w)
+		return &tarArchive{writer: tar.NewWriter(compressed), compressed: compressed}, nil
+	case strings.HasSuffix(lower, ".tar"):
+		return &tarArchive{writer: tar.NewWriter(w)}, nil
+	}
+
+	return nil, simpleWarning(fmt.Sprintf("Can't tell the format of the archive %v, name it .zip, .tar, .tar.gz or .tgz.", name))
+}
+
+type tarArchive struct {
+	writer     *tar.Writer
+	compressed *gzip.Writer
+}
+
+func (archive *tarArchive) addDir(name string, modTime time.Time) error {
+	return archive.writer.WriteHeader(&tar.Header{Name: name + "/", Mode: 0755, ModTime: modTime, Typeflag: tar.TypeDir})
+}
+
+func (archive *tarArchive) addFile(name string, size int64, modTime time.Time, contents io.Reader) error {
+	err := archive.writer.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: size, ModTime: modTime, Typeflag: tar.TypeReg})
+	if err != nil {
+		return err
+	}
+
+	written, err := io.Copy(archive.writer, contents)
+	if err != nil {
+		return err
+	}
+	if written != size {
+		return simpleWarning(fmt.Sprintf("The size of %v changed while it was exported", name))
+	}
+
+	return nil
+}
+
+func (archive *tarArchive) Close() error {
+	err := archive.writer.Close()
+	if err != nil {
+		return err
+	}
+
+	if archive.compressed != nil {
+		return archive.compressed.Close()
+	}
+
+	return nil
+}
+
+type zipArchive struct {
+	writer *zip.Writer
+}
+
+func (archive *zipArchive) addDir(name string, modTime time.Time) error {
+	header := &zip.FileHeader{Name: path.Clean(name) + "/"}
+	header.SetModTime(modTime)
+
+	_, err := archive.writer.CreateHeader(header)
+	return err
+}
+
+func (archive *zipArchive) addFile(name string, size int64, modTime time.Time, contents io.Reader) error {
+	header := &zip.FileHeader{Name: name, Method: zip.Deflate}
+	header.SetModTime(modTime)
+
+	w, err := archive.writer.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, contents)
+	return err
+}
+
+func (archive *zipArchive) Close() error {
+	return archive.writer.Close()
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const (
+	// Files with a NUL byte this close to the start are taken to be binary
+	grepBinaryCheckSize = 8000
+)
+
+func grepDefaults() {
+	fmt.Printf("gojazz grep <pattern> -project <project name> [options] [paths]\n")
+	flag.PrintDefaults()
+}
+
+func grepOp() {
+	if len(os.Args) < 2 || strings.HasPrefix(os.Args[1], "-") {
+		fmt.Println("Provide a pattern to search for and try again.")
+		grepDefaults()
+		return
+	}
+	pattern := os.Args[1]
+	os.Args = os.Args[1:]
+
+	projectName := flag.String("project", "", "Project to search")
+	stream := flag.String("stream", "", "Alternate stream to search")
+	workspace := flag.Bool("workspace", false, "Search your repository workspace for the stream instead (requires authentication).")
+	snapshot := flag.String("snapshot", "", "Search the files as they were in this snapshot.")
+	var componentNames stringList
+	flag.Var(&componentNames, "component", "Only search the component with this name. Repeat to search several components.")
+	var includes stringList
+	flag.Var(&includes, "include", "Only search files matching this glob, such as '*.go'. Patterns with a slash match the whole path. Repeat for several globs.")
+	var excludes stringList
+	flag.Var(&excludes, "exclude", "Don't search files or folders matching this glob. Repeat for several globs.")
+	ignoreCase := flag.Bool("i", false, "Ignore case when matching.")
+	filesOnly := flag.Bool("l", false, "Only print the paths of the files that match.")
+	applyTransferFlags := transferFlags()
+	flag.Usage = grepDefaults
+	flag.Parse()
+	applyTransferFlags()
+
+	if *projectName == "" {
+		fmt.Println("Provide the project to search with -project and try again.")
+		grepDefaults()
+		return
+	}
+
+	if *ignoreCase {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		panic(simpleWarning(fmt.Sprintf("The pattern is not a valid regular expression: %v", err.Error())))
+	}
+
+	scope, err := sparsePaths(flag.Args())
+	if err != nil {
+		panic(err)
+	}
+
+	filter := newGrepFilter(includes, excludes)
+
+	client, ccmBaseUrl, workspaceId := findRemoteWorkspace(*projectName, *stream, *workspace)
+
+	metadata := newMetaData()
+	metadata.baselines, err = findConfiguration(client, ccmBaseUrl, workspaceId, *snapshot, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	if len(componentNames) > 0 {
+		metadata.components, err = findComponentsByName(client, ccmBaseUrl, workspaceId, componentNames)
+		if err != nil {
+			panic(err)
+		}
+	} else if len(metadata.baselines) > 0 {
+		metadata.components = baselineComponents(metadata.baselines)
+	}
+
+	components, err := FindComponents(client, ccmBaseUrl, workspaceId)
+	if err != nil {
+		panic(err)
+	}
+
+	// Files are searched concurrently by the walk, no more of them at a
+	//  time than the number of downloads. Each one's matches are printed
+	//  together.
+	printMutex := &sync.Mutex{}
+	downloads := make(chan bool, numDownloadGoroutines)
+
+	for _, component := range selectedComponents(components, metadata.components) {
+		componentId := component.ScmInfo.ItemId
+
+		err = Walk(client, ccmBaseUrl, workspaceId, metadata.componentRef(componentId), func(p string, file File) error {
+			rel := metadata.localPath(componentId, p)
+
+			inside, descend := pathInScope(scope, rel)
+			if !inside && (!descend || !file.info.Directory) {
+				return filepath.SkipDir
+			}
+
+			if file.info.Directory {
+				if filter.excluded(rel, true) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			if !inside || !filter.included(rel) {
+				return nil
+			}
+
+			downloads <- true
+			matches, err := grepReader(&file, re)
+			file.Close()
+			<-downloads
+			if err != nil {
+				return err
+			}
+
+			if len(matches) == 0 {
+				return nil
+			}
+
+			name := filepath.ToSlash(rel)
+
+			printMutex.Lock()
+			defer printMutex.Unlock()
+
+			if *filesOnly {
+				fmt.Printf("%v\n", name)
+				return nil
+			}
+
+			for _, match := range matches {
+				fmt.Printf("%v:%v:%v\n", name, match.line, match.text)
+			}
+
+			return nil
+		})
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	// Kept out of the matches so that they can be piped
+	fmt.Fprintf(os.Stderr, "Transferred %v\n", client.Statistics())
+}
+
+// A line that matches the pattern
+type grepMatch struct {
+	line int
+	text string
+}
+
+// Find the lines of the contents that match. Binary contents don't have
+// lines so nothing is matched.
+func grepReader(contents io.Reader, re *regexp.Regexp) ([]grepMatch, error) {
+	reader := bufio.NewReaderSize(contents, grepBinaryCheckSize)
+
+	start, err := reader.Peek(grepBinaryCheckSize)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, err
+	}
+	if isBinary(start) {
+		return nil, nil
+	}
+
+	matches := []grepMatch{}
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			line = bytes.TrimRight(line, "\r\n")
+			if re.Match(line) {
+				matches = append(matches, grepMatch{line: lineNumber, text: string(line)})
+			}
+		}
+
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return matches, nil
+}
+
+// The globs that pick the files to search, written like ignore rules
+type grepFilter struct {
+	includes []ignoreRule
+	excludes []ignoreRule
+}
+
+func newGrepFilter(includes []string, excludes []string) *grepFilter {
+	filter := &grepFilter{}
+
+	for _, pattern := range includes {
+		filter.includes = append(filter.includes, ignoreRule{pattern: strings.TrimPrefix(pattern, "/")})
+	}
+	for _, pattern := range excludes {
+		filter.excludes = append(filter.excludes, ignoreRule{pattern: strings.TrimPrefix(pattern, "/")})
+	}
+
+	return filter
+}
+
+func (filter *grepFilter) excluded(rel string, isDir bool) bool {
+	relpath := filepath.ToSlash(rel)
+
+	for _, rule := range filter.excludes {
+		if rule.matches(relpath, isDir) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Whether the file should be searched
+func (filter *grepFilter) included(rel string) bool {
+	if filter.excluded(rel, false) {
+		return false
+	}
+
+	if len(filter.includes) == 0 {
+		return true
+	}
+
+	relpath := filepath.ToSlash(rel)
+	for _, rule := range filter.includes {
+		if rule.matches(relpath, false) {
+			return true
+		}
+	}
+
+	return false
+}
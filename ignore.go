@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	sandboxIgnoreFile = ".gojazzignore"
+	userIgnoreFile    = "ignore.txt"
+
+	defaultMaxFileSize = 10 * 1024 * 1024
+
+	metadataReason = "gojazz metadata"
+
+	conflictFileReason = "other version of a file with a conflict"
+)
+
+var (
+	// Signs that a file isn't source code. These are applied before the
+	//  per-user and per-sandbox ignore files so that they can be overridden
+	//  with allow rules (e.g. "!bin").
+	defaultIgnoreRules = []string{
+		// Build output
+		"bin",
+		// Binaries and shared libraries
+		"*.exe", "*.dll", "*.so",
+		// Temporary files left by editors
+		"*~", "*.ext.swp",
+	}
+)
+
+type ignoreRule struct {
+	pattern string
+	allow   bool
+	dirOnly bool
+	source  string
+}
+
+// The set of rules used to decide whether changes to a file in the sandbox
+// should be ignored. Rules are evaluated in order and the last matching
+// rule wins, much like a .gitignore file.
+type ignorePolicy struct {
+	rules       []ignoreRule
+	maxSize     int64
+	sandboxPath string
+
+	// Tells whether the file at a path relative to the sandbox has a
+	//  conflict from a merge, nil if none do
+	conflicted func(rel string) bool
+}
+
+func newIgnorePolicy(sandboxPath string) *ignorePolicy {
+	policy := &ignorePolicy{}
+	policy.sandboxPath = sandboxPath
+	policy.maxSize = defaultMaxFileSize
+
+	for _, line := range defaultIgnoreRules {
+		policy.addRule(line, "default")
+	}
+
+	return policy
+}
+
+// Load the ignore policy for a sandbox. The defaults are extended first by
+// the per-user ignore file in the gojazz data directory and then by the
+// ignore file at the root of the sandbox.
+func loadIgnorePolicy(sandboxPath string) (*ignorePolicy, error) {
+	policy := newIgnorePolicy(sandboxPath)
+
+	usr, err := user.Current()
+	if err == nil {
+		err = policy.parseFile(filepath.Join(usr.HomeDir, gojazzDataDir, userIgnoreFile))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = policy.parseFile(filepath.Join(sandboxPath, sandboxIgnoreFile))
+	if err != nil {
+		return nil, err
+	}
+
+	return policy, nil
+}
+
+func (policy *ignorePolicy) parseFile(p string) error {
+	file, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		source := fmt.Sprintf("%v:%v", p, lineNum)
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// The size limit is a directive rather than a pattern
+		if strings.HasPrefix(line, "maxsize ") {
+			size, err := parseSize(strings.TrimSpace(line[len("maxsize "):]))
+			if err != nil {
+				return simpleWarning(fmt.Sprintf("Invalid size limit at %v: %v", source, err.Error()))
+			}
+			policy.maxSize = size
+			continue
+		}
+
+		policy.addRule(line, source)
+	}
+
+	return scanner.Err()
+}
+
+func (policy *ignorePolicy) addRule(line string, source string) {
+	rule := ignoreRule{source: source}
+
+	if strings.HasPrefix(line, "!") {
+		rule.allow = true
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+
+	rule.pattern = strings.TrimPrefix(line, "/")
+
+	policy.rules = append(policy.rules, rule)
+}
+
+// Parse a size such as 500KB, 10MB or 1GB. A size of 0 disables the limit.
+func parseSize(s string) (int64, error) {
+	s = strings.ToUpper(s)
+	multiplier := int64(1)
+
+	if strings.HasSuffix(s, "GB") {
+		multiplier = 1024 * 1024 * 1024
+		s = s[:len(s)-2]
+	} else if strings.HasSuffix(s, "MB") {
+		multiplier = 1024 * 1024
+		s = s[:len(s)-2]
+	} else if strings.HasSuffix(s, "KB") {
+		multiplier = 1024
+		s = s[:len(s)-2]
+	} else if strings.HasSuffix(s, "B") {
+		s = s[:len(s)-1]
+	}
+
+	size, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return size * multiplier, nil
+}
+
+func formatSize(size int64) string {
+	// TODO handle Gigabytes?
+	if size >= (1024 * 1024) {
+		return strconv.FormatInt(size/(1024*1024), 10) + "MB"
+	} else if size >= 1024 {
+		return strconv.FormatInt(size/1024, 10) + "KB"
+	}
+
+	return strconv.FormatInt(size, 10) + "B"
+}
+
+func (rule ignoreRule) matches(relpath string, isDir bool) bool {
+	if rule.dirOnly && !isDir {
+		return false
+	}
+
+	// Patterns without a slash match the name at any depth, otherwise
+	//  they are anchored to the root of the sandbox.
+	name := relpath
+	if !strings.Contains(rule.pattern, "/") {
+		name = path.Base(relpath)
+	}
+
+	matched, _ := path.Match(rule.pattern, name)
+	return matched
+}
+
+func (policy *ignorePolicy) matchRules(relpath string, isDir bool) (bool, string) {
+	ignored := false
+	reason := ""
+
+	for _, rule := range policy.rules {
+		if rule.matches(relpath, isDir) {
+			ignored = !rule.allow
+			reason = fmt.Sprintf("matches '%v' (%v)", rule.pattern, rule.source)
+		}
+	}
+
+	return ignored, reason
+}
+
+// Check whether changes to the file or directory at the given path should be
+// ignored. The reason is a short human readable explanation of the rule
+// that caused the path to be ignored.
+func (policy *ignorePolicy) check(p string) (bool, string, error) {
+	base := filepath.Base(p)
+
+	// Skip the metadata, staging, backup, base and stash directories, these cannot be overridden
+	if base == metadataFileName || strings.HasPrefix(base, lockFileName) || base == journalFileName || strings.HasPrefix(base, downloadTempPrefix) || strings.Contains(p, stageFolder) || strings.Contains(p, backupFolder) || strings.Contains(p, baseFolder) || strings.Contains(p, stashFolder) {
+		return true, metadataReason, nil
+	}
+
+	// The other version written next to a file that couldn't be merged is
+	//  only there to resolve the conflict and must not be checked in. Files
+	//  with the same suffix are left alone when there is no conflict.
+	if policy.conflicted != nil && (strings.HasSuffix(base, remoteSuffix) || strings.HasSuffix(base, stashSuffix)) {
+		original, err := filepath.Rel(policy.sandboxPath, strings.TrimSuffix(strings.TrimSuffix(p, remoteSuffix), stashSuffix))
+		if err == nil && policy.conflicted(original) {
+			return true, conflictFileReason, nil
+		}
+	}
+
+	relpath, err := filepath.Rel(policy.sandboxPath, p)
+	if err != nil {
+		return false, "", err
+	}
+	relpath = filepath.ToSlash(relpath)
+
+	// Anything underneath an ignored directory is ignored too
+	segments := strings.Split(relpath, "/")
+	for i := 1; i < len(segments); i++ {
+		ignored, reason := policy.matchRules(strings.Join(segments[:i], "/"), true)
+		if ignored {
+			return true, reason, nil
+		}
+	}
+
+	s, err := os.Stat(p)
+	if err != nil {
+		return false, "", err
+	}
+
+	ignored, reason := policy.matchRules(relpath, s.IsDir())
+	if ignored {
+		return true, reason, nil
+	}
+
+	// An explicit allow rule overrides the size limit
+	if reason != "" {
+		return false, "", nil
+	}
+
+	if !s.IsDir() && policy.maxSize > 0 && s.Size() > policy.maxSize {
+		return true, policy.sizeReason(), nil
+	}
+
+	return false, "", nil
+}
+
+// Files over the size limit are ignored but, unlike the patterns, the user
+// should be warned about them since they may well be source.
+func (policy *ignorePolicy) sizeReason() string {
+	return "larger than " + formatSize(policy.maxSize)
+}
+
+// Should we ignore changes to this file? The ignore policy of the sandbox
+// containing the path is used.
+func IsIgnored(p string) (bool, error) {
+	sandboxPath := findSandbox(filepath.Dir(p))
+
+	policy, err := loadIgnorePolicy(sandboxPath)
+	if err != nil {
+		return false, err
+	}
+
+	// Without metadata no file has a conflict
+	metadata := newMetaData()
+	if metadata.load(filepath.Join(sandboxPath, metadataFileName)) == nil {
+		conflicted := metadata.conflictPaths()
+		policy.conflicted = func(rel string) bool { return conflicted[rel] }
+	}
+
+	ignored, _, err := policy.check(p)
+	return ignored, err
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const (
+	journalFileName = ".jazzjournal"
+)
+
+// What is being loaded into the sandbox, so that an interrupted load can be
+// resumed without providing it again
+type journalHeader struct {
+	CcmBaseUrl  string
+	ProjectName string
+	WorkspaceId string
+	UserId      string
+	IsStream    bool
+	NoPristine  bool
+	Sparse      []string
+
+	Components    []string
+	ComponentDirs map[string]string
+
+	Snapshot  string
+	Baselines map[string]baseline
+
+	// Set when local changes are merged with the incoming ones. The metadata
+	//  is replaced as soon as the load starts, so the changes and the
+	//  metadata that they are based on are kept here for a resumed load to
+	//  merge the files that the interrupted one didn't get to.
+	Merge    bool                  `json:",omitempty"`
+	Added    []string              `json:",omitempty"`
+	Modified []string              `json:",omitempty"`
+	Deleted  []string              `json:",omitempty"`
+	Previous map[string]metaObject `json:",omitempty"`
+}
+
+// Record the local changes that the load merges with the incoming ones
+func (header *journalHeader) recordMerge(status *status) {
+	header.Merge = true
+	header.Previous = make(map[string]metaObject)
+
+	for rel, _ := range status.Added {
+		header.Added = append(header.Added, rel)
+	}
+	for rel, _ := range status.Modified {
+		header.Modified = append(header.Modified, rel)
+	}
+	for rel, _ := range status.Deleted {
+		header.Deleted = append(header.Deleted, rel)
+	}
+	sort.Strings(header.Added)
+	sort.Strings(header.Modified)
+	sort.Strings(header.Deleted)
+
+	for _, paths := range [][]string{header.Modified, header.Deleted} {
+		for _, rel := range paths {
+			if meta, ok := status.metaData.pathMap[rel]; ok {
+				header.Previous[rel] = meta
+			}
+		}
+	}
+}
+
+// The local changes that the interrupted load was merging with the incoming
+// ones, in the form of the status that it started with
+func (journal *loadJournal) mergeStatus(sandboxPath string) *status {
+	header := journal.header
+
+	status := newStatus(sandboxPath, NO_COPY)
+	status.metaData = newMetaData()
+	status.metaData.ccmBaseUrl = header.CcmBaseUrl
+	status.metaData.projectName = header.ProjectName
+	status.metaData.workspaceId = header.WorkspaceId
+	status.metaData.userId = header.UserId
+	status.metaData.isstream = header.IsStream
+	status.metaData.noPristine = header.NoPristine
+	status.metaData.sparse = header.Sparse
+	status.metaData.components = header.Components
+	status.metaData.componentDirs = header.ComponentDirs
+	status.metaData.snapshot = header.Snapshot
+	status.metaData.baselines = header.Baselines
+
+	for rel, meta := range header.Previous {
+		status.metaData.pathMap[rel] = meta
+	}
+	for _, rel := range header.Added {
+		status.Added[rel] = true
+	}
+	for _, rel := range header.Modified {
+		status.Modified[rel] = true
+	}
+	for _, rel := range header.Deleted {
+		status.Deleted[rel] = true
+	}
+
+	return status
+}
+
+// A line in the journal, only one of the fields is set
+type journalEntry struct {
+	Header *journalHeader `json:",omitempty"`
+
+	// A file or directory that was loaded, with its path relative to the sandbox
+	Item *metaObject `json:",omitempty"`
+
+	// A component that was loaded completely
+	Component string `json:",omitempty"`
+	Etag      string `json:",omitempty"`
+}
+
+// The journal records the progress of a load as it happens. The metadata is
+// only saved once the load is finished, if the load is interrupted before
+// then the journal has what was already loaded so that it doesn't have to
+// be loaded again.
+type loadJournal struct {
+	file   *os.File
+	mutex  sync.Mutex
+	failed bool
+
+	header journalHeader
+
+	// The progress recorded by the interrupted load being resumed
+	items      map[string]metaObject
+	components map[string]string
+}
+
+// Start the journal of a new load
+func createJournal(sandboxPath string, header journalHeader) (*loadJournal, error) {
+	file, err := os.Create(filepath.Join(sandboxPath, journalFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	journal := &loadJournal{file: file, header: header, items: make(map[string]metaObject), components: make(map[string]string)}
+
+	err = journal.write(journalEntry{Header: &header})
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return journal, nil
+}
+
+// Read the journal of an interrupted load
+func readJournal(sandboxPath string) (*loadJournal, error) {
+	file, err := os.Open(filepath.Join(sandboxPath, journalFileName))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	journal := &loadJournal{items: make(map[string]metaObject), components: make(map[string]string)}
+	headerFound := false
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		entry := journalEntry{}
+		err = json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			// An entry that was cut off when the load was interrupted
+			continue
+		}
+
+		if entry.Header != nil {
+			journal.header = *entry.Header
+			headerFound = true
+		}
+		if entry.Item != nil {
+			journal.items[entry.Item.Path] = *entry.Item
+		}
+		if entry.Component != "" {
+			journal.components[entry.Component] = entry.Etag
+		}
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	if !headerFound {
+		return nil, simpleWarning("The journal of the interrupted load is damaged, load the project again instead.")
+	}
+
+	return journal, nil
+}
+
+// Continue writing the journal of an interrupted load
+func resumeJournal(sandboxPath string) (*loadJournal, error) {
+	journal, err := readJournal(sandboxPath)
+	if err != nil {
+		return nil, err
+	}
+
+	journal.file, err = os.OpenFile(filepath.Join(sandboxPath, journalFileName), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	// Don't continue on the same line as an entry that was cut off
+	_, err = journal.file.Write([]byte("\n"))
+	if err != nil {
+		journal.file.Close()
+		return nil, err
+	}
+
+	return journal, nil
+}
+
+func (journal *loadJournal) write(entry journalEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	// Each entry is written as it happens so that it survives a crash
+	_, err = journal.file.Write(append(b, '\n'))
+	return err
+}
+
+// Record a file or directory that was loaded. The path of the metadata is
+// relative to the sandbox. A journal that can't be written only means that
+// the load can't be resumed so it doesn't stop the load.
+func (journal *loadJournal) record(meta metaObject) {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+
+	if journal.failed {
+		return
+	}
+
+	err := journal.write(journalEntry{Item: &meta})
+	if err != nil {
+		journal.failed = true
+		fmt.Printf("\nWARNING: The progress of the load can't be recorded, it won't be possible to resume it: %v\n", err.Error())
+	}
+}
+
+// Record that all of the component was loaded
+func (journal *loadJournal) finishComponent(componentId string, etag string) {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+
+	if journal.failed {
+		return
+	}
+
+	err := journal.write(journalEntry{Component: componentId, Etag: etag})
+	if err != nil {
+		journal.failed = true
+		fmt.Printf("\nWARNING: The progress of the load can't be recorded, it won't be possible to resume it: %v\n", err.Error())
+	}
+}
+
+// The load is finished and its metadata saved, the journal is no longer needed
+func (journal *loadJournal) remove() error {
+	journal.file.Close()
+	return os.Remove(journal.file.Name())
+}
@@ -2,22 +2,24 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/sha1"
 	"encoding/base64"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 )
 
 const (
-	numGoRoutines = 10
-	bufferSize    = 1000
+	bufferSize = 1000
 )
 
 func loadDefaults() {
@@ -26,6 +28,7 @@ func loadDefaults() {
 }
 
 func loadOp() {
+	operation := commandLine()
 	var projectName string
 
 	streamDef := ""
@@ -45,8 +48,37 @@ func loadOp() {
 
 	sandboxPath := flag.String("sandbox", "", "Location of the sandbox to load the files")
 	force := flag.Bool("force", false, "Force the load to overwrite any files. Don't prompt.")
+	clobber := flag.Bool("clobber", false, "Overwrite local changes with the remote files instead of merging them. The changes are still backed up.")
+	pristine := flag.Bool("pristine", true, "Keep compressed copies of the loaded files for offline diff and revert, and for merging. The choice is remembered by the sandbox.")
+	resume := flag.Bool("resume", false, "Continue a load that was interrupted, skipping the files it already loaded.")
+	var paths stringList
+	flag.Var(&paths, "path", "Only load this path, relative to the sandbox. Repeat to load several paths. The paths are remembered by the sandbox, use '-path .' to load everything again.")
+	var componentNames stringList
+	flag.Var(&componentNames, "component", "Only load the component with this name. Repeat to load several components. The components are remembered by the sandbox, use '-component *' to load all of them again.")
+	snapshot := flag.String("snapshot", "", "Load the components as they were in this snapshot of the stream or repository workspace. The sandbox is read-only and remembers the snapshot, use '-snapshot=' to load the latest again.")
+	var baselineSpecs stringList
+	flag.Var(&baselineSpecs, "baseline", "Load a component as it was in a baseline, given as <component>=<baseline>. Repeat for several components. The sandbox is read-only.")
+	componentDirs := flag.Bool("component-dirs", false, "Load each component into its own folder of the sandbox named after the component instead of loading them all into the root. Only for new sandboxes.")
+	wait := flag.Duration("wait", 0, "How long to wait for another operation on the sandbox to finish instead of failing right away.")
+	applyTransferFlags := transferFlags()
 	flag.Usage = loadDefaults
 	flag.Parse()
+	applyTransferFlags()
+
+	pristineSet := false
+	componentDirsSet := false
+	configurationSet := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "snapshot" || f.Name == "baseline" {
+			configurationSet = true
+		}
+		if f.Name == "pristine" {
+			pristineSet = true
+		}
+		if f.Name == "component-dirs" {
+			componentDirsSet = true
+		}
+	})
 
 	if *sandboxPath == "" {
 		path, err := os.Getwd()
@@ -58,13 +90,40 @@ func loadOp() {
 		sandboxPath = &path
 	}
 
+	lock, err := lockSandbox(*sandboxPath, operation, *wait)
+	if err != nil {
+		panic(err)
+	}
+	defer lock.unlock()
+
+	// An interrupted load leaves its journal behind
+	var journal *loadJournal
+	_, journalErr := os.Stat(filepath.Join(*sandboxPath, journalFileName))
+	if *resume {
+		if journalErr != nil {
+			panic(simpleWarning("There is no interrupted load to resume in this sandbox."))
+		}
+
+		journal, err = readJournal(*sandboxPath)
+		if err != nil {
+			panic(err)
+		}
+	} else if journalErr == nil {
+		fmt.Println("A previous load into this sandbox was interrupted. Use 'gojazz load -resume' to continue it.")
+	}
+
 	// Get the existing status of the sandbox, if available
 	// Back up any changes that are found
-	status, _ := scmStatus(*sandboxPath, BACKUP)
+	status, _ := scmBackup(*sandboxPath, operation, nil)
 
 	if status != nil && !status.unchanged() {
 		fmt.Printf("Here was the status of your sandbox before loading:\n%v", status)
 		fmt.Printf("Your changes have been backed up to this location: %v\n", status.copyPath)
+
+		_, err := pruneBackups(*sandboxPath, defaultBackupRetention)
+		if err != nil {
+			panic(err)
+		}
 	}
 
 	// You don't need credentials to load streams of public projects
@@ -74,7 +133,7 @@ func loadOp() {
 	// If the user specified a workspace or previously loaded a workspace
 	//  then we will need credentials. If they are already logged in then
 	//  use those credentials.
-	if *workspace || (status != nil && !status.metaData.isstream) || isLoggedIn() {
+	if *workspace || (status != nil && !status.metaData.isstream) || (journal != nil && !journal.header.IsStream) || isLoggedIn() {
 		var err error
 		userId, password, err = getCredentials()
 		if err != nil {
@@ -94,8 +153,14 @@ func loadOp() {
 	workspaceId := ""
 	ccmBaseUrl := ""
 
-	// This is either a fresh sandbox or project/stream/workspace information was provided
-	if status == nil || projectName != "" {
+	if journal != nil {
+		// Continue with whatever the interrupted load was loading
+		projectName = journal.header.ProjectName
+		isstream = journal.header.IsStream
+		workspaceId = journal.header.WorkspaceId
+		ccmBaseUrl = journal.header.CcmBaseUrl
+	} else if status == nil || projectName != "" {
+		// This is either a fresh sandbox or project/stream/workspace information was provided
 		if projectName == "" {
 			fmt.Println("Provide a project to load and try again.")
 			loadDefaults()
@@ -187,13 +252,96 @@ func loadOp() {
 		ccmBaseUrl = status.metaData.ccmBaseUrl
 	}
 
-	if isstream {
+	noPristine := !*pristine
+	if status != nil && !pristineSet {
+		noPristine = status.metaData.noPristine
+	}
+	if journal != nil {
+		noPristine = journal.header.NoPristine
+	}
+
+	sparse := []string{}
+	if status != nil {
+		sparse = status.metaData.sparse
+	}
+	if len(paths) > 0 {
+		sparse, err = sparsePaths(paths)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if journal != nil {
+		sparse = journal.header.Sparse
+	}
+
+	components := []string{}
+	if status != nil {
+		components = status.metaData.components
+	}
+	if len(componentNames) > 0 {
+		components, err = findComponentsByName(client, ccmBaseUrl, workspaceId, componentNames)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if journal != nil {
+		components = journal.header.Components
+	}
+
+	snapshotName := ""
+	baselines := make(map[string]baseline)
+	if status != nil {
+		snapshotName = status.metaData.snapshot
+		baselines = status.metaData.baselines
+	}
+	if configurationSet {
+		snapshotName = *snapshot
+		baselines, err = findConfiguration(client, ccmBaseUrl, workspaceId, *snapshot, baselineSpecs)
+		if err != nil {
+			panic(err)
+		}
+
+		// The configuration decides which components there are unless
+		//  they were picked
+		if len(componentNames) == 0 && len(baselines) > 0 {
+			components = baselineComponents(baselines)
+		}
+	}
+	if journal != nil {
+		snapshotName = journal.header.Snapshot
+		baselines = journal.header.Baselines
+	}
+
+	// Moving the components around would look like every file was deleted
+	//  and added again
+	if status != nil {
+		loadedDirs := len(status.metaData.componentDirs) > 0
+		if componentDirsSet && *componentDirs != loadedDirs {
+			panic(simpleWarning("The sandbox already has its components laid out differently. Load into a new sandbox to change it."))
+		}
+		*componentDirs = loadedDirs
+	}
+	if journal != nil {
+		*componentDirs = len(journal.header.ComponentDirs) > 0
+	}
+
+	if snapshotName != "" || len(baselines) > 0 {
+		fmt.Printf("Note: Loading a snapshot or baselines will not allow you to contribute changes. Load again with '-snapshot=' to get the latest.\n")
+	} else if isstream {
 		fmt.Printf("Note: Loading from a stream will not allow you to contribute changes. You must load again using the '-workspace=true' option.\n")
 	}
 
-	scmLoad(client, ccmBaseUrl, projectName, workspaceId, isstream, userId, *sandboxPath, status, *force)
+	conflicts := scmLoad(client, ccmBaseUrl, projectName, workspaceId, isstream, userId, *sandboxPath, status, loadOptions{force: *force, clobber: *clobber, noPristine: noPristine, sparse: sparse, components: components, componentDirs: *componentDirs, snapshot: snapshotName, baselines: baselines, resume: *resume})
 
 	fmt.Printf("Load Successful\n")
+	fmt.Printf("Transferred %v\n", client.Statistics())
+
+	rememberSandbox(*sandboxPath)
+
+	if !conflicts.empty() {
+		fmt.Printf("These files were changed both locally and remotely and could not be merged:\n%v", conflicts)
+		fmt.Printf("Resolve the conflicts before checking in.\n")
+	}
 
 	// If we loaded from a repository workspace then init the web IDE project and
 	//  provide a URL for them to manage their changes
@@ -222,7 +370,53 @@ func loadOp() {
 	}
 }
 
-func scmLoad(client *Client, ccmBaseUrl string, projectName string, workspaceId string, stream bool, userId string, sandbox string, status *status, force bool) {
+// How a load treats the local changes and what it loads into the sandbox
+type loadOptions struct {
+	// Replace files in a sandbox that wasn't loaded yet without asking
+	force bool
+	// Replace the local changes instead of merging incoming changes into them
+	clobber bool
+	// Don't keep pristine copies of the loaded files
+	noPristine bool
+	// Only load these paths and components, everything if they are empty
+	sparse     []string
+	components []string
+	// Load each component into its own directory
+	componentDirs bool
+	// Load the components as they were in these baselines, recording the
+	//  snapshot that they came from
+	snapshot  string
+	baselines map[string]baseline
+	// Continue the journal of a load that was interrupted
+	resume bool
+}
+
+// The options that the sandbox was loaded with, so that it can be loaded
+// again the same way
+func (metadata *metaData) loadOptions() loadOptions {
+	return loadOptions{
+		noPristine:    metadata.noPristine,
+		sparse:        metadata.sparse,
+		components:    metadata.components,
+		componentDirs: len(metadata.componentDirs) > 0,
+		snapshot:      metadata.snapshot,
+		baselines:     metadata.baselines,
+	}
+}
+
+// Load the remote workspace or stream into the sandbox. Unless clobber is
+// set, local changes found in the status are kept and merged with any
+// incoming changes to the same files. Only the sparse paths and the selected
+// components are loaded if there are any. The components are loaded into
+// the root of the sandbox unless componentDirs is set, then each one gets
+// its own directory. Components with a baseline are loaded as they were in
+// it, the snapshot they came from is only recorded. The progress is
+// journaled, with resume set the load continues from the journal of a load
+// that was interrupted. The conflicts that couldn't be merged are returned.
+func scmLoad(client *Client, ccmBaseUrl string, projectName string, workspaceId string, stream bool, userId string, sandbox string, status *status, options loadOptions) *conflicts {
+	conflicts := newConflicts()
+	merge := status != nil && !options.clobber
+
 	newMetaData := newMetaData()
 	newMetaData.initConcurrentWrite()
 	newMetaData.isstream = stream
@@ -230,8 +424,32 @@ func scmLoad(client *Client, ccmBaseUrl string, projectName string, workspaceId
 	newMetaData.ccmBaseUrl = ccmBaseUrl
 	newMetaData.projectName = projectName
 	newMetaData.workspaceId = workspaceId
+	newMetaData.noPristine = options.noPristine
+	newMetaData.sparse = options.sparse
+	newMetaData.components = options.components
+	newMetaData.snapshot = options.snapshot
+	newMetaData.baselines = options.baselines
+
+	// Find the components to load and make sure that they fit into the
+	//  sandbox before anything is changed
+	allComponents, err := FindComponents(client, ccmBaseUrl, workspaceId)
+	if err != nil {
+		panic(err)
+	}
+	loadComponents := selectedComponents(allComponents, options.components)
 
-	if status != nil {
+	if !options.componentDirs {
+		err = checkComponentRoots(client, ccmBaseUrl, workspaceId, newMetaData, loadComponents)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if merge {
+		// Local changes are kept, they will be merged as the files are loaded
+	} else if options.resume {
+		// The files in the sandbox are from the interrupted load
+	} else if status != nil {
 		// Delete any files that were added/modified (they should already be backed up)
 		for addedPath, _ := range status.Added {
 			err := os.RemoveAll(filepath.Join(sandbox, addedPath))
@@ -260,7 +478,15 @@ func scmLoad(client *Client, ccmBaseUrl string, projectName string, workspaceId
 				panic(err)
 			}
 
-			if len(children) > 0 && !force {
+			// The sandbox lock doesn't count
+			files := 0
+			for _, child := range children {
+				if child != lockFileName {
+					files++
+				}
+			}
+
+			if files > 0 && !options.force {
 				fmt.Println("There are files in the sandbox directory that will be replaced with the remote files.")
 				fmt.Print("Do you want to proceed? [Y/n]:")
 				reader := bufio.NewReader(os.Stdin)
@@ -274,19 +500,82 @@ func scmLoad(client *Client, ccmBaseUrl string, projectName string, workspaceId
 		}
 	}
 
-	// Delete the old metadata
-	metadataFile := filepath.Join(sandbox, metadataFileName)
-	os.Remove(metadataFile)
-
-	// Find all of the components of the remote workspace and then walk over each one
-	componentIds, err := FindComponentIds(client, ccmBaseUrl, workspaceId)
+	policy, err := loadIgnorePolicy(sandbox)
 	if err != nil {
 		panic(err)
 	}
 
+	// Conflicts found by this load count as well as those it started with
+	previouslyConflicted := map[string]bool{}
+	if status != nil {
+		previouslyConflicted = status.metaData.conflictPaths()
+	}
+	policy.conflicted = func(rel string) bool { return previouslyConflicted[rel] || conflicts.has(rel) }
+
+	cache := openUserCache()
+
+	var journal *loadJournal
+	if options.resume {
+		journal, err = resumeJournal(sandbox)
+		if err != nil {
+			panic(err)
+		}
+
+		// The metadata went away with the interrupted load, the local
+		//  changes that it was merging are in the journal
+		if status == nil && journal.header.Merge {
+			status = journal.mergeStatus(sandbox)
+			merge = true
+		}
+	}
+
+	if options.componentDirs {
+		// Components keep the folder they were loaded into before
+		previous := make(map[string]string)
+		if journal != nil {
+			previous = journal.header.ComponentDirs
+		} else if status != nil {
+			previous = status.metaData.componentDirs
+		}
+		newMetaData.componentDirs = assignComponentDirs(loadComponents, previous)
+	}
+
+	// Clean up the leftovers of a load that was interrupted, which leaves
+	//  its journal behind. Only the paths being loaded again are looked at
+	//  rather than the whole sandbox.
+	if _, err := os.Stat(filepath.Join(sandbox, journalFileName)); err == nil {
+		scope := options.sparse
+		if len(scope) == 0 {
+			for _, dir := range newMetaData.componentDirs {
+				scope = append(scope, dir)
+			}
+		}
+
+		err = cleanDownloads(sandbox, scope)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if journal == nil {
+		header := journalHeader{CcmBaseUrl: ccmBaseUrl, ProjectName: projectName, WorkspaceId: workspaceId, UserId: userId, IsStream: stream, NoPristine: options.noPristine, Sparse: options.sparse, Components: options.components, ComponentDirs: newMetaData.componentDirs, Snapshot: options.snapshot, Baselines: options.baselines}
+		if merge {
+			header.recordMerge(status)
+		}
+		journal, err = createJournal(sandbox, header)
+		if err != nil {
+			panic(err)
+		}
+	}
+	newMetaData.journal = journal
+
+	// Delete the old metadata
+	metadataFile := filepath.Join(sandbox, metadataFileName)
+	os.Remove(metadataFile)
+
 	// Walk through the remote components creating directories, if necessary and cleaning up any deleted files
-	for _, componentId := range componentIds {
-		loadComponent(client, ccmBaseUrl, workspaceId, componentId, sandbox, newMetaData, status)
+	for _, component := range loadComponents {
+		loadComponent(client, ccmBaseUrl, workspaceId, component.ScmInfo.ItemId, sandbox, newMetaData, status, policy, cache, merge, conflicts)
 	}
 
 	// Do a final pass over the top-level elements in the sandbox
@@ -302,7 +591,7 @@ func scmLoad(client *Client, ccmBaseUrl string, projectName string, workspaceId
 	for _, root := range roots {
 		rootPath := filepath.Join(sandbox, root)
 
-		ignored, err := IsIgnored(rootPath)
+		ignored, _, err := policy.check(rootPath)
 		if err != nil {
 			panic(err)
 		}
@@ -311,8 +600,17 @@ func scmLoad(client *Client, ccmBaseUrl string, projectName string, workspaceId
 			continue
 		}
 
+		// Whatever is outside of the sparse paths is left alone
+		if inside, _ := pathInScope(options.sparse, root); !inside {
+			continue
+		}
+
 		_, ok := newMetaData.get(rootPath, sandbox)
 
+		if !ok && merge && keepLocal(status, root, conflicts) {
+			continue
+		}
+
 		if !ok {
 			err = os.RemoveAll(rootPath)
 			if err != nil {
@@ -321,14 +619,199 @@ func scmLoad(client *Client, ccmBaseUrl string, projectName string, workspaceId
 		}
 	}
 
-	newMetaData.save(metadataFile)
+	if status != nil {
+		removeOutsideSparse(sandbox, status, options.sparse)
+	}
+
+	err = newMetaData.save(metadataFile)
+	if err != nil {
+		panic(err)
+	}
+
+	for _, p := range options.sparse {
+		if _, ok := newMetaData.pathMap[p]; !ok {
+			fmt.Printf("Warning: %v was not found in any of the components\n", p)
+		}
+	}
+
+	err = journal.remove()
+	if err != nil {
+		panic(err)
+	}
+
+	err = pruneBase(sandbox, newMetaData)
+	if err != nil {
+		panic(err)
+	}
+
+	if cache != nil {
+		_, _, err = cache.prune(cache.maxSize)
+		if err != nil {
+			fmt.Printf("Warning: The download cache could not be pruned: %v\n", err.Error())
+		}
+	}
+
+	return conflicts
+}
+
+// Clean up and check the paths of a sparse load. An empty list means that
+// everything is loaded.
+func sparsePaths(paths []string) ([]string, error) {
+	result := []string{}
+
+	for _, p := range paths {
+		p = filepath.Clean(filepath.FromSlash(p))
+		p = strings.TrimPrefix(p, string(filepath.Separator))
+
+		if p == ".." || strings.HasPrefix(p, ".."+string(filepath.Separator)) {
+			return nil, simpleWarning(fmt.Sprintf("%v is not inside of the sandbox", p))
+		}
+
+		// The whole sandbox
+		if p == "." || p == "" {
+			return []string{}, nil
+		}
+
+		result = append(result, p)
+	}
+
+	sort.Strings(result)
+	return result, nil
+}
+
+func samePaths(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for idx, _ := range a {
+		if a[idx] != b[idx] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Remove the files loaded previously that are outside of the new sparse
+// paths. Files with local changes are kept, as are directories that aren't
+// empty.
+func removeOutsideSparse(sandbox string, status *status, sparse []string) {
+	if len(sparse) == 0 {
+		return
+	}
+
+	paths := []string{}
+	for rel, _ := range status.metaData.pathMap {
+		paths = append(paths, rel)
+	}
+	sort.Strings(paths)
+
+	// Children go before their parents
+	for idx := len(paths) - 1; idx >= 0; idx-- {
+		rel := paths[idx]
+
+		inside, descend := pathInScope(sparse, rel)
+		if inside || descend || status.Modified[rel] {
+			continue
+		}
+
+		// Fails for directories that still have something in them
+		os.Remove(filepath.Join(sandbox, rel))
+	}
+}
+
+// An item that is no longer on the remote is kept if it, or anything inside
+// it, was added or modified locally. Removing a modified item remotely
+// conflicts with the local changes.
+func keepLocal(status *status, rel string, conflicts *conflicts) bool {
+	if status.Added[rel] {
+		return true
+	}
+
+	prefix := rel + string(filepath.Separator)
+	for modified, _ := range status.Modified {
+		if modified == rel || strings.HasPrefix(modified, prefix) {
+			conflicts.add(rel, "deleted remotely, modified locally")
+			return true
+		}
+	}
+	for added, _ := range status.Added {
+		if strings.HasPrefix(added, prefix) {
+			conflicts.add(rel, "deleted remotely, files added locally")
+			return true
+		}
+	}
+
+	return false
 }
 
-func loadComponent(client *Client, ccmBaseUrl string, workspaceId string, componentId string, sandbox string, newMetaData *metaData, status *status) {
-	// Optimization: if status is unchanged and the component's ETag is the same
-	//  then we can skip downloading this component
-	if status != nil && status.unchanged() {
-		// TODO implement the optimization
+func loadComponent(client *Client, ccmBaseUrl string, workspaceId string, componentId string, sandbox string, newMetaData *metaData, status *status, policy *ignorePolicy, cache *downloadCache, merge bool, conflicts *conflicts) {
+	journal := newMetaData.journal
+	componentRef := newMetaData.componentRef(componentId)
+
+	// None of the sparse paths are in the component's own folder
+	componentDir := newMetaData.componentDirs[componentId]
+	if componentDir != "" {
+		if inside, descend := pathInScope(newMetaData.sparse, componentDir); !inside && !descend {
+			return
+		}
+	}
+
+	// The interrupted load already loaded all of this component
+	if etag, ok := journal.components[componentId]; ok {
+		for relpath, meta := range journal.items {
+			if meta.ComponentId == componentId {
+				meta.Path = filepath.Join(sandbox, relpath)
+				newMetaData.put(meta, sandbox)
+			}
+		}
+
+		newMetaData.componentEtag[componentId] = etag
+		journal.finishComponent(componentId, etag)
+		return
+	}
+
+	// The ETag carries the component's sync time, which changes whenever
+	//  anything in the component changes
+	root, err := Open(client, ccmBaseUrl, workspaceId, componentRef, "/")
+	if err != nil {
+		panic(err)
+	}
+	etag := root.etag
+
+	// Optimization: if none of the component's files were changed locally (or
+	//  local changes are being kept anyway) and the component's ETag is the same
+	//  then we can skip downloading this component. Turning on pristine copies
+	//  needs a full pass to fill them in.
+	if status != nil && status.metaData.workspaceId == workspaceId && status.metaData.noPristine == newMetaData.noPristine && samePaths(status.metaData.sparse, newMetaData.sparse) && status.metaData.baselines[componentId] == newMetaData.baselines[componentId] && (merge || !status.componentChanged(componentId)) {
+		prevEtag, ok := status.metaData.componentEtag[componentId]
+
+		if ok && prevEtag == etag {
+			// Push the old metadata forward for the whole component
+			for relpath, meta := range status.metaData.pathMap {
+				if meta.ComponentId == componentId {
+					meta.Path = filepath.Join(sandbox, relpath)
+					newMetaData.put(meta, sandbox)
+				}
+			}
+
+			newMetaData.componentEtag[componentId] = etag
+			journal.finishComponent(componentId, etag)
+			return
+		}
+	}
+
+	if componentDir != "" {
+		err = os.MkdirAll(filepath.Join(sandbox, componentDir), 0700)
+		if err != nil {
+			panic(err)
+		}
+
+		// The component's folder stands for its root
+		scmInfo := root.info.ScmInfo
+		meta := metaObject{Path: filepath.Join(sandbox, componentDir), ItemId: scmInfo.ItemId, StateId: scmInfo.StateId, ComponentId: componentId}
+		newMetaData.put(meta, sandbox)
 	}
 
 	// Queue of paths to download (empty string means we are done)
@@ -398,19 +881,40 @@ func loadComponent(client *Client, ccmBaseUrl string, workspaceId string, compon
 
 				workTracker <- true
 
-				remoteFile, err := Open(client, ccmBaseUrl, workspaceId, componentId, pathToDownload)
+				remoteFile, err := Open(client, ccmBaseUrl, workspaceId, componentRef, pathToDownload)
 				if err != nil {
 					// We try one more time with a small timeout
 					<-time.After(10 * time.Millisecond)
-					remoteFile, err = Open(client, ccmBaseUrl, workspaceId, componentId, pathToDownload)
+					remoteFile, err = Open(client, ccmBaseUrl, workspaceId, componentRef, pathToDownload)
 					if err != nil {
 						panic(err)
 					}
 				}
 
 				scmInfo := remoteFile.info.ScmInfo
-				localPath := filepath.Join(sandbox, pathToDownload)
-				localSandboxPath := filepath.FromSlash(pathToDownload)
+				localSandboxPath := newMetaData.localPath(componentId, pathToDownload)
+				localPath := filepath.Join(sandbox, localSandboxPath)
+
+				// Downloaded by the interrupted load and still intact, or
+				//  merged with the local changes by it
+				if prevMeta, ok := journal.items[localSandboxPath]; ok && prevMeta.StateId == scmInfo.StateId && prevMeta.Hash != "" {
+					merged := merge && (status.Modified[localSandboxPath] || status.Deleted[localSandboxPath] || status.Added[localSandboxPath])
+					hash, _ := hashFile(localPath)
+					stat, _ := os.Stat(localPath)
+
+					if (merged || hash == prevMeta.Hash) && stat != nil && (newMetaData.noPristine || hasBase(sandbox, prevMeta.Hash)) {
+						remoteFile.Close()
+						prevMeta.Path = localPath
+						if !merged {
+							prevMeta.setStat(stat)
+						} else if prevMeta.Conflict {
+							conflicts.add(localSandboxPath, "merged with conflicts by the interrupted load")
+						}
+						newMetaData.put(prevMeta, sandbox)
+						workTracker <- false
+						continue
+					}
+				}
 
 				// Optimization: State ID is the same as last time and there were no local modifications
 				if status != nil && !status.Modified[localSandboxPath] && !status.Deleted[localSandboxPath] {
@@ -419,42 +923,131 @@ func loadComponent(client *Client, ccmBaseUrl string, workspaceId string, compon
 					if ok && prevMeta.StateId == scmInfo.StateId {
 						// Push the old metadata forward for this file
 						remoteFile.Close()
+						if !newMetaData.noPristine {
+							err = ensureBase(sandbox, prevMeta)
+							if err != nil {
+								panic(err)
+							}
+						}
 						newMetaData.put(prevMeta, sandbox)
 						workTracker <- false
 						continue
 					}
 				}
 
-				localFile, err := os.Create(filepath.Join(sandbox, pathToDownload))
+				if merge && (status.Modified[localSandboxPath] || status.Deleted[localSandboxPath] || status.Added[localSandboxPath]) {
+					meta := mergeRemoteFile(remoteFile, localPath, localSandboxPath, sandbox, status, newMetaData.noPristine, conflicts)
+					newMetaData.put(meta, sandbox)
+					workTracker <- false
+					continue
+				}
+
+				if merge {
+					// The parent directory may have been deleted locally
+					err = os.MkdirAll(filepath.Dir(localPath), 0700)
+					if err != nil {
+						panic(err)
+					}
+				}
+
+				// Another sandbox may have loaded the same version of the file
+				if cache != nil {
+					hash, ok := cache.fetch(scmInfo.ItemId, scmInfo.StateId, localPath, sandbox, newMetaData.noPristine)
+					if ok {
+						remoteFile.Close()
+						stat, _ := os.Stat(localPath)
+
+						meta := metaObject{
+							Path:        localPath,
+							ItemId:      scmInfo.ItemId,
+							StateId:     scmInfo.StateId,
+							ComponentId: scmInfo.ComponentId,
+							Hash:        hash,
+						}
+						meta.setStat(stat)
+
+						newMetaData.put(meta, sandbox)
+						workTracker <- false
+						continue
+					}
+				}
+
+				// The file is only replaced once it has been downloaded completely
+				localFile, err := createDownloadWriter(localPath)
 				if err != nil {
 					panic(err)
 				}
+				writers := []io.Writer{localFile}
 
-				// Setup the SHA-1 hash of the file contents
-				hash := sha1.New()
-				tee := io.MultiWriter(localFile, hash)
+				// Keep a pristine copy of the file too
+				var baseFile *baseWriter
+				if !newMetaData.noPristine {
+					baseFile, err = createBaseWriter(sandbox)
+					if err != nil {
+						localFile.abort()
+						panic(err)
+					}
+					writers = append(writers, baseFile)
+				}
 
-				numBytes, err := io.Copy(tee, remoteFile)
+				// Share it with the other sandboxes
+				var cacheFile *cacheWriter
+				if cache != nil {
+					cacheFile, _ = cache.createWriter()
+					if cacheFile != nil {
+						writers = append(writers, cacheFile)
+					}
+				}
+
+				numBytes, err := io.Copy(io.MultiWriter(writers...), remoteFile)
+				remoteFile.Close()
 				if err != nil {
+					localFile.abort()
+					if baseFile != nil {
+						baseFile.abort()
+					}
+					if cacheFile != nil {
+						cacheFile.abort()
+					}
 					panic(err)
 				}
 
 				workTransfer <- numBytes
 
-				localFile.Close()
-				remoteFile.Close()
+				hash := localFile.sum()
+				err = localFile.commit(remoteFile.info.Length, "")
+				if err != nil {
+					if baseFile != nil {
+						baseFile.abort()
+					}
+					if cacheFile != nil {
+						cacheFile.abort()
+					}
+					panic(err)
+				}
+
+				if cacheFile != nil {
+					// Not being able to cache the file doesn't matter to this load
+					cacheFile.commit(scmInfo.ItemId, scmInfo.StateId, hash)
+				}
+
+				if baseFile != nil {
+					err = baseFile.commit(hash)
+					if err != nil {
+						panic(err)
+					}
+				}
 
 				stat, _ := os.Stat(localPath)
 
 				meta := metaObject{
-					Path:         localPath,
-					ItemId:       scmInfo.ItemId,
-					StateId:      scmInfo.StateId,
-					ComponentId:  scmInfo.ComponentId,
-					LastModified: stat.ModTime().Unix(),
-					Size:         stat.Size(),
-					Hash:         base64.StdEncoding.EncodeToString(hash.Sum(nil)),
+					Path:        localPath,
+					ItemId:      scmInfo.ItemId,
+					StateId:     scmInfo.StateId,
+					ComponentId: scmInfo.ComponentId,
+					Hash:        hash,
 				}
+				meta.setStat(stat)
 
 				newMetaData.put(meta, sandbox)
 
@@ -463,12 +1056,18 @@ func loadComponent(client *Client, ccmBaseUrl string, workspaceId string, compon
 		}
 	}
 
-	for i := 0; i < numGoRoutines; i++ {
+	for i := 0; i < numDownloadGoroutines; i++ {
 		go downloadFiles()
 	}
 
-	err := Walk(client, ccmBaseUrl, workspaceId, componentId, func(p string, file File) error {
-		localPath := filepath.Join(sandbox, p)
+	err = Walk(client, ccmBaseUrl, workspaceId, componentRef, func(p string, file File) error {
+		rel := newMetaData.localPath(componentId, p)
+		localPath := filepath.Join(sandbox, rel)
+
+		// Only the sparse paths are loaded, along with the directories above them
+		if inside, descend := pathInScope(newMetaData.sparse, rel); !inside && (!descend || !file.info.Directory) {
+			return filepath.SkipDir
+		}
 
 		if file.info.Directory {
 			workTracker <- true
@@ -476,9 +1075,12 @@ func loadComponent(client *Client, ccmBaseUrl string, workspaceId string, compon
 			stat, _ := os.Stat(localPath)
 
 			if stat == nil {
-				err := os.MkdirAll(localPath, 0700)
-				if err != nil {
-					return err
+				// Directories deleted locally stay deleted when merging
+				if !merge || !status.Deleted[rel] {
+					err := os.MkdirAll(localPath, 0700)
+					if err != nil {
+						return err
+					}
 				}
 			} else if !stat.IsDir() {
 				// Weird, there's a file with the same name as the directory in the workspace here
@@ -508,10 +1110,18 @@ func loadComponent(client *Client, ccmBaseUrl string, workspaceId string, compon
 
 					if !existsOnRemote {
 						localChildPath := filepath.Join(localPath, localChild)
-						ignored, err := IsIgnored(localChildPath)
+
+						if inside, _ := pathInScope(newMetaData.sparse, filepath.Join(rel, localChild)); !inside {
+							continue
+						}
+
+						ignored, _, err := policy.check(localChildPath)
 						if err != nil {
 							return err
 						}
+						if !ignored && merge && keepLocal(status, filepath.Join(rel, localChild), conflicts) {
+							continue
+						}
 						if !ignored {
 							err := os.RemoveAll(localChildPath)
 							if err != nil {
@@ -537,7 +1147,7 @@ func loadComponent(client *Client, ccmBaseUrl string, workspaceId string, compon
 	})
 
 	// Send the stop signal to all download routines
-	for i := 0; i < numGoRoutines; i++ {
+	for i := 0; i < numDownloadGoroutines; i++ {
 		downloadQueue <- ""
 		<-finished
 	}
@@ -550,4 +1160,112 @@ func loadComponent(client *Client, ccmBaseUrl string, workspaceId string, compon
 	if err != nil {
 		panic(err)
 	}
+
+	// Everything in the component is loaded, the next load can skip it if it doesn't change
+	newMetaData.componentEtag[componentId] = etag
+	journal.finishComponent(componentId, etag)
+}
+
+// Load a remote file that was also changed locally (or added locally with
+// the same name) by merging the incoming contents into the local file. The
+// metadata records the remote version as the new base so that whatever is
+// left after the merge shows up as a local modification.
+func mergeRemoteFile(remoteFile *File, localPath string, rel string, sandbox string, status *status, noPristine bool, conflicts *conflicts) metaObject {
+	defer remoteFile.Close()
+
+	scmInfo := remoteFile.info.ScmInfo
+	prevMeta, tracked := status.metaData.get(localPath, sandbox)
+
+	// Local changes that don't overlap with a remote change stay as they are
+	if tracked && prevMeta.StateId == scmInfo.StateId {
+		return prevMeta
+	}
+
+	remoteContents, err := ioutil.ReadAll(remoteFile)
+	if err != nil {
+		panic(err)
+	}
+
+	hash := sha1.Sum(remoteContents)
+	remoteHash := base64.StdEncoding.EncodeToString(hash[:])
+
+	if !noPristine {
+		err = storeBase(sandbox, remoteHash, bytes.NewReader(remoteContents))
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	meta := metaObject{
+		Path:        localPath,
+		ItemId:      scmInfo.ItemId,
+		StateId:     scmInfo.StateId,
+		ComponentId: scmInfo.ComponentId,
+		Hash:        remoteHash,
+	}
+
+	if status.Deleted[rel] {
+		// Bring back the file so that the incoming change isn't lost
+		err = os.MkdirAll(filepath.Dir(localPath), 0700)
+		if err != nil {
+			panic(err)
+		}
+		err = writeDownload(localPath, bytes.NewReader(remoteContents))
+		if err != nil {
+			panic(err)
+		}
+
+		stat, err := os.Stat(localPath)
+		if err != nil {
+			panic(err)
+		}
+		meta.setStat(stat)
+
+		conflicts.add(rel, "deleted locally, modified remotely")
+		return meta
+	}
+
+	localContents, err := ioutil.ReadFile(localPath)
+	if err != nil {
+		panic(err)
+	}
+
+	// Files added on both sides are merged as if they started out empty
+	baseContents := []byte{}
+	mergeable := true
+	if tracked {
+		baseContents, err = readBase(sandbox, prevMeta.Hash)
+		mergeable = err == nil
+	}
+
+	merged, conflict, ok := []byte(nil), false, false
+	if mergeable {
+		merged, conflict, ok = mergeFile(baseContents, localContents, remoteContents)
+	}
+
+	if !ok {
+		// Keep both versions, the local one stays where it is
+		err = ioutil.WriteFile(localPath+remoteSuffix, remoteContents, 0600)
+		if err != nil {
+			panic(err)
+		}
+
+		meta.Conflict = true
+		conflicts.add(rel, "both versions kept, the remote version is in "+filepath.Base(localPath)+remoteSuffix)
+		return meta
+	}
+
+	err = writeDownload(localPath, bytes.NewReader(merged))
+	if err != nil {
+		panic(err)
+	}
+
+	if conflict {
+		meta.Conflict = true
+		conflicts.add(rel, "conflict markers were written to the file")
+	}
+
+	// The stat information is deliberately left empty so that the next status
+	//  compares the merged contents with the new base
+	return meta
 }
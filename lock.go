@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	lockFileName = ".jazzlock"
+
+	// How often a held lock is checked again while waiting for it
+	lockPollInterval = 200 * time.Millisecond
+
+	// A lock file that can't be read is assumed to be in the middle of being
+	//  written unless it is older than this
+	lockWriteGrace = 10 * time.Second
+)
+
+// An advisory lock held by an operation that changes the sandbox. It is a
+// file in the sandbox that records who holds it so that locks left behind by
+// an operation that didn't finish can be detected.
+type sandboxLock struct {
+	Pid       int
+	Host      string
+	Operation string
+	Time      time.Time
+
+	path string
+}
+
+func (lock *sandboxLock) String() string {
+	return fmt.Sprintf("'%v' (process %v on %v since %v)", lock.Operation, lock.Pid, lock.Host, lock.Time.Format("2006-01-02 15:04:05"))
+}
+
+// Acquire the lock of the sandbox for the operation, waiting up to the given
+// amount of time for another operation to release it. The sandbox directory
+// is created if it doesn't exist yet.
+func lockSandbox(sandboxPath string, operation string, wait time.Duration) (*sandboxLock, error) {
+	err := os.MkdirAll(sandboxPath, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+
+	lock := &sandboxLock{Pid: os.Getpid(), Host: host, Operation: operation, path: filepath.Join(sandboxPath, lockFileName)}
+	deadline := time.Now().Add(wait)
+
+	for {
+		lock.Time = time.Now()
+		acquired, err := lock.tryLock()
+		if err != nil {
+			return nil, err
+		}
+		if acquired {
+			return lock, nil
+		}
+
+		holder, err := readLock(lock.path)
+		if os.IsNotExist(err) {
+			// Released in the meantime
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if holder.stale(host) {
+			err = lock.breakStale(holder)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if !time.Now().Before(deadline) {
+			return nil, simpleWarning(fmt.Sprintf("The sandbox is in use by %v. Try again when it finishes or use -wait to wait for it.", holder))
+		}
+
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// Create the lock file, failing if it already exists
+func (lock *sandboxLock) tryLock() (bool, error) {
+	file, err := os.OpenFile(lock.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	b, err := json.Marshal(lock)
+	if err == nil {
+		_, err = file.Write(b)
+	}
+	if err != nil {
+		os.Remove(lock.path)
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Remove a lock that was found to be stale. Other operations may have found
+// it stale too, so it is claimed by renaming it first, which only one of them
+// can do. It is checked again in case it was released and a new lock was
+// taken since it was read, in which case the new lock is put back.
+func (lock *sandboxLock) breakStale(holder *sandboxLock) error {
+	claimed := fmt.Sprintf("%v-stale-%v", lock.path, os.Getpid())
+	err := os.Rename(lock.path, claimed)
+	if os.IsNotExist(err) {
+		// Another operation removed it first
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	current, err := readLock(claimed)
+	if err == nil && current.Pid == holder.Pid && current.Host == holder.Host && current.Time.Equal(holder.Time) {
+		fmt.Printf("Removing the lock left behind by %v\n", holder)
+		return os.Remove(claimed)
+	}
+
+	// Linking fails if yet another lock was taken in the meantime, that one
+	//  wins and this one is gone
+	err = os.Link(claimed, lock.path)
+	os.Remove(claimed)
+	if err != nil && !os.IsExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (lock *sandboxLock) unlock() error {
+	return os.Remove(lock.path)
+}
+
+func readLock(path string) (*sandboxLock, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	lock := &sandboxLock{path: path}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(b, lock)
+	if err != nil {
+		// Partially written lock, or garbage
+		lock.Operation = "unknown"
+		lock.Time = info.ModTime()
+	}
+
+	return lock, nil
+}
+
+// A lock is stale when the process that holds it has gone away. Processes on
+// other hosts sharing the sandbox can't be checked so their locks are only
+// stale if they aren't readable.
+func (lock *sandboxLock) stale(host string) bool {
+	if lock.Pid == 0 {
+		return time.Since(lock.Time) > lockWriteGrace
+	}
+
+	if lock.Host != host {
+		return false
+	}
+
+	return !processAlive(lock.Pid)
+}
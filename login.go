@@ -165,3 +165,26 @@ func storeCredentials(userId string, password string) error {
 
 	return nil
 }
+
+// Create a client for working with the repository workspace or stream that
+// was loaded into a sandbox. Streams of public projects don't need
+// credentials but they are used if the user is logged in.
+func newClientForSandbox(metadata *metaData) *Client {
+	userId := ""
+	password := ""
+
+	if !metadata.isstream || isLoggedIn() {
+		var err error
+		userId, password, err = getCredentials()
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	client, err := NewClient(userId, password)
+	if err != nil {
+		panic(err)
+	}
+
+	return client
+}
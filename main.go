@@ -30,9 +30,57 @@ func simpleWarning(msg string) *JazzError {
 	return &JazzError{Msg: msg, Log: false}
 }
 
+// Tell the user about an error that stopped an operation, writing the
+// details of unexpected problems to a log file
+func reportError(r interface{}) {
+	jazzError, ok := r.(*JazzError)
+	if ok {
+		// First, check to see if it a well known status code
+		if jazzError.StatusCode == 401 {
+			fmt.Printf("Error: Unauthorized. Use the login command to set your credentials.\n")
+			return
+		}
+
+		if jazzError.StatusCode == 403 {
+			fmt.Printf("Error: Forbidden. You are not allowed access.\n")
+			return
+		}
+
+		if jazzError.StatusCode == 404 {
+			fmt.Printf("Error: Not Found. Check the name and spelling and try again.\n")
+			return
+		}
+
+		if jazzError.Log {
+			fmt.Printf("ERROR: %v\n", jazzError.Msg)
+			logfile, err := ioutil.TempFile("", "gojazz-log")
+			if err == nil {
+				fmt.Printf("Writing details of this problem to %v\n", logfile.Name())
+				logfile.Write([]byte(fmt.Sprintf("ERROR: %v\n", r)))
+				logfile.Write([]byte(fmt.Sprintf("DETAILS: %v\n", jazzError.Details)))
+				logfile.Write(debug.Stack())
+			}
+		} else {
+			fmt.Printf("%v\n", jazzError.Msg)
+		}
+	} else {
+		fmt.Printf("ERROR: %v\n", r)
+		logfile, err := ioutil.TempFile("", "gojazz-log")
+		if err == nil {
+			fmt.Printf("Writing details of this problem to %v\n", logfile.Name())
+			logfile.Write([]byte(fmt.Sprintf("ERROR: %v\n", r)))
+			logfile.Write(debug.Stack())
+		}
+	}
+}
+
+const (
+	subcommands = "'load', 'status', 'diff', 'revert', 'stash', 'checkin', 'sync', 'backups', 'restore', 'export', 'ls', 'cat', 'stat', 'grep', 'cache', 'sandboxes', 'build' and 'login'"
+)
+
 func main() {
 	if len(os.Args) < 2 {
-		fmt.Printf("No subcommand provided. Available subcommands: 'load', 'status', 'sync', 'build' and 'login'\n")
+		fmt.Printf("No subcommand provided. Available subcommands: %v\n", subcommands)
 		return
 	}
 
@@ -45,47 +93,16 @@ func main() {
 			return
 		}
 
-		jazzError, ok := r.(*JazzError)
-		if ok {
-			// First, check to see if it a well known status code
-			if jazzError.StatusCode == 401 {
-				fmt.Printf("Error: Unauthorized. Use the login command to set your credentials.\n")
-				return
-			}
-
-			if jazzError.StatusCode == 403 {
-				fmt.Printf("Error: Forbidden. You are not allowed access.\n")
-				return
-			}
-
-			if jazzError.StatusCode == 404 {
-				fmt.Printf("Error: Not Found. Check the name and spelling and try again.\n")
-				return
-			}
-
-			if jazzError.Log {
-				fmt.Printf("ERROR: %v\n", jazzError.Msg)
-				logfile, err := ioutil.TempFile("", "gojazz-log")
-				if err == nil {
-					fmt.Printf("Writing details of this problem to %v\n", logfile.Name())
-					logfile.Write([]byte(fmt.Sprintf("ERROR: %v\n", r)))
-					logfile.Write([]byte(fmt.Sprintf("DETAILS: %v\n", jazzError.Details)))
-					logfile.Write(debug.Stack())
-				}
-			} else {
-				fmt.Printf("%v\n", jazzError.Msg)
-			}
-		} else {
-			fmt.Printf("ERROR: %v\n", r)
-			logfile, err := ioutil.TempFile("", "gojazz-log")
-			if err == nil {
-				fmt.Printf("Writing details of this problem to %v\n", logfile.Name())
-				logfile.Write([]byte(fmt.Sprintf("ERROR: %v\n", r)))
-				logfile.Write(debug.Stack())
-			}
-		}
+		reportError(r)
 	}()
 
+	// Every command that talks to the server keeps to the transfer
+	//  settings, but settings that can't be read don't stop any of them
+	err := loadTransferSettings()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v. The default transfer settings are used.\n", err.Error())
+	}
+
 	switch os.Args[1] {
 	case "load":
 		os.Args = os.Args[1:]
@@ -93,6 +110,21 @@ func main() {
 	case "status":
 		os.Args = os.Args[1:]
 		statusOp()
+	case "diff":
+		os.Args = os.Args[1:]
+		diffOp()
+	case "revert":
+		os.Args = os.Args[1:]
+		revertOp()
+	case "backups":
+		os.Args = os.Args[1:]
+		backupsOp()
+	case "restore":
+		os.Args = os.Args[1:]
+		restoreOp()
+	case "stash":
+		os.Args = os.Args[1:]
+		stashOp()
 	case "checkin":
 		os.Args = os.Args[1:]
 		checkinOp()
@@ -102,10 +134,31 @@ func main() {
 	case "login":
 		os.Args = os.Args[1:]
 		loginOp()
+	case "export":
+		os.Args = os.Args[1:]
+		exportOp()
+	case "ls":
+		os.Args = os.Args[1:]
+		lsOp()
+	case "cat":
+		os.Args = os.Args[1:]
+		catOp()
+	case "stat":
+		os.Args = os.Args[1:]
+		statOp()
+	case "grep":
+		os.Args = os.Args[1:]
+		grepOp()
+	case "cache":
+		os.Args = os.Args[1:]
+		cacheOp()
+	case "sandboxes":
+		os.Args = os.Args[1:]
+		sandboxesOp()
 	case "build":
 		os.Args = os.Args[1:]
 		buildOp()
 	default:
-		fmt.Printf("Invalid subcommand '%v'. Available subcommands: 'load', 'status', 'sync', 'build' and 'login'\n", os.Args[1])
+		fmt.Printf("Invalid subcommand '%v'. Available subcommands: %v\n", os.Args[1], subcommands)
 	}
 }
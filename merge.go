@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	conflictStartMarker = "<<<<<<<"
+	conflictSep         = "======="
+	conflictEndMarker   = ">>>>>>>"
+
+	conflictStart = conflictStartMarker + " local"
+	conflictEnd   = conflictEndMarker + " remote"
+
+	// Files that can't be merged keep the local version in place and the
+	//  incoming version is written next to it with this suffix
+	remoteSuffix = ".remote"
+
+	// Give up looking for matching lines when the files are this different,
+	//  the rest of the region becomes one conflict
+	maxDiffDistance = 2000
+)
+
+// Conflicts found while merging incoming changes with local ones, keyed by
+// sandbox relative path with a short description of the conflict
+type conflicts struct {
+	paths map[string]string
+	mutex sync.Mutex
+}
+
+func newConflicts() *conflicts {
+	return &conflicts{paths: make(map[string]string)}
+}
+
+func (conflicts *conflicts) add(rel string, description string) {
+	conflicts.mutex.Lock()
+	conflicts.paths[rel] = description
+	conflicts.mutex.Unlock()
+}
+
+func (conflicts *conflicts) has(rel string) bool {
+	conflicts.mutex.Lock()
+	defer conflicts.mutex.Unlock()
+
+	_, ok := conflicts.paths[rel]
+	return ok
+}
+
+func (conflicts *conflicts) empty() bool {
+	return len(conflicts.paths) == 0
+}
+
+func (conflicts *conflicts) String() string {
+	paths := make([]string, 0, len(conflicts.paths))
+	for p, _ := range conflicts.paths {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	result := ""
+	for _, p := range paths {
+		result = result + fmt.Sprintf("%v (Conflict: %v)\n", p, conflicts.paths[p])
+	}
+
+	return result
+}
+
+// Merge the local and remote versions of a file that both changed since the
+// base version. Regions changed on only one side are taken from that side,
+// regions changed on both sides differently are written between conflict
+// markers. If any of the versions look binary then ok is false and the file
+// can't be merged.
+func mergeFile(base []byte, local []byte, remote []byte) (merged []byte, conflict bool, ok bool) {
+	return mergeFileLabels(base, local, remote, "local", "remote")
+}
+
+// Like mergeFile but with the names of the two sides to put on the conflict
+// markers
+func mergeFileLabels(base []byte, local []byte, remote []byte, localLabel string, remoteLabel string) (merged []byte, conflict bool, ok bool) {
+	if isBinary(base) || isBinary(local) || isBinary(remote) {
+		return nil, false, false
+	}
+
+	lines, numConflicts := merge3(splitLines(base), splitLines(local), splitLines(remote), localLabel, remoteLabel)
+
+	return []byte(strings.Join(lines, "")), numConflicts > 0, true
+}
+
+// Check whether a merged file still has conflict markers in it
+func hasConflictMarkers(contents []byte) bool {
+	for _, line := range splitLines(contents) {
+		if strings.HasPrefix(line, conflictStartMarker+" ") || strings.HasPrefix(line, conflictEndMarker+" ") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Find the files in the sandbox that were left with a conflict by a merge
+// and haven't been resolved yet, either because they still have conflict
+// markers or because the other version is still next to them.
+// The paths, relative to the sandbox, of the files that were left with a
+// conflict by a merge
+func (metadata *metaData) conflictPaths() map[string]bool {
+	paths := make(map[string]bool)
+	for rel, meta := range metadata.pathMap {
+		if meta.Conflict {
+			paths[rel] = true
+		}
+	}
+
+	return paths
+}
+
+func unresolvedConflicts(status *status) []string {
+	unresolved := []string{}
+
+	for rel, meta := range status.metaData.pathMap {
+		if !meta.Conflict {
+			continue
+		}
+
+		localPath := filepath.Join(status.sandboxPath, rel)
+
+		_, remoteErr := os.Stat(localPath + remoteSuffix)
+		_, stashErr := os.Stat(localPath + stashSuffix)
+		if remoteErr == nil || stashErr == nil {
+			unresolved = append(unresolved, rel)
+			continue
+		}
+
+		contents, err := ioutil.ReadFile(localPath)
+		if err == nil && hasConflictMarkers(contents) {
+			unresolved = append(unresolved, rel)
+		}
+	}
+
+	sort.Strings(unresolved)
+
+	return unresolved
+}
+
+func isBinary(contents []byte) bool {
+	return bytes.IndexByte(contents, 0) != -1
+}
+
+// Split into lines, each keeping its line ending
+func splitLines(contents []byte) []string {
+	if len(contents) == 0 {
+		return []string{}
+	}
+
+	lines := strings.SplitAfter(string(contents), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	return lines
+}
+
+// A three-way merge in the style of diff3. The base is matched against each
+// side and the lines that are unchanged in both split the files into
+// regions that are resolved one at a time.
+func merge3(base []string, local []string, remote []string, localLabel string, remoteLabel string) ([]string, int) {
+	localMatches := matchLines(base, local)
+	remoteMatches := matchLines(base, remote)
+
+	merged := []string{}
+	numConflicts := 0
+	b, l, r := 0, 0, 0
+
+	for {
+		// Find the next base line that survived on both sides
+		i := b
+		for i < len(base) && (localMatches[i] < l || remoteMatches[i] < r) {
+			i++
+		}
+
+		localEnd, remoteEnd := len(local), len(remote)
+		if i < len(base) {
+			localEnd, remoteEnd = localMatches[i], remoteMatches[i]
+		}
+
+		baseChunk := base[b:i]
+		localChunk := local[l:localEnd]
+		remoteChunk := remote[r:remoteEnd]
+
+		switch {
+		case equalLines(localChunk, baseChunk):
+			merged = append(merged, remoteChunk...)
+		case equalLines(remoteChunk, baseChunk), equalLines(localChunk, remoteChunk):
+			merged = append(merged, localChunk...)
+		default:
+			numConflicts++
+			merged = append(merged, conflictStartMarker+" "+localLabel+"\n")
+			merged = append(merged, terminateLines(localChunk)...)
+			merged = append(merged, conflictSep+"\n")
+			merged = append(merged, terminateLines(remoteChunk)...)
+			merged = append(merged, conflictEndMarker+" "+remoteLabel+"\n")
+		}
+
+		if i == len(base) {
+			break
+		}
+
+		// The stable line itself
+		merged = append(merged, base[i])
+		b, l, r = i+1, localEnd+1, remoteEnd+1
+	}
+
+	return merged, numConflicts
+}
+
+func equalLines(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i, _ := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Lines written before a conflict marker need a line ending
+func terminateLines(lines []string) []string {
+	if len(lines) == 0 || strings.HasSuffix(lines[len(lines)-1], "\n") {
+		return lines
+	}
+
+	terminated := make([]string, len(lines))
+	copy(terminated, lines)
+	terminated[len(terminated)-1] += "\n"
+
+	return terminated
+}
+
+// For each line of a find the index of the matching line in b, or -1 if it
+// was removed. Matches are in increasing order and form a longest common
+// subsequence of the two.
+func matchLines(a []string, b []string) []int {
+	matches := make([]int, len(a))
+	for i, _ := range matches {
+		matches[i] = -1
+	}
+
+	// Most changes are small so trim the common prefix and suffix first
+	start := 0
+	for start < len(a) && start < len(b) && a[start] == b[start] {
+		matches[start] = start
+		start++
+	}
+
+	endA, endB := len(a), len(b)
+	for endA > start && endB > start && a[endA-1] == b[endB-1] {
+		endA--
+		endB--
+		matches[endA] = endB
+	}
+
+	myersMatch(a[start:endA], b[start:endB], start, start, matches)
+
+	return matches
+}
+
+// Myers' O(ND) difference algorithm, recording the matching lines
+func myersMatch(a []string, b []string, offsetA int, offsetB int, matches []int) {
+	n, m := len(a), len(b)
+	if n == 0 || m == 0 {
+		return
+	}
+
+	// The furthest x reached on each diagonal k, for each distance d.
+	//  Only diagonals -d-1..d+1 are needed so trace[d][k+d+1] holds
+	//  the values from before step d.
+	trace := [][]int{}
+	v := map[int]int{1: 0}
+	found := false
+
+	for d := 0; d <= n+m && d <= maxDiffDistance && !found; d++ {
+		snapshot := make([]int, 2*d+3)
+		for k := -d - 1; k <= d+1; k++ {
+			snapshot[k+d+1] = v[k]
+		}
+		trace = append(trace, snapshot)
+
+		for k := -d; k <= d; k += 2 {
+			x := 0
+			if k == -d || (k != d && v[k-1] < v[k+1]) {
+				x = v[k+1]
+			} else {
+				x = v[k-1] + 1
+			}
+			y := x - k
+
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+
+			v[k] = x
+
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+	}
+
+	if !found {
+		// Too different to be worth matching up
+		return
+	}
+
+	// Walk backwards through the steps recording the diagonal runs
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		snapshot := trace[d]
+		k := x - y
+
+		prevK := k - 1
+		if k == -d || (k != d && snapshot[k-1+d+1] < snapshot[k+1+d+1]) {
+			prevK = k + 1
+		}
+
+		prevX := snapshot[prevK+d+1]
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			x--
+			y--
+			matches[offsetA+x] = offsetB + y
+		}
+
+		if d > 0 {
+			x, y = prevX, prevY
+		}
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/gob"
+	"io"
 	"os"
 	"path/filepath"
 )
@@ -15,10 +16,14 @@ type metaObject struct {
 	Path         string
 	ItemId       string
 	StateId      string
-	LastModified int64
+	LastModified int64 // Nanoseconds since the epoch
 	Size         int64
+	Inode        uint64
 	Hash         string
 	ComponentId  string
+
+	// The file was left with conflict markers by a merge during load
+	Conflict bool
 }
 
 type metaData struct {
@@ -30,6 +35,32 @@ type metaData struct {
 	projectName   string
 	userId        string
 
+	// Don't keep the pristine copies of the loaded files
+	noPristine bool
+
+	// Paths relative to the sandbox that were loaded, everything if empty
+	sparse []string
+
+	// IDs of the components that were loaded, all of them if empty
+	components []string
+
+	// The directory of the sandbox that each component is loaded into when
+	//  they aren't all loaded into the root of the sandbox
+	componentDirs map[string]string
+
+	// The snapshot that was loaded, if any, and the baseline of each
+	//  component that was loaded from one. Such sandboxes are read-only.
+	snapshot  string
+	baselines map[string]baseline
+
+	// Records the progress of a load so that it can be resumed
+	journal *loadJournal
+
+	// Modification time of the metadata file when it was loaded. Files
+	//  modified at or after this time can't be trusted to be unchanged
+	//  based on their stat information alone.
+	indexTime int64
+
 	inited    bool
 	storeMeta chan metaObject
 	sync      chan int
@@ -40,6 +71,8 @@ func newMetaData() *metaData {
 
 	metadata.pathMap = make(map[string]metaObject)
 	metadata.componentEtag = make(map[string]string)
+	metadata.componentDirs = make(map[string]string)
+	metadata.baselines = make(map[string]baseline)
 
 	metadata.inited = false
 
@@ -58,7 +91,37 @@ func (metadata *metaData) load(path string) error {
 		err = decoder.Decode(&metadata.projectName)
 		err = decoder.Decode(&metadata.userId)
 		err = decoder.Decode(&metadata.pathMap)
-		err = decoder.Decode(&metadata.componentEtag)
+
+		// Sandboxes loaded by older versions don't have the newer fields
+		if err == nil {
+			err = decoder.Decode(&metadata.componentEtag)
+		}
+		if err == nil {
+			err = decoder.Decode(&metadata.noPristine)
+		}
+		if err == nil {
+			err = decoder.Decode(&metadata.sparse)
+		}
+		if err == nil {
+			err = decoder.Decode(&metadata.components)
+		}
+		if err == nil {
+			err = decoder.Decode(&metadata.componentDirs)
+		}
+		if err == nil {
+			err = decoder.Decode(&metadata.snapshot)
+		}
+		if err == nil {
+			err = decoder.Decode(&metadata.baselines)
+		}
+		if err == io.EOF {
+			err = nil
+		}
+
+		stat, statErr := file.Stat()
+		if statErr == nil {
+			metadata.indexTime = stat.ModTime().UnixNano()
+		}
 	}
 
 	return err
@@ -82,6 +145,12 @@ func (metadata *metaData) save(path string) error {
 		err = encoder.Encode(&metadata.userId)
 		err = encoder.Encode(&metadata.pathMap)
 		err = encoder.Encode(&metadata.componentEtag)
+		err = encoder.Encode(&metadata.noPristine)
+		err = encoder.Encode(&metadata.sparse)
+		err = encoder.Encode(&metadata.components)
+		err = encoder.Encode(&metadata.componentDirs)
+		err = encoder.Encode(&metadata.snapshot)
+		err = encoder.Encode(&metadata.baselines)
 	}
 
 	return err
@@ -98,6 +167,9 @@ func (metadata *metaData) initConcurrentWrite() {
 			select {
 			case data := <-metadata.storeMeta:
 				metadata.pathMap[data.Path] = data
+				if metadata.journal != nil {
+					metadata.journal.record(data)
+				}
 			case <-metadata.sync:
 				// Shutdown after synchronizing
 				metadata.inited = false
@@ -157,3 +229,33 @@ func (metadata *metaData) get(path string, sandboxpath string) (metaObject, bool
 
 	return meta, hit
 }
+
+// Record the stat information of the file so that later status checks can
+// skip hashing it when it hasn't been touched.
+func (meta *metaObject) setStat(info os.FileInfo) {
+	meta.LastModified = info.ModTime().UnixNano()
+	meta.Size = info.Size()
+	meta.Inode = fileInode(info)
+}
+
+// Check whether the file is unchanged according to the stat information
+// recorded in the metadata. Like the git index this has to watch out for
+// racy timestamps: a file modified in the same clock tick that the metadata
+// was written could have new contents with the same size and modification
+// time, so it is never trusted and must be hashed instead.
+func (metadata *metaData) statUnchanged(meta metaObject, info os.FileInfo) bool {
+	if meta.LastModified != info.ModTime().UnixNano() || meta.Size != info.Size() {
+		return false
+	}
+
+	inode := fileInode(info)
+	if meta.Inode != 0 && inode != 0 && meta.Inode != inode {
+		return false
+	}
+
+	if meta.LastModified >= metadata.indexTime {
+		return false
+	}
+
+	return true
+}
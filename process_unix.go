@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"syscall"
+)
+
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, syscall.Signal(0))
+
+	// The process exists but belongs to someone else
+	return err == nil || err == syscall.EPERM
+}
@@ -0,0 +1,20 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os"
+)
+
+// Finding a process on Windows opens a handle to it, which fails when the
+// process no longer exists.
+func processAlive(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+
+	process.Release()
+	return true
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	registryFile = "sandboxes.txt"
+
+	// How long a change to the registry waits for another one to finish
+	registryLockWait = 10 * time.Second
+)
+
+// The registry lists the sandboxes of the user, one path per line, so that
+// they can be found and worked with together. Sandboxes are added when they
+// are loaded.
+func registryPath() (string, error) {
+	usr, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(usr.HomeDir, gojazzDataDir, registryFile), nil
+}
+
+// The registered sandboxes, sorted by path
+func registeredSandboxes(registry string) ([]string, error) {
+	file, err := os.Open(registry)
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	seen := make(map[string]bool)
+	sandboxes := []string{}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		p := strings.TrimSpace(scanner.Text())
+		if p == "" || seen[p] {
+			continue
+		}
+
+		seen[p] = true
+		sandboxes = append(sandboxes, p)
+	}
+
+	sort.Strings(sandboxes)
+
+	return sandboxes, scanner.Err()
+}
+
+// Changes to the registry are made under the same kind of lock as the
+// changes to a sandbox, so that a sandbox that is added while others are
+// removed isn't lost when the registry is replaced
+func lockRegistry(registry string) (*sandboxLock, error) {
+	return lockSandbox(filepath.Dir(registry), "update the list of sandboxes", registryLockWait)
+}
+
+// Add the sandbox to the registry unless it is already there
+func registerSandbox(registry string, sandboxPath string) error {
+	abs, err := filepath.Abs(sandboxPath)
+	if err != nil {
+		return err
+	}
+
+	lock, err := lockRegistry(registry)
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+
+	sandboxes, err := registeredSandboxes(registry)
+	if err != nil {
+		return err
+	}
+	for _, p := range sandboxes {
+		if p == abs {
+			return nil
+		}
+	}
+
+	file, err := os.OpenFile(registry, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.WriteString(abs + "\n")
+	return err
+}
+
+// Remove the sandboxes from the registry
+func unregisterSandboxes(registry string, remove []string) error {
+	lock, err := lockRegistry(registry)
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+
+	sandboxes, err := registeredSandboxes(registry)
+	if err != nil {
+		return err
+	}
+
+	removed := make(map[string]bool)
+	for _, p := range remove {
+		removed[p] = true
+	}
+
+	contents := ""
+	for _, p := range sandboxes {
+		if !removed[p] {
+			contents = contents + p + "\n"
+		}
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(registry), "tmp")
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteString(contents)
+	file.Close()
+	if err == nil {
+		err = os.Rename(file.Name(), registry)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+
+	return err
+}
+
+// Record a sandbox that was loaded. Not being able to record it only means
+// that it isn't found by the commands that work on all of the sandboxes.
+func rememberSandbox(sandboxPath string) {
+	registry, err := registryPath()
+	if err == nil {
+		err = registerSandbox(registry, sandboxPath)
+	}
+
+	if err != nil {
+		fmt.Printf("Warning: The sandbox could not be added to the list of your sandboxes: %v\n", err.Error())
+	}
+}
+
+// Run the operation on each of the registered sandboxes. A failure in one
+// of them is reported and the others carry on.
+func forEachSandbox(op func(sandboxPath string)) {
+	registry, err := registryPath()
+	if err != nil {
+		panic(err)
+	}
+
+	sandboxes, err := registeredSandboxes(registry)
+	if err != nil {
+		panic(err)
+	}
+
+	if len(sandboxes) == 0 {
+		panic(simpleWarning("There are no sandboxes in the list. Sandboxes are added to it when they are loaded."))
+	}
+
+	for idx, p := range sandboxes {
+		if idx > 0 {
+			fmt.Printf("\n")
+		}
+
+		func() {
+			defer func() {
+				r := recover()
+				if r != nil {
+					reportError(r)
+				}
+			}()
+
+			op(p)
+		}()
+	}
+}
+
+// A short description of a registered sandbox. Counting the changes checks
+// every file of the sandbox, so it is only done when asked for.
+func describeSandbox(sandboxPath string, changes bool) string {
+	metadata := newMetaData()
+	err := metadata.load(filepath.Join(sandboxPath, metadataFileName))
+	if err != nil {
+		return "Not a sandbox anymore"
+	}
+
+	kind := "Stream"
+	if !metadata.isstream {
+		kind = "Repository Workspace"
+	}
+	if metadata.snapshot != "" {
+		kind = kind + ", snapshot " + metadata.snapshot
+	} else if len(metadata.baselines) > 0 {
+		kind = kind + ", baselines"
+	}
+
+	description := fmt.Sprintf("%v (%v)", metadata.projectName, kind)
+	if !changes {
+		return description
+	}
+
+	status, err := scmStatus(sandboxPath, NO_COPY, false)
+	if err != nil {
+		return description + ", changes unknown: " + err.Error()
+	}
+
+	switch n := len(status.changes()); n {
+	case 0:
+		return description + ", no changes"
+	case 1:
+		return description + ", 1 change"
+	default:
+		return fmt.Sprintf("%v, %v changes", description, n)
+	}
+}
+
+func sandboxesDefaults() {
+	fmt.Printf("gojazz sandboxes [options]\n")
+	flag.PrintDefaults()
+}
+
+func sandboxesOp() {
+	prune := flag.Bool("prune", false, "Remove the sandboxes that no longer exist from the list.")
+	changes := flag.Bool("changes", false, "Show how many changes each sandbox has. This checks all of the files in the sandboxes.")
+	flag.Usage = sandboxesDefaults
+	flag.Parse()
+
+	registry, err := registryPath()
+	if err != nil {
+		panic(err)
+	}
+
+	sandboxes, err := registeredSandboxes(registry)
+	if err != nil {
+		panic(err)
+	}
+
+	if len(sandboxes) == 0 {
+		fmt.Println("There are no sandboxes in the list. Sandboxes are added to it when they are loaded.")
+		return
+	}
+
+	gone := []string{}
+	for _, p := range sandboxes {
+		if _, err := os.Stat(filepath.Join(p, metadataFileName)); err != nil {
+			gone = append(gone, p)
+			if *prune {
+				continue
+			}
+		}
+
+		fmt.Printf("%v: %v\n", p, describeSandbox(p, *changes))
+	}
+
+	if *prune && len(gone) > 0 {
+		err = unregisterSandboxes(registry, gone)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("Removed %v sandboxes that no longer exist from the list\n", len(gone))
+	}
+}
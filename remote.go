@@ -0,0 +1,206 @@
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Changes in the repository workspace or stream that haven't been loaded
+// into the sandbox yet.
+type incoming struct {
+	Added    map[string]bool
+	Modified map[string]bool
+	Deleted  map[string]bool
+
+	// Incoming changes to paths that have also been changed locally and the
+	//  kind of the local change
+	Conflicts map[string]string
+
+	// Components of the added and modified items
+	componentIds map[string]string
+
+	isstream bool
+}
+
+func newIncoming() *incoming {
+	incoming := &incoming{}
+	incoming.Added = make(map[string]bool)
+	incoming.Modified = make(map[string]bool)
+	incoming.Deleted = make(map[string]bool)
+	incoming.Conflicts = make(map[string]string)
+	incoming.componentIds = make(map[string]string)
+
+	return incoming
+}
+
+func (incoming *incoming) unchanged() bool {
+	return len(incoming.Added) == 0 && len(incoming.Modified) == 0 && len(incoming.Deleted) == 0
+}
+
+func (incoming *incoming) changes() []statusChange {
+	changes := []statusChange{}
+
+	for k, _ := range incoming.Added {
+		changes = append(changes, statusChange{Kind: "Added", Path: k})
+	}
+	for k, _ := range incoming.Modified {
+		changes = append(changes, statusChange{Kind: "Modified", Path: k})
+	}
+	for k, _ := range incoming.Deleted {
+		changes = append(changes, statusChange{Kind: "Deleted", Path: k})
+	}
+
+	sort.Sort(byChangePath(changes))
+
+	return changes
+}
+
+func (incoming *incoming) String() string {
+	result := ""
+
+	if incoming.isstream {
+		result = result + "Incoming changes from the stream:\n"
+	} else {
+		result = result + "Incoming changes from the repository workspace:\n"
+	}
+
+	changes := incoming.changes()
+
+	for _, change := range changes {
+		result = result + change.Path + " (Incoming " + change.Kind + ")"
+
+		if local, ok := incoming.Conflicts[change.Path]; ok {
+			result = result + " CONFLICT: " + local + " locally"
+		}
+
+		result = result + "\n"
+	}
+
+	if len(changes) == 0 {
+		result = result + "No incoming changes\n"
+	} else if len(incoming.Conflicts) > 0 {
+		result = result + "Load will back up your local changes and merge the incoming changes into them. Conflicting lines are marked in the files, and files that can't be merged keep your version with the incoming version written next to them with a " + remoteSuffix + " suffix.\n"
+	}
+
+	return result
+}
+
+// Same format as the porcelain status with the letters in lower case to
+// distinguish incoming changes, and a C for conflicts.
+func (incoming *incoming) porcelain() string {
+	result := ""
+
+	for _, change := range incoming.changes() {
+		code := "a"
+		if change.Kind == "Modified" {
+			code = "m"
+		} else if change.Kind == "Deleted" {
+			code = "d"
+		}
+
+		if _, ok := incoming.Conflicts[change.Path]; ok {
+			code = code + "C"
+		}
+
+		result = result + code + " " + filepath.ToSlash(change.Path) + "\n"
+	}
+
+	return result
+}
+
+// Walk the remote repository workspace or stream and compare it with the
+// metadata of the sandbox to find the changes that a load would bring in.
+// Nothing in the sandbox is modified.
+func scmIncoming(client *Client, status *status) (*incoming, error) {
+	return scmCompare(client, status, status.metaData.workspaceId, status.metaData.isstream)
+}
+
+// Compare a repository workspace or stream, which doesn't have to be the one
+// that the sandbox was loaded from, with the metadata of the sandbox.
+func scmCompare(client *Client, status *status, workspaceId string, isstream bool) (*incoming, error) {
+	metadata := status.metaData
+	incoming := newIncoming()
+	incoming.isstream = isstream
+
+	components, err := FindComponents(client, metadata.ccmBaseUrl, workspaceId)
+	if err != nil {
+		return nil, err
+	}
+
+	// The walk function is called concurrently
+	mutex := &sync.Mutex{}
+	remotePaths := make(map[string]bool)
+
+	// Only the components that the sandbox loads
+	for _, component := range selectedComponents(components, metadata.components) {
+		componentId := component.ScmInfo.ItemId
+
+		// A component loaded from a baseline stays at the baseline
+		componentRef := componentId
+		if workspaceId == metadata.workspaceId {
+			componentRef = metadata.componentRef(componentId)
+		}
+
+		err = Walk(client, metadata.ccmBaseUrl, workspaceId, componentRef, func(p string, file File) error {
+			rel := metadata.localPath(componentId, p)
+
+			if inside, descend := status.inScope(rel); !inside {
+				if !descend {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			remotePaths[rel] = true
+
+			meta, ok := metadata.pathMap[rel]
+			if !ok {
+				incoming.Added[rel] = true
+				incoming.componentIds[rel] = file.info.ScmInfo.ComponentId
+			} else if !file.info.Directory && meta.StateId != file.info.ScmInfo.StateId {
+				// Directories get a new state whenever their children
+				//  change, only the files are interesting
+				incoming.Modified[rel] = true
+				incoming.componentIds[rel] = file.info.ScmInfo.ComponentId
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		// The walk doesn't include the component's own folder
+		if dir, ok := metadata.componentDirs[componentId]; ok {
+			remotePaths[dir] = true
+		}
+	}
+
+	for rel, _ := range metadata.pathMap {
+		if inside, _ := status.inScope(rel); !inside {
+			continue
+		}
+
+		if !remotePaths[rel] {
+			incoming.Deleted[rel] = true
+		}
+	}
+
+	// Anything that is changing on both sides is a conflict
+	for _, change := range incoming.changes() {
+		if status.Added[change.Path] {
+			incoming.Conflicts[change.Path] = "Added"
+		} else if status.Modified[change.Path] {
+			incoming.Conflicts[change.Path] = "Modified"
+		} else if status.Deleted[change.Path] && change.Kind != "Deleted" {
+			incoming.Conflicts[change.Path] = "Deleted"
+		}
+	}
+
+	return incoming, nil
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Find a stream of the project, or the user's repository workspace for it,
+// along with a client that can access it. The default stream is used if
+// no stream name is given.
+func findRemoteWorkspace(projectName string, stream string, workspace bool) (*Client, string, string) {
+	// You don't need credentials to read streams of public projects
+	userId := ""
+	password := ""
+	if workspace || isLoggedIn() {
+		var err error
+		userId, password, err = getCredentials()
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	client, err := NewClient(userId, password)
+	if err != nil {
+		panic(err)
+	}
+
+	project, err := client.findProject(projectName)
+	if err != nil {
+		panic(err)
+	}
+	ccmBaseUrl := project.CcmBaseUrl
+
+	streamName := stream
+	if streamName == "" {
+		streamName = projectName + " Stream"
+	}
+	workspaceId, err := FindStream(client, ccmBaseUrl, projectName, streamName)
+	if err != nil {
+		panic(err)
+	}
+	if workspaceId == "" {
+		panic(simpleWarning("Stream with name " + streamName + " not found"))
+	}
+
+	if workspace {
+		workspaceId, err = FindWorkspaceForStream(client, ccmBaseUrl, workspaceId)
+		if err != nil {
+			panic(err)
+		}
+		if workspaceId == "" {
+			panic(simpleWarning("You don't have a repository workspace for " + streamName + ". Load the project with '-workspace=true' to create one."))
+		}
+	}
+
+	return client, ccmBaseUrl, workspaceId
+}
+
+// The options of the commands that look at a single remote file or folder
+type remoteFileOptions struct {
+	stream     *string
+	workspace  *bool
+	snapshot   *string
+	components stringList
+	json       *bool
+}
+
+func remoteFileFlags(jsonOutput bool) *remoteFileOptions {
+	options := &remoteFileOptions{}
+	options.stream = flag.String("stream", "", "Alternate stream to look in")
+	options.workspace = flag.Bool("workspace", false, "Look in your repository workspace for the stream instead (requires authentication).")
+	options.snapshot = flag.String("snapshot", "", "Look at the files as they were in this snapshot.")
+	flag.Var(&options.components, "component", "Only look in the component with this name. Repeat to look in several components.")
+
+	jsonDef := false
+	options.json = &jsonDef
+	if jsonOutput {
+		options.json = flag.Bool("json", false, "Print the result as JSON.")
+	}
+
+	return options
+}
+
+// A file or folder found in one of the components
+type remoteMatch struct {
+	component FileInfo
+	file      *File
+}
+
+// Open the project's file or folder at the path relative to the root of
+// the components, which are all loaded on top of each other. A folder can
+// be in more than one component. The project and path are taken from the
+// command line.
+func (options *remoteFileOptions) open(usage func()) (string, []remoteMatch) {
+	if len(os.Args) < 2 || strings.HasPrefix(os.Args[1], "-") {
+		usage()
+		panic(simpleWarning("Provide a project and try again."))
+	}
+	projectName := os.Args[1]
+	os.Args = os.Args[1:]
+
+	flag.Usage = usage
+	flag.Parse()
+
+	p := "/"
+	if flag.NArg() > 0 {
+		p = path.Clean("/" + strings.Replace(flag.Arg(0), "\\", "/", -1))
+	}
+
+	client, ccmBaseUrl, workspaceId := findRemoteWorkspace(projectName, *options.stream, *options.workspace)
+
+	metadata := newMetaData()
+	var err error
+	metadata.baselines, err = findConfiguration(client, ccmBaseUrl, workspaceId, *options.snapshot, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	if len(options.components) > 0 {
+		metadata.components, err = findComponentsByName(client, ccmBaseUrl, workspaceId, options.components)
+		if err != nil {
+			panic(err)
+		}
+	} else if len(metadata.baselines) > 0 {
+		metadata.components = baselineComponents(metadata.baselines)
+	}
+
+	components, err := FindComponents(client, ccmBaseUrl, workspaceId)
+	if err != nil {
+		panic(err)
+	}
+
+	matches := []remoteMatch{}
+	for _, component := range selectedComponents(components, metadata.components) {
+		file, err := Open(client, ccmBaseUrl, workspaceId, metadata.componentRef(component.ScmInfo.ItemId), p)
+		if err != nil {
+			jazzError, ok := err.(*JazzError)
+			if ok && jazzError.StatusCode == 404 {
+				continue
+			}
+			panic(err)
+		}
+
+		matches = append(matches, remoteMatch{component: component, file: file})
+	}
+
+	if len(matches) == 0 {
+		panic(simpleWarning(fmt.Sprintf("%v was not found in any of the components", strings.TrimPrefix(p, "/"))))
+	}
+
+	return p, matches
+}
+
+// What the remote file commands print about a file or folder
+type remoteItem struct {
+	Path        string
+	Directory   bool
+	Size        int64  `json:",omitempty"`
+	Modified    string `json:",omitempty"`
+	Component   string
+	ComponentId string
+	ItemId      string
+	StateId     string
+}
+
+func newRemoteItem(p string, info FileInfo, component FileInfo) remoteItem {
+	item := remoteItem{Path: strings.TrimPrefix(p, "/"), Directory: info.Directory, Component: component.Name, ComponentId: component.ScmInfo.ItemId, ItemId: info.ScmInfo.ItemId, StateId: info.ScmInfo.StateId}
+	if item.Path == "" {
+		item.Path = "."
+	}
+
+	if !info.Directory {
+		item.Size = info.Length
+	}
+	if info.LocalTimeStamp > 0 {
+		item.Modified = time.Unix(0, info.LocalTimeStamp*int64(time.Millisecond)).Format(time.RFC3339)
+	}
+
+	return item
+}
+
+func printJson(v interface{}) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("%s\n", b)
+}
+
+func lsDefaults() {
+	fmt.Printf("gojazz ls <project name> [options] [path]\n")
+	flag.PrintDefaults()
+}
+
+func lsOp() {
+	options := remoteFileFlags(true)
+	long := flag.Bool("l", false, "Print the size, modification time and component of each entry.")
+	p, matches := options.open(lsDefaults)
+
+	// The contents of a folder from all of the components that have it
+	items := []remoteItem{}
+	seen := make(map[string]bool)
+	for _, match := range matches {
+		if !match.file.info.Directory {
+			items = append(items, newRemoteItem(p, match.file.info, match.component))
+			break
+		}
+
+		for _, child := range match.file.info.Children {
+			if seen[child.Name] {
+				continue
+			}
+			seen[child.Name] = true
+
+			items = append(items, newRemoteItem(path.Join(p, child.Name), child, match.component))
+		}
+	}
+	sort.Sort(remoteItemsByPath(items))
+
+	if *options.json {
+		printJson(items)
+		return
+	}
+
+	for _, item := range items {
+		name := path.Base(item.Path)
+		if item.Directory {
+			name = name + "/"
+		}
+
+		if *long {
+			fmt.Printf("%10v  %-25v  %-20v  %v\n", item.Size, item.Modified, item.Component, name)
+		} else {
+			fmt.Printf("%v\n", name)
+		}
+	}
+}
+
+type remoteItemsByPath []remoteItem
+
+func (items remoteItemsByPath) Len() int           { return len(items) }
+func (items remoteItemsByPath) Swap(i, j int)      { items[i], items[j] = items[j], items[i] }
+func (items remoteItemsByPath) Less(i, j int) bool { return items[i].Path < items[j].Path }
+
+func catDefaults() {
+	fmt.Printf("gojazz cat <project name> [options] <path>\n")
+	flag.PrintDefaults()
+}
+
+func catOp() {
+	options := remoteFileFlags(false)
+	p, matches := options.open(catDefaults)
+
+	// The first component that has the file, like a load would
+	for _, match := range matches {
+		if match.file.info.Directory {
+			continue
+		}
+
+		_, err := io.Copy(os.Stdout, match.file)
+		match.file.Close()
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	panic(simpleWarning(fmt.Sprintf("%v is a folder, use ls to list it", strings.TrimPrefix(p, "/"))))
+}
+
+func statDefaults() {
+	fmt.Printf("gojazz stat <project name> [options] <path>\n")
+	flag.PrintDefaults()
+}
+
+func statOp() {
+	options := remoteFileFlags(true)
+	p, matches := options.open(statDefaults)
+
+	// A folder is reported for each component that has it
+	items := []remoteItem{}
+	for _, match := range matches {
+		items = append(items, newRemoteItem(p, match.file.info, match.component))
+	}
+
+	if *options.json {
+		if len(items) == 1 {
+			printJson(items[0])
+		} else {
+			printJson(items)
+		}
+		return
+	}
+
+	for idx, item := range items {
+		if idx > 0 {
+			fmt.Printf("\n")
+		}
+		fmt.Printf("%v", item)
+	}
+}
+
+func (item remoteItem) String() string {
+	kind := "File"
+	if item.Directory {
+		kind = "Folder"
+	}
+
+	result := "Path: " + item.Path + "\n"
+	result = result + "Type: " + kind + "\n"
+	if !item.Directory {
+		result = result + fmt.Sprintf("Size: %v\n", item.Size)
+	}
+	if item.Modified != "" {
+		result = result + "Modified: " + item.Modified + "\n"
+	}
+	result = result + "Component: " + item.Component + " (" + item.ComponentId + ")\n"
+	result = result + "Item ID: " + item.ItemId + "\n"
+	result = result + "State ID: " + item.StateId + "\n"
+
+	return result
+}
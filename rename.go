@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Pair up deleted files with added files that have the same contents and
+// record them as renames (or moves if the parent directory changed). The
+// paths stay in the Added and Deleted maps so that operations that don't care
+// about renames (e.g. load) continue to see the whole picture.
+//
+// Matching is by content hash only. Renames of files that were also edited
+// would need the previous contents of the file, which the sandbox doesn't
+// keep, so they show up as a delete and an add.
+func (status *status) detectRenames() error {
+	if len(status.Deleted) == 0 || len(status.Added) == 0 {
+		return nil
+	}
+
+	// Index the deleted files by hash, in sorted order so that the pairing
+	//  doesn't depend on map iteration order
+	deletedPaths := sortedKeys(status.Deleted)
+	deletedByHash := make(map[string][]string)
+	deletedSizes := make(map[int64]bool)
+
+	for _, deleted := range deletedPaths {
+		meta, ok := status.metaData.pathMap[deleted]
+		if !ok || meta.Hash == "" {
+			// Directories don't have a hash
+			continue
+		}
+
+		deletedByHash[meta.Hash] = append(deletedByHash[meta.Hash], deleted)
+		deletedSizes[meta.Size] = true
+	}
+
+	if len(deletedByHash) == 0 {
+		return nil
+	}
+
+	for _, added := range sortedKeys(status.Added) {
+		fullpath := filepath.Join(status.sandboxPath, added)
+		info, err := os.Stat(fullpath)
+		if err != nil {
+			return err
+		}
+
+		// Only files with the size of a deleted file are worth hashing
+		if info.IsDir() || !deletedSizes[info.Size()] {
+			continue
+		}
+
+		hash, err := hashFile(fullpath)
+		if err != nil {
+			return err
+		}
+
+		candidates := deletedByHash[hash]
+		if len(candidates) == 0 {
+			continue
+		}
+
+		status.Renamed[candidates[0]] = added
+		deletedByHash[hash] = candidates[1:]
+	}
+
+	status.collapseDirectoryRenames()
+
+	return nil
+}
+
+// When every item in a deleted directory was renamed into the same place in an
+// added directory then the directory itself was renamed. Record that instead
+// of the individual files so that check-in moves the directory as a whole.
+func (status *status) collapseDirectoryRenames() {
+	if len(status.Renamed) == 0 {
+		return
+	}
+
+	// Outermost directories first
+	deletedDirs := []string{}
+	for _, deleted := range sortedKeys(status.Deleted) {
+		meta, ok := status.metaData.pathMap[deleted]
+		if ok && meta.Hash == "" {
+			deletedDirs = append(deletedDirs, deleted)
+		}
+	}
+	sort.Sort(byDepth(deletedDirs))
+
+	for _, dir := range deletedDirs {
+		if _, ok := status.Renamed[dir]; ok {
+			continue
+		}
+
+		prefix := dir + string(filepath.Separator)
+		newDir := ""
+		files := 0
+		matches := true
+
+		for p, meta := range status.metaData.pathMap {
+			if !strings.HasPrefix(p, prefix) {
+				continue
+			}
+
+			suffix := p[len(prefix):]
+
+			if meta.Hash == "" {
+				// Sub-directories are matched once we know where the directory went
+				continue
+			}
+
+			files++
+			renamed, ok := status.Renamed[p]
+			if !ok || !strings.HasSuffix(renamed, string(filepath.Separator)+suffix) {
+				matches = false
+				break
+			}
+
+			candidate := renamed[:len(renamed)-len(suffix)-1]
+			if newDir == "" {
+				newDir = candidate
+			} else if newDir != candidate {
+				matches = false
+				break
+			}
+		}
+
+		if !matches || files == 0 || !status.Added[newDir] {
+			continue
+		}
+
+		// The sub-directories must have come along too
+		for p, meta := range status.metaData.pathMap {
+			if strings.HasPrefix(p, prefix) && meta.Hash == "" && !status.Added[filepath.Join(newDir, p[len(prefix):])] {
+				matches = false
+				break
+			}
+		}
+
+		if !matches {
+			continue
+		}
+
+		for p, _ := range status.Renamed {
+			if strings.HasPrefix(p, prefix) {
+				delete(status.Renamed, p)
+			}
+		}
+		status.Renamed[dir] = newDir
+	}
+}
+
+// Find the path that the item at the new path was renamed from, if any
+func (status *status) renamedFrom(newPath string) (string, bool) {
+	for oldPath, renamed := range status.Renamed {
+		if renamed == newPath {
+			return oldPath, true
+		}
+	}
+
+	return "", false
+}
+
+// Check whether an added or deleted path is accounted for by a rename, either
+// directly or because it moved along with a renamed directory.
+func (status *status) coveredByRename(p string) bool {
+	for oldPath, newPath := range status.Renamed {
+		if p == oldPath || p == newPath {
+			return true
+		}
+
+		oldPrefix := oldPath + string(filepath.Separator)
+		newPrefix := newPath + string(filepath.Separator)
+
+		if strings.HasPrefix(p, oldPrefix) && status.Added[newPrefix+p[len(oldPrefix):]] {
+			return true
+		}
+
+		if strings.HasPrefix(p, newPrefix) && status.Deleted[oldPrefix+p[len(newPrefix):]] {
+			return true
+		}
+	}
+
+	return false
+}
+
+func renameKind(oldPath string, newPath string) string {
+	if filepath.Dir(oldPath) == filepath.Dir(newPath) {
+		return "Renamed"
+	}
+
+	return "Moved"
+}
+
+func hashFile(p string) (string, error) {
+	file, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha1.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(hash.Sum(nil)), nil
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k, _ := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+type byDepth []string
+
+func (paths byDepth) Len() int {
+	return len(paths)
+}
+
+func (paths byDepth) Less(i, j int) bool {
+	depthI := strings.Count(paths[i], string(filepath.Separator))
+	depthJ := strings.Count(paths[j], string(filepath.Separator))
+
+	if depthI != depthJ {
+		return depthI < depthJ
+	}
+
+	return paths[i] < paths[j]
+}
+
+func (paths byDepth) Swap(i, j int) {
+	paths[i], paths[j] = paths[j], paths[i]
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// Reverting more changes than this asks for confirmation first
+	bulkRevertThreshold = 10
+)
+
+func revertDefaults() {
+	fmt.Printf("gojazz revert [options] [paths...]\n")
+	flag.PrintDefaults()
+}
+
+func revertOp() {
+	operation := commandLine()
+	sandboxPath := flag.String("sandbox", "", "Location of the sandbox")
+	dryRun := flag.Bool("dry-run", false, "Only show what would be reverted.")
+	force := flag.Bool("force", false, "Don't ask for confirmation before reverting many files or the whole sandbox.")
+	wait := flag.Duration("wait", 0, "How long to wait for another operation on the sandbox to finish instead of failing right away.")
+	flag.Usage = revertDefaults
+	flag.Parse()
+
+	if *sandboxPath == "" {
+		path, err := os.Getwd()
+		if err != nil {
+			panic(err)
+		}
+
+		path = findSandbox(path)
+		sandboxPath = &path
+	}
+
+	lock, err := lockSandbox(*sandboxPath, operation, *wait)
+	if err != nil {
+		panic(err)
+	}
+	defer lock.unlock()
+
+	filter, err := sandboxRelativePaths(*sandboxPath, flag.Args())
+	if err != nil {
+		panic(err)
+	}
+
+	// Back up the changes before they are thrown away
+	var status *status
+	if *dryRun {
+		status, err = scmStatusPaths(*sandboxPath, NO_COPY, false, filter)
+	} else {
+		status, err = scmBackup(*sandboxPath, operation, filter)
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	if status.unchanged() {
+		fmt.Println("Nothing to revert.")
+		return
+	}
+
+	if *dryRun {
+		for _, change := range revertChanges(status) {
+			fmt.Printf("%v (Would revert %v)\n", change.Path, change.Kind)
+		}
+		return
+	}
+
+	numChanges := len(status.Added) + len(status.Modified) + len(status.Deleted)
+	if !*force && (len(filter) == 0 || numChanges > bulkRevertThreshold) {
+		fmt.Printf("%v", status)
+		fmt.Printf("All %v of these changes will be reverted.\n", numChanges)
+		fmt.Print("Do you want to proceed? [y/N]:")
+		reader := bufio.NewReader(os.Stdin)
+		answer, _ := reader.ReadString('\n')
+		answer = strings.TrimSpace(answer)
+
+		if strings.ToLower(answer) != "y" {
+			panic(simpleWarning("Operation Canceled"))
+		}
+	}
+
+	scmRevert(status)
+
+	fmt.Printf("Your changes have been backed up to this location: %v\n", status.copyPath)
+
+	_, err = pruneBackups(*sandboxPath, defaultBackupRetention)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// The changes to revert in the order they are reverted. Parent directories
+// come before their children and added items come last.
+func revertChanges(status *status) []statusChange {
+	changes := []statusChange{}
+
+	restore := append(sortedKeys(status.Modified), sortedKeys(status.Deleted)...)
+	sort.Strings(restore)
+	for _, rel := range restore {
+		kind := "Modified"
+		if status.Deleted[rel] {
+			kind = "Deleted"
+		}
+		changes = append(changes, statusChange{Kind: kind, Path: rel})
+	}
+
+	for _, rel := range sortedKeys(status.Added) {
+		changes = append(changes, statusChange{Kind: "Added", Path: rel})
+	}
+
+	return changes
+}
+
+// Revert the changes in the status. Modified and deleted files are restored
+// from their pristine copies, or fetched from the repository workspace or
+// stream when there isn't one, and added files are removed. The paths that
+// were reverted are returned.
+func scmRevert(status *status) []string {
+	var client *Client
+	reverted := []string{}
+
+	for _, change := range revertChanges(status) {
+		rel := change.Path
+		fullpath := filepath.Join(status.sandboxPath, rel)
+
+		if change.Kind == "Added" {
+			err := os.RemoveAll(fullpath)
+			if err != nil {
+				panic(err)
+			}
+
+			fmt.Printf("%v (Removed)\n", rel)
+			reverted = append(reverted, rel)
+			continue
+		}
+
+		meta, ok := status.metaData.pathMap[rel]
+		if !ok {
+			continue
+		}
+
+		if meta.Hash == "" {
+			err := os.MkdirAll(fullpath, 0700)
+			if err != nil {
+				panic(err)
+			}
+
+			fmt.Printf("%v (Reverted)\n", rel)
+			reverted = append(reverted, rel)
+			continue
+		}
+
+		contents, err := readBase(status.sandboxPath, meta.Hash)
+		if err != nil {
+			// No pristine copy, get the file from the server instead
+			if client == nil {
+				client = newClientForSandbox(status.metaData)
+			}
+
+			contents, err = fetchRevert(client, status, rel, &meta)
+			if err != nil {
+				fmt.Printf("%v (Could not be reverted: %v)\n", rel, err.Error())
+				continue
+			}
+		}
+
+		err = os.MkdirAll(filepath.Dir(fullpath), 0700)
+		if err != nil {
+			panic(err)
+		}
+
+		// Replaced like a download so an interrupted revert can't leave a
+		//  truncated file behind
+		err = writeDownload(fullpath, bytes.NewReader(contents))
+		if err != nil {
+			panic(err)
+		}
+
+		info, err := os.Stat(fullpath)
+		if err != nil {
+			panic(err)
+		}
+
+		meta.setStat(info)
+		meta.Conflict = false
+		status.metaData.pathMap[rel] = meta
+
+		fmt.Printf("%v (Reverted)\n", rel)
+		reverted = append(reverted, rel)
+	}
+
+	err := status.metaData.save(filepath.Join(status.sandboxPath, metadataFileName))
+	if err != nil {
+		panic(err)
+	}
+
+	return reverted
+}
+
+// Fetch the current version of a file from the repository workspace or
+// stream and rewrite its metadata to match.
+func fetchRevert(client *Client, status *status, rel string, meta *metaObject) ([]byte, error) {
+	metadata := status.metaData
+
+	remoteFile, err := Open(client, metadata.ccmBaseUrl, metadata.workspaceId, metadata.componentRef(meta.ComponentId), metadata.remotePath(meta.ComponentId, rel))
+	if err != nil {
+		jazzError, ok := err.(*JazzError)
+		if ok && jazzError.StatusCode == 404 {
+			return nil, simpleWarning("it no longer exists remotely")
+		}
+		return nil, err
+	}
+	defer remoteFile.Close()
+
+	if remoteFile.info.Directory {
+		return nil, simpleWarning("there is a folder at this location on the remote")
+	}
+
+	contents, err := ioutil.ReadAll(remoteFile)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha1.Sum(contents)
+
+	scmInfo := remoteFile.info.ScmInfo
+	meta.ItemId = scmInfo.ItemId
+	meta.StateId = scmInfo.StateId
+	meta.ComponentId = scmInfo.ComponentId
+	meta.Hash = base64.StdEncoding.EncodeToString(hash[:])
+
+	if !metadata.noPristine {
+		err = storeBase(status.sandboxPath, meta.Hash, bytes.NewReader(contents))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return contents, nil
+}
@@ -15,9 +15,17 @@ import (
 	"sync"
 )
 
-const (
-	numWalkGoroutines = 10
-)
+// A flag that can be repeated to provide several values
+type stringList []string
+
+func (list *stringList) String() string {
+	return strings.Join(*list, ", ")
+}
+
+func (list *stringList) Set(value string) error {
+	*list = append(*list, value)
+	return nil
+}
 
 func findSandbox(startingPath string) (p string) {
 	_, err := os.Stat(startingPath)
@@ -34,6 +42,12 @@ func findSandbox(startingPath string) (p string) {
 			return p
 		}
 
+		// A sandbox that hasn't finished loading yet
+		_, err = os.Stat(filepath.Join(p, journalFileName))
+		if err == nil {
+			return p
+		}
+
 		p = filepath.Dir(p)
 	}
 
@@ -136,7 +150,9 @@ type soapvalue struct {
 	Items  []soapitem `json:"items"`
 }
 type soapitem struct {
-	Workspace soapworkspace `json:"workspace"`
+	Workspace   soapworkspace   `json:"workspace"`
+	BaselineSet soapbaselineset `json:"baselineSet"`
+	Baseline    soapbaseline    `json:"baseline"`
 }
 type soapworkspace struct {
 	Name   string              `json:"name"`
@@ -342,6 +358,10 @@ type FileInfo struct {
 	Directory bool
 	Children  []FileInfo
 	ScmInfo   ScmInfo `json:"RTCSCM"`
+
+	// Size in bytes and modification time in milliseconds since the epoch
+	Length         int64
+	LocalTimeStamp int64
 }
 
 type ScmInfo struct {
@@ -586,6 +606,54 @@ func MkdirAll(client *Client, ccmBaseUrl string, workspaceId string, componentId
 	return childFile, nil
 }
 
+func Move(client *Client, ccmBaseUrl string, workspaceId string, componentId string, p string, newPath string) (*File, error) {
+	f := &File{}
+	f.client = client
+	f.url = assembleOFSUrl(ccmBaseUrl, workspaceId, componentId, newPath)
+
+	moveUrl := assembleOFSUrl(ccmBaseUrl, workspaceId, componentId, p) + "?op=move&destination=" + url.QueryEscape(newPath)
+
+	request, err := http.NewRequest("POST", moveUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Workaround for weird IBM DOS bug with the OrionFilesystem
+	if strings.HasSuffix(moveUrl, ".jspderp") {
+		request.Header.Add("X-HasUriSuffix", "true")
+	}
+
+	resp, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		body := string(b)
+		// The service returns 500 instead of 404
+		if resp.StatusCode == 500 && strings.Contains(body, "Failed to resolve path:") {
+			return nil, &JazzError{Msg: fmt.Sprintf("Not Found: %v", p), StatusCode: 404}
+		}
+		return nil, errorFromResponse(resp)
+	}
+	info := &FileInfo{}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, info)
+	if err != nil {
+		return nil, err
+	}
+
+	f.info = *info
+
+	return f, nil
+}
+
 func Remove(client *Client, ccmBaseUrl string, workspaceId string, componentId string, p string) error {
 	f := &File{}
 	f.client = client
@@ -709,6 +777,8 @@ func (f *File) Close() error {
 	return nil
 }
 
+// Called for each file and directory in the component. Returning
+// filepath.SkipDir for a directory skips its children.
 type WalkFunc func(path string, file File) error
 
 type walkData struct {
@@ -843,6 +913,10 @@ func internalWalk(data walkData) error {
 	}
 
 	err = data.wf(data.path, *f)
+	if err == filepath.SkipDir {
+		// Don't walk the children of this directory
+		return nil
+	}
 	if err != nil {
 		return err
 	}
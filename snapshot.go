@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
+// A component is loaded as it was in this baseline instead of its current
+// state in the workspace or stream
+type baseline struct {
+	ItemId string
+	Name   string
+
+	// The name of the component, for showing what was loaded
+	Component string
+}
+
+type soapbaselineset struct {
+	Name      string         `json:"name"`
+	ItemId    string         `json:"itemId"`
+	Baselines []soapbaseline `json:"baselines"`
+}
+type soapbaseline struct {
+	Name      string        `json:"name"`
+	ItemId    string        `json:"itemId"`
+	Component soapcomponent `json:"component"`
+}
+type soapcomponent struct {
+	ItemId string `json:"itemId"`
+}
+
+// Query the items of the SCM REST service, expecting the same envelope as
+// the workspaces request that FindWorkspaceForStream makes.
+//
+// NOTE: The baselineSets and baselines requests and the shape of their
+// responses are assumed by analogy with the workspaces request. They haven't
+// been checked against a server, there is no published documentation of
+// this internal service to cite.
+func scmRestItems(client *Client, ccmBaseUrl string, service string) ([]soapitem, error) {
+	url := path.Join(ccmBaseUrl, "/service/com.ibm.team.scm.common.internal.rest.IScmRestService/"+service)
+	url = strings.Replace(url, ":/", "://", 1)
+
+	request, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Add("Accept", "text/json")
+
+	resp, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, errorFromResponse(resp)
+	}
+
+	result := &soapenv{}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, result)
+	if err != nil {
+		return nil, err
+	}
+
+	return result.Body.Response.ReturnValue.Value.Items, nil
+}
+
+// Find the baselines of a snapshot of the workspace or stream by the name or
+// ID of the snapshot. Nothing is returned if there is no such snapshot.
+func FindSnapshot(client *Client, ccmBaseUrl string, workspaceId string, snapshotName string) ([]soapbaseline, error) {
+	items, err := scmRestItems(client, ccmBaseUrl, "baselineSets?workspaceItemId="+url.QueryEscape(workspaceId))
+	if err != nil {
+		return nil, err
+	}
+
+	// Return the first snapshot that matches the name
+	for _, item := range items {
+		if item.BaselineSet.Name == snapshotName || item.BaselineSet.ItemId == snapshotName {
+			return item.BaselineSet.Baselines, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// Find the ID of a baseline of the component by its name or ID, empty if
+// there is no such baseline
+func FindBaseline(client *Client, ccmBaseUrl string, componentId string, baselineName string) (string, error) {
+	items, err := scmRestItems(client, ccmBaseUrl, "baselines?componentItemId="+url.QueryEscape(componentId))
+	if err != nil {
+		return "", err
+	}
+
+	// Return the first baseline that matches the name
+	for _, item := range items {
+		if item.Baseline.Name == baselineName || item.Baseline.ItemId == baselineName {
+			return item.Baseline.ItemId, nil
+		}
+	}
+
+	return "", nil
+}
+
+// Resolve the snapshot and the baselines, given as <component>=<baseline>,
+// into the baseline to load for each component by component ID. The
+// baselines replace those of the snapshot for their components.
+func findConfiguration(client *Client, ccmBaseUrl string, workspaceId string, snapshotName string, baselineSpecs []string) (map[string]baseline, error) {
+	baselines := make(map[string]baseline)
+	if snapshotName == "" && len(baselineSpecs) == 0 {
+		return baselines, nil
+	}
+
+	components, err := FindComponents(client, ccmBaseUrl, workspaceId)
+	if err != nil {
+		return nil, err
+	}
+
+	if snapshotName != "" {
+		snapshotBaselines, err := FindSnapshot(client, ccmBaseUrl, workspaceId, snapshotName)
+		if err != nil {
+			return nil, err
+		}
+		if snapshotBaselines == nil {
+			return nil, simpleWarning(fmt.Sprintf("Snapshot %v was not found.", snapshotName))
+		}
+
+		for _, b := range snapshotBaselines {
+			componentName := ""
+			for _, component := range components {
+				if component.ScmInfo.ItemId == b.Component.ItemId {
+					componentName = component.Name
+				}
+			}
+
+			if componentName == "" {
+				fmt.Printf("Warning: Baseline %v of snapshot %v is for a component that is no longer in the workspace or stream, it will not be loaded\n", b.Name, snapshotName)
+				continue
+			}
+
+			baselines[b.Component.ItemId] = baseline{ItemId: b.ItemId, Name: b.Name, Component: componentName}
+		}
+	}
+
+	for _, spec := range baselineSpecs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, simpleWarning(fmt.Sprintf("Baseline %v should be given as <component>=<baseline>.", spec))
+		}
+
+		var component *FileInfo
+		for idx, c := range components {
+			if c.Name == parts[0] || c.ScmInfo.ItemId == parts[0] {
+				component = &components[idx]
+				break
+			}
+		}
+		if component == nil {
+			return nil, simpleWarning(fmt.Sprintf("Component %v was not found. The available components are %v.", parts[0], componentNames(components)))
+		}
+
+		baselineId, err := FindBaseline(client, ccmBaseUrl, component.ScmInfo.ItemId, parts[1])
+		if err != nil {
+			return nil, err
+		}
+		if baselineId == "" {
+			return nil, simpleWarning(fmt.Sprintf("Baseline %v of component %v was not found.", parts[1], component.Name))
+		}
+
+		baselines[component.ScmInfo.ItemId] = baseline{ItemId: baselineId, Name: parts[1], Component: component.Name}
+	}
+
+	return baselines, nil
+}
+
+// The IDs of the components that have a baseline, in a stable order
+func baselineComponents(baselines map[string]baseline) []string {
+	ids := []string{}
+	for id, _ := range baselines {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids
+}
+
+// The component as it is addressed in the filesystem service, which is
+// expected to serve the contents of its baseline instead if it has one.
+//
+// NOTE: The <component>@<baseline> form is assumed, it hasn't been checked
+// against a server either.
+func (metadata *metaData) componentRef(componentId string) string {
+	if b, ok := metadata.baselines[componentId]; ok {
+		return componentId + "@" + b.ItemId
+	}
+
+	return componentId
+}
+
+// Sandboxes loaded from a snapshot or baselines show a fixed configuration,
+// changes to them can't be checked in
+func (metadata *metaData) readOnly() bool {
+	return metadata.snapshot != "" || len(metadata.baselines) > 0
+}
+
+// What was loaded into a read-only sandbox
+func (metadata *metaData) configurationString() string {
+	names := []string{}
+	for _, id := range baselineComponents(metadata.baselines) {
+		b := metadata.baselines[id]
+		names = append(names, b.Component+"="+b.Name)
+	}
+
+	result := ""
+	if metadata.snapshot != "" {
+		result = result + "Snapshot: " + metadata.snapshot + "\n"
+	}
+	if len(names) > 0 {
+		result = result + "Baselines: " + strings.Join(names, ", ") + "\n"
+	}
+
+	return result
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	stashFolder       = ".jazzstash"
+	stashManifestFile = "manifest.json"
+	stashFilesFolder  = "files"
+
+	// Stashed files that can't be merged are applied next to the
+	//  sandbox file with this suffix
+	stashSuffix = ".stash"
+)
+
+// A change that was stashed. Modified and deleted files record the hash of
+// the version they were changed from so that applying the stash can tell
+// whether the file changed in the meantime.
+type stashEntry struct {
+	Kind     string
+	Path     string
+	BaseHash string
+}
+
+// Work in progress that was set aside without checking it in. The contents
+// of the added and modified files are kept alongside the manifest.
+type stashManifest struct {
+	Name    string
+	Time    time.Time
+	Message string
+	Entries []stashEntry
+}
+
+func stashDefaults() {
+	fmt.Printf("gojazz stash [save] [options] [paths...]\n")
+	fmt.Printf("gojazz stash list [options]\n")
+	fmt.Printf("gojazz stash apply [<name>] [options]\n")
+	fmt.Printf("gojazz stash drop <name> [options]\n")
+	flag.PrintDefaults()
+}
+
+func stashOp() {
+	operation := commandLine()
+	action := "save"
+	name := ""
+
+	// Sub-action and stash name provided
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		switch os.Args[1] {
+		case "save", "list", "apply", "drop":
+			action = os.Args[1]
+			os.Args = os.Args[1:]
+
+			if action != "save" && len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+				name = os.Args[1]
+				os.Args = os.Args[1:]
+			}
+		}
+	}
+
+	sandboxPath := flag.String("sandbox", "", "Location of the sandbox")
+	stashName := flag.String("name", "", "Name of the new stash, a timestamp by default.")
+	message := flag.String("m", "", "Description of the stashed changes.")
+	wait := flag.Duration("wait", 0, "How long to wait for another operation on the sandbox to finish instead of failing right away.")
+	flag.Usage = stashDefaults
+	flag.Parse()
+
+	for _, n := range []string{name, *stashName} {
+		err := checkStashName(n)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if *sandboxPath == "" {
+		path, err := os.Getwd()
+		if err != nil {
+			panic(err)
+		}
+
+		path = findSandbox(path)
+		sandboxPath = &path
+	}
+
+	if action != "list" {
+		lock, err := lockSandbox(*sandboxPath, operation, *wait)
+		if err != nil {
+			panic(err)
+		}
+		defer lock.unlock()
+	}
+
+	switch action {
+	case "save":
+		filter, err := sandboxRelativePaths(*sandboxPath, flag.Args())
+		if err != nil {
+			panic(err)
+		}
+
+		status, err := scmStatusPaths(*sandboxPath, NO_COPY, false, filter)
+		if err != nil {
+			panic(err)
+		}
+
+		if status.unchanged() {
+			fmt.Println("No changes to stash.")
+			return
+		}
+
+		manifest := scmStash(status, *stashName, *message)
+		fmt.Printf("Changes stashed as '%v'. Use 'gojazz stash apply %v' to bring them back.\n", manifest.Name, manifest.Name)
+	case "list":
+		stashes, err := listStashes(*sandboxPath)
+		if err != nil {
+			panic(err)
+		}
+
+		if len(stashes) == 0 {
+			fmt.Println("No stashes")
+		}
+		for _, stash := range stashes {
+			fmt.Printf("%v  %v  %v  %v\n", stash.Name, stash.Time.Format("2006-01-02 15:04:05"), plural(len(stash.Entries), "change"), stash.Message)
+		}
+	case "apply":
+		manifest, err := findStash(*sandboxPath, name)
+		if err != nil {
+			panic(err)
+		}
+
+		status, err := scmStatus(*sandboxPath, NO_COPY, false)
+		if err != nil {
+			panic(err)
+		}
+
+		conflicts := scmStashApply(status, manifest)
+		if !conflicts.empty() {
+			fmt.Printf("These stashed changes conflict with changes made since they were stashed:\n%v", conflicts)
+		}
+		fmt.Printf("The stash is kept, use 'gojazz stash drop %v' to remove it.\n", manifest.Name)
+	case "drop":
+		if name == "" {
+			fmt.Println("Provide the name of the stash to drop and try again.")
+			stashDefaults()
+			return
+		}
+
+		_, err := findStash(*sandboxPath, name)
+		if err != nil {
+			panic(err)
+		}
+
+		err = os.RemoveAll(filepath.Join(*sandboxPath, stashFolder, name))
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("%v (Dropped)\n", name)
+	}
+}
+
+// Stashes are kept in a folder named after them so the name can't lead
+// anywhere else
+func checkStashName(name string) error {
+	if strings.ContainsAny(name, "/\\") || strings.Contains(name, "..") {
+		return simpleWarning("The stash name " + name + " can't contain a path separator or '..'")
+	}
+
+	return nil
+}
+
+// Copy the changes in the status into a new stash and then revert them so
+// that the sandbox is back to the state it was loaded in.
+func scmStash(status *status, name string, message string) stashManifest {
+	if name == "" {
+		name = time.Now().Format(backupIdFormat)
+	}
+
+	err := checkStashName(name)
+	if err != nil {
+		panic(err)
+	}
+
+	stashPath := filepath.Join(status.sandboxPath, stashFolder, name)
+	_, err = os.Stat(stashPath)
+	if err == nil {
+		panic(simpleWarning("There is already a stash named " + name))
+	}
+
+	manifest := stashManifest{Name: name, Time: time.Now(), Message: message}
+
+	for _, change := range revertChanges(status) {
+		entry := stashEntry{Kind: change.Kind, Path: change.Path}
+
+		if meta, ok := status.metaData.pathMap[change.Path]; ok {
+			entry.BaseHash = meta.Hash
+		}
+
+		if change.Kind != "Deleted" {
+			source := filepath.Join(status.sandboxPath, change.Path)
+			target := filepath.Join(stashPath, stashFilesFolder, change.Path)
+
+			info, err := os.Stat(source)
+			if err != nil {
+				panic(err)
+			}
+
+			if info.IsDir() {
+				err = os.MkdirAll(target, 0700)
+			} else {
+				err = copyFile(source, target)
+			}
+			if err != nil {
+				panic(err)
+			}
+		}
+
+		manifest.Entries = append(manifest.Entries, entry)
+	}
+
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+
+	err = os.MkdirAll(stashPath, 0700)
+	if err != nil {
+		panic(err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(stashPath, stashManifestFile), b, 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	scmRevert(status)
+
+	return manifest
+}
+
+// Reapply the changes in a stash to the sandbox. Files that changed since
+// they were stashed are merged with the stashed changes, using the version
+// that they were stashed from as the base.
+func scmStashApply(status *status, manifest stashManifest) *conflicts {
+	conflicts := newConflicts()
+	stashPath := filepath.Join(status.sandboxPath, stashFolder, manifest.Name)
+
+	// Deleted items are removed afterwards, deepest first so that
+	//  directories are empty
+	deleted := []stashEntry{}
+
+	for _, entry := range manifest.Entries {
+		fullpath := filepath.Join(status.sandboxPath, entry.Path)
+		stashedPath := filepath.Join(stashPath, stashFilesFolder, entry.Path)
+
+		if entry.Kind == "Deleted" {
+			deleted = append(deleted, entry)
+			continue
+		}
+
+		info, err := os.Stat(stashedPath)
+		if err != nil {
+			panic(err)
+		}
+
+		if info.IsDir() {
+			err = os.MkdirAll(fullpath, 0700)
+			if err != nil {
+				panic(err)
+			}
+			continue
+		}
+
+		stashed, err := ioutil.ReadFile(stashedPath)
+		if err != nil {
+			panic(err)
+		}
+
+		current, err := ioutil.ReadFile(fullpath)
+		if os.IsNotExist(err) {
+			// Nothing here anymore, the stashed version is used as it is
+			err = os.MkdirAll(filepath.Dir(fullpath), 0700)
+			if err == nil {
+				err = writeDownload(fullpath, bytes.NewReader(stashed))
+			}
+			if err != nil {
+				panic(err)
+			}
+
+			fmt.Printf("%v (Applied)\n", entry.Path)
+			continue
+		}
+		if err != nil {
+			panic(err)
+		}
+
+		// Unchanged since it was stashed, there's nothing to merge. This
+		//  doesn't need the pristine copy, which may not be there.
+		if entry.BaseHash != "" {
+			hash, err := hashFile(fullpath)
+			if err != nil {
+				panic(err)
+			}
+
+			if hash == entry.BaseHash {
+				err = writeDownload(fullpath, bytes.NewReader(stashed))
+				if err != nil {
+					panic(err)
+				}
+
+				fmt.Printf("%v (Applied)\n", entry.Path)
+				continue
+			}
+		}
+
+		// Added files are merged as if they started out empty
+		base := []byte{}
+		mergeable := true
+		if entry.BaseHash != "" {
+			base, err = readBase(status.sandboxPath, entry.BaseHash)
+			mergeable = err == nil
+		}
+
+		merged, conflict, ok := []byte(nil), false, false
+		if mergeable {
+			merged, conflict, ok = mergeFileLabels(base, current, stashed, "local", "stash")
+		}
+
+		if !ok {
+			// Keep both versions, the sandbox one stays where it is
+			err = ioutil.WriteFile(fullpath+stashSuffix, stashed, 0600)
+			if err != nil {
+				panic(err)
+			}
+
+			if meta, ok := status.metaData.pathMap[entry.Path]; ok {
+				meta.Conflict = true
+				status.metaData.pathMap[entry.Path] = meta
+			}
+
+			conflicts.add(entry.Path, "both versions kept, the stashed version is in "+filepath.Base(fullpath)+stashSuffix)
+			continue
+		}
+
+		err = writeDownload(fullpath, bytes.NewReader(merged))
+		if err != nil {
+			panic(err)
+		}
+
+		if conflict {
+			if meta, ok := status.metaData.pathMap[entry.Path]; ok {
+				meta.Conflict = true
+				status.metaData.pathMap[entry.Path] = meta
+			}
+			conflicts.add(entry.Path, "conflict markers were written to the file")
+			continue
+		}
+
+		fmt.Printf("%v (Applied)\n", entry.Path)
+	}
+
+	for idx := len(deleted) - 1; idx >= 0; idx-- {
+		entry := deleted[idx]
+		fullpath := filepath.Join(status.sandboxPath, entry.Path)
+
+		info, err := os.Stat(fullpath)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			panic(err)
+		}
+
+		if info.IsDir() {
+			err = os.Remove(fullpath)
+			if err != nil {
+				conflicts.add(entry.Path, "deleted in the stash but there are new files in it")
+				continue
+			}
+		} else {
+			hash, err := hashFile(fullpath)
+			if err != nil {
+				panic(err)
+			}
+
+			if hash != entry.BaseHash {
+				conflicts.add(entry.Path, "deleted in the stash but modified since")
+				continue
+			}
+
+			err = os.Remove(fullpath)
+			if err != nil {
+				panic(err)
+			}
+		}
+
+		fmt.Printf("%v (Deleted)\n", entry.Path)
+	}
+
+	err := status.metaData.save(filepath.Join(status.sandboxPath, metadataFileName))
+	if err != nil {
+		panic(err)
+	}
+
+	return conflicts
+}
+
+// The stashes of the sandbox from oldest to newest
+func listStashes(sandboxPath string) ([]stashManifest, error) {
+	stashes := []stashManifest{}
+
+	entries, err := ioutil.ReadDir(filepath.Join(sandboxPath, stashFolder))
+	if os.IsNotExist(err) {
+		return stashes, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		b, err := ioutil.ReadFile(filepath.Join(sandboxPath, stashFolder, entry.Name(), stashManifestFile))
+		if err != nil {
+			continue
+		}
+
+		manifest := stashManifest{}
+		err = json.Unmarshal(b, &manifest)
+		if err != nil {
+			return nil, err
+		}
+
+		stashes = append(stashes, manifest)
+	}
+
+	sort.Sort(byStashTime(stashes))
+
+	return stashes, nil
+}
+
+// Find the stash with the given name, or the most recent one if no name is
+// given
+func findStash(sandboxPath string, name string) (stashManifest, error) {
+	stashes, err := listStashes(sandboxPath)
+	if err != nil {
+		return stashManifest{}, err
+	}
+
+	if len(stashes) == 0 {
+		return stashManifest{}, simpleWarning("There are no stashes in this sandbox.")
+	}
+
+	if name == "" {
+		return stashes[len(stashes)-1], nil
+	}
+
+	for _, stash := range stashes {
+		if stash.Name == name {
+			return stash, nil
+		}
+	}
+
+	return stashManifest{}, simpleWarning("Stash with name " + name + " not found. Use 'gojazz stash list' to list them.")
+}
+
+type byStashTime []stashManifest
+
+func (stashes byStashTime) Len() int {
+	return len(stashes)
+}
+
+func (stashes byStashTime) Less(i, j int) bool {
+	return stashes[i].Time.Before(stashes[j].Time)
+}
+
+func (stashes byStashTime) Swap(i, j int) {
+	stashes[i], stashes[j] = stashes[j], stashes[i]
+}
@@ -0,0 +1,14 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os"
+)
+
+// Windows doesn't provide a file index through os.FileInfo, the modification
+// time and size are used on their own.
+func fileInode(info os.FileInfo) uint64 {
+	return 0
+}
@@ -8,7 +8,10 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
 )
 
 type mode int
@@ -20,6 +23,13 @@ const (
 	STAGE mode = iota
 	BACKUP
 	NO_COPY
+	// Like NO_COPY but the metadata isn't updated either
+	NO_WRITE
+)
+
+var (
+	// Number of files hashed and directories read at the same time
+	numStatusGoroutines = runtime.NumCPU()
 )
 
 func statusDefaults() {
@@ -32,7 +42,26 @@ type status struct {
 	Modified map[string]bool
 	Deleted  map[string]bool
 
+	// Deleted paths (keys) that were renamed or moved to an added path
+	//  (values). Both paths remain in the Deleted and Added maps.
+	Renamed map[string]string
+
+	// Paths that were skipped by the ignore policy and the reason why
+	Ignored map[string]string
+
 	metaData *metaData
+	policy   *ignorePolicy
+
+	// Paths relative to the sandbox that the status is restricted to, all
+	//  of the sandbox if empty
+	filter []string
+
+	// The stat information of the staged files, taken from the sandbox
+	//  files before they were copied so that a later edit isn't missed
+	staged map[string]os.FileInfo
+
+	// Guards the maps while the sandbox is scanned concurrently
+	mutex sync.Mutex
 
 	sandboxPath string
 	copyPath    string
@@ -43,18 +72,74 @@ func newStatus(sandboxPath string, m mode) *status {
 	status.Added = make(map[string]bool)
 	status.Modified = make(map[string]bool)
 	status.Deleted = make(map[string]bool)
+	status.staged = make(map[string]os.FileInfo)
+	status.Renamed = make(map[string]string)
+	status.Ignored = make(map[string]string)
 
 	status.sandboxPath = sandboxPath
 
 	if m == STAGE {
 		status.copyPath = filepath.Join(status.sandboxPath, stageFolder)
 	} else if m == BACKUP {
-		status.copyPath = filepath.Join(status.sandboxPath, backupFolder)
+		// Each backup is kept separately so that a later one doesn't overwrite it
+		status.copyPath = filepath.Join(status.sandboxPath, backupFolder, newBackupId(sandboxPath))
 	}
 
 	return status
 }
 
+// Check whether a path relative to the sandbox is inside of the paths that
+// the status is restricted to and inside of the sparse paths that the
+// sandbox was loaded with. Directories above those paths need to be
+// descended even though they aren't inside themselves.
+func (status *status) inScope(rel string) (inside bool, descend bool) {
+	inside, descend = pathInScope(status.filter, rel)
+
+	if status.metaData != nil {
+		sparseInside, sparseDescend := pathInScope(status.metaData.sparse, rel)
+		inside = inside && sparseInside
+		descend = descend && sparseDescend
+	}
+
+	return inside, descend
+}
+
+// Check whether a relative path is inside of one of the paths, all paths are
+// inside if there aren't any. Directories above the paths need to be
+// descended to reach them.
+func pathInScope(paths []string, rel string) (inside bool, descend bool) {
+	if len(paths) == 0 {
+		return true, true
+	}
+
+	for _, p := range paths {
+		if rel == p || strings.HasPrefix(rel, p+string(filepath.Separator)) {
+			return true, true
+		}
+
+		if strings.HasPrefix(p, rel+string(filepath.Separator)) {
+			descend = true
+		}
+	}
+
+	return false, descend
+}
+
+// Check whether any of the files that were loaded from the component have
+// been modified or deleted in the sandbox.
+func (status *status) componentChanged(componentId string) bool {
+	for _, changes := range []map[string]bool{status.Modified, status.Deleted} {
+		for p, _ := range changes {
+			meta, ok := status.metaData.pathMap[p]
+			if !ok || meta.ComponentId == componentId {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
 func (status *status) unchanged() bool {
 	return len(status.Added) == 0 && len(status.Modified) == 0 && len(status.Deleted) == 0
 }
@@ -71,25 +156,148 @@ func (status *status) String() string {
 		result = result + "Type: Repository Workspace\n"
 	}
 
-	nochanges := true
+	result = result + status.metaData.configurationString()
+
+	if len(status.metaData.sparse) > 0 {
+		result = result + "Loaded paths: " + strings.Join(status.metaData.sparse, ", ") + "\n"
+	}
+
+	changes := status.changes()
+
+	for _, change := range changes {
+		if change.OldPath != "" {
+			result = result + change.Path + " (" + change.Kind + " from " + change.OldPath + ")\n"
+		} else {
+			result = result + change.Path + " (" + change.Kind + ")\n"
+		}
+	}
+
+	if len(changes) == 0 {
+		result = result + "No local changes\n"
+	}
+
+	return result
+}
+
+// A short, stable format for scripts. Each change is on its own line with a
+// one letter code followed by the path relative to the sandbox root.
+func (status *status) porcelain() string {
+	result := ""
+
+	for _, change := range status.changes() {
+		code := change.Kind[:1]
+		if change.OldPath != "" {
+			result = result + "R " + filepath.ToSlash(change.OldPath) + " -> " + filepath.ToSlash(change.Path) + "\n"
+		} else {
+			result = result + code + " " + filepath.ToSlash(change.Path) + "\n"
+		}
+	}
+
+	return result
+}
+
+func (status *status) summary() string {
+	counts := make(map[string]int)
+	for _, change := range status.changes() {
+		if change.OldPath != "" {
+			counts["Renamed"]++
+		} else {
+			counts[change.Kind]++
+		}
+	}
+
+	return fmt.Sprintf("%v added, %v modified, %v deleted, %v renamed\n", counts["Added"], counts["Modified"], counts["Deleted"], counts["Renamed"])
+}
+
+type statusChange struct {
+	Kind    string
+	Path    string
+	OldPath string
+}
+
+// The changes in the sandbox sorted by path. Renames are reported once
+// rather than as a delete and an add.
+func (status *status) changes() []statusChange {
+	changes := []statusChange{}
 
 	for k, _ := range status.Added {
-		result = result + k + " (Added)\n"
-		nochanges = false
+		if oldPath, ok := status.renamedFrom(k); ok {
+			changes = append(changes, statusChange{Kind: renameKind(oldPath, k), Path: k, OldPath: oldPath})
+			continue
+		}
+		if status.coveredByRename(k) {
+			continue
+		}
+
+		changes = append(changes, statusChange{Kind: "Added", Path: k})
 	}
 
 	for k, _ := range status.Modified {
-		result = result + k + " (Modified)\n"
-		nochanges = false
+		changes = append(changes, statusChange{Kind: "Modified", Path: k})
 	}
 
 	for k, _ := range status.Deleted {
-		result = result + k + " (Deleted)\n"
-		nochanges = false
+		if status.coveredByRename(k) {
+			continue
+		}
+
+		changes = append(changes, statusChange{Kind: "Deleted", Path: k})
 	}
 
-	if nochanges {
-		result = result + "No local changes\n"
+	sort.Sort(byChangePath(changes))
+
+	return changes
+}
+
+type byChangePath []statusChange
+
+func (changes byChangePath) Len() int {
+	return len(changes)
+}
+
+func (changes byChangePath) Less(i, j int) bool {
+	return changes[i].Path < changes[j].Path
+}
+
+func (changes byChangePath) Swap(i, j int) {
+	changes[i], changes[j] = changes[j], changes[i]
+}
+
+// Warnings about the files that were left out for being too large. They
+// are likely to be source so they shouldn't be left out silently.
+func (status *status) largeFileWarnings() string {
+	result := ""
+
+	ignoredPaths := make([]string, 0, len(status.Ignored))
+	for rel, _ := range status.Ignored {
+		ignoredPaths = append(ignoredPaths, rel)
+	}
+	sort.Strings(ignoredPaths)
+	for _, rel := range ignoredPaths {
+		reason := status.Ignored[rel]
+		if reason == status.policy.sizeReason() {
+			result = result + fmt.Sprintf("Warning: %v is %v and will not be checked in. Add '!%v' to %v or raise the 'maxsize' to include it.\n", rel, reason, filepath.ToSlash(rel), sandboxIgnoreFile)
+		}
+	}
+
+	return result
+}
+
+func (status *status) ignoredString() string {
+	result := ""
+
+	ignoredPaths := make([]string, 0, len(status.Ignored))
+	for k, _ := range status.Ignored {
+		ignoredPaths = append(ignoredPaths, k)
+	}
+	sort.Strings(ignoredPaths)
+
+	for _, k := range ignoredPaths {
+		result = result + k + " (Ignored: " + status.Ignored[k] + ")\n"
+	}
+
+	if result == "" {
+		result = "No ignored files\n"
 	}
 
 	return result
@@ -97,9 +305,31 @@ func (status *status) String() string {
 
 func statusOp() {
 	sandboxPath := flag.String("sandbox", "", "Location of the sandbox to load the files")
+	showIgnored := flag.Bool("ignored", false, "List the files that were ignored and the reason why.")
+	full := flag.Bool("full", false, "Hash every file instead of trusting unchanged modification times and sizes.")
+	workers := flag.Int("workers", numStatusGoroutines, "Number of files to hash and directories to read at the same time.")
+	porcelain := flag.Bool("porcelain", false, "Print the changes in a short format that is easy to parse.")
+	summary := flag.Bool("summary", false, "Only print the number of changes of each kind.")
+	remote := flag.Bool("remote", false, "Also show the incoming changes from the repository workspace or stream without loading them.")
+	all := flag.Bool("all", false, "Show the status of all of your sandboxes.")
 	flag.Usage = statusDefaults
 	flag.Parse()
 
+	if *workers > 0 {
+		numStatusGoroutines = *workers
+	}
+
+	if *all {
+		if flag.NArg() > 0 || *sandboxPath != "" || *porcelain {
+			panic(simpleWarning("The status of all sandboxes can't be restricted to paths, a single sandbox or printed with -porcelain."))
+		}
+
+		forEachSandbox(func(sandboxPath string) {
+			showStatus(sandboxPath, nil, *showIgnored, *full, *porcelain, *summary, *remote)
+		})
+		return
+	}
+
 	if *sandboxPath == "" {
 		path, err := os.Getwd()
 		if err != nil {
@@ -110,17 +340,99 @@ func statusOp() {
 		sandboxPath = &path
 	}
 
-	fmt.Printf("Status of %v...\n", *sandboxPath)
-	status, err := scmStatus(*sandboxPath, NO_COPY)
+	filter, err := sandboxRelativePaths(*sandboxPath, flag.Args())
+	if err != nil {
+		panic(err)
+	}
+
+	showStatus(*sandboxPath, filter, *showIgnored, *full, *porcelain, *summary, *remote)
+}
+
+func showStatus(sandboxPath string, filter []string, showIgnored bool, full bool, porcelain bool, summary bool, remote bool) {
+	if !porcelain {
+		fmt.Printf("Status of %v...\n", sandboxPath)
+	}
+	m := NO_COPY
+	if remote {
+		m = NO_WRITE
+	}
+	status, err := scmStatusPaths(sandboxPath, m, full, filter)
 
 	if err != nil {
 		panic(err)
 	}
 
-	fmt.Printf("%v", status)
+	// Scripts reading the porcelain output don't expect anything else in it
+	if !porcelain {
+		fmt.Fprintf(os.Stderr, "%v", status.largeFileWarnings())
+	}
+
+	if porcelain {
+		fmt.Printf("%v", status.porcelain())
+	} else if summary {
+		fmt.Printf("%v", status.summary())
+	} else {
+		fmt.Printf("%v", status)
+	}
+
+	if showIgnored {
+		fmt.Printf("%v", status.ignoredString())
+	}
+
+	if remote {
+		client := newClientForSandbox(status.metaData)
+
+		incoming, err := scmIncoming(client, status)
+		if err != nil {
+			panic(err)
+		}
+
+		if porcelain {
+			fmt.Printf("%v", incoming.porcelain())
+		} else {
+			fmt.Printf("%v", incoming)
+		}
+	}
 }
 
-func scmStatus(sandboxPath string, m mode) (*status, error) {
+// Convert paths provided on the command line (relative to the working
+// directory) into paths relative to the root of the sandbox.
+func sandboxRelativePaths(sandboxPath string, paths []string) ([]string, error) {
+	result := []string{}
+
+	for _, p := range paths {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return nil, err
+		}
+
+		rel, err := filepath.Rel(sandboxPath, abs)
+		if err != nil {
+			return nil, err
+		}
+
+		if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return nil, simpleWarning(fmt.Sprintf("%v is not inside of the sandbox %v", p, sandboxPath))
+		}
+
+		// The whole sandbox
+		if rel == "." {
+			return []string{}, nil
+		}
+
+		result = append(result, rel)
+	}
+
+	return result, nil
+}
+
+func scmStatus(sandboxPath string, m mode, full bool) (*status, error) {
+	return scmStatusPaths(sandboxPath, m, full, nil)
+}
+
+// Find the changes in the sandbox. If any paths (relative to the sandbox) are
+// provided then only those files and directories are checked.
+func scmStatusPaths(sandboxPath string, m mode, full bool, filter []string) (*status, error) {
 	// Load up existing metadata and prepare fresh metadata
 	oldMetaData := newMetaData()
 	// If the load fails, it's not a problem, just empty
@@ -130,8 +442,18 @@ func scmStatus(sandboxPath string, m mode) (*status, error) {
 		return nil, simpleWarning("Not a sandbox")
 	}
 
+	policy, err := loadIgnorePolicy(sandboxPath)
+	if err != nil {
+		return nil, err
+	}
+
+	conflicted := oldMetaData.conflictPaths()
+	policy.conflicted = func(rel string) bool { return conflicted[rel] }
+
 	status := newStatus(sandboxPath, m)
 	status.metaData = oldMetaData
+	status.policy = policy
+	status.filter = filter
 
 	// Delete any existing staging area
 	if m == STAGE {
@@ -141,136 +463,256 @@ func scmStatus(sandboxPath string, m mode) (*status, error) {
 		}
 	}
 
-	// Walk the current directory structure looking for changed items
-	err = filepath.Walk(sandboxPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
+	scan := &statusScan{status: status, full: full}
+	err = scan.run()
+	if err != nil {
+		return nil, err
+	}
+
+	// Walk the metadata to find any items that don't exist. Anything that
+	//  the scan visited is obviously still there.
+	for path, meta := range oldMetaData.pathMap {
+		if scan.visited[path] {
+			continue
 		}
 
-		if path == sandboxPath {
-			return nil
+		if inside, _ := status.inScope(path); !inside {
+			continue
 		}
 
-		ignored, err := IsIgnored(path)
+		fullpath := filepath.Join(sandboxPath, path)
+		_, err := os.Stat(fullpath)
 		if err != nil {
-			return err
+			status.fileDeleted(meta, fullpath, sandboxPath)
 		}
+	}
 
-		if ignored && info.IsDir() {
-			return filepath.SkipDir
-		} else if ignored {
-			return nil
-		}
+	err = status.detectRenames()
+	if err != nil {
+		return nil, err
+	}
 
-		meta, ok := oldMetaData.get(path, sandboxPath)
+	// Write out the refreshed stat information. This is only an optimization
+	//  for the next status so failures are not a problem.
+	if len(scan.refreshed) > 0 {
+		for _, meta := range scan.refreshed {
+			oldMetaData.simplePut(meta, sandboxPath)
+		}
 
-		// Metadata doesn't exist for this file, so it must be added
-		if !ok {
-			status.fileAdded(path, sandboxPath)
-			return nil
+		if m != NO_WRITE {
+			oldMetaData.save(filepath.Join(sandboxPath, metadataFileName))
 		}
+	}
 
-		if !info.IsDir() {
-			// The modified time is not a good enough check to see if the
-			//  file is modified or not.
-			//if meta.LastModified != info.ModTime().Unix() {
-			// Different sizes mean that the file has changed for sure
-			if meta.Size != info.Size() {
-				status.fileModified(meta, path, sandboxPath)
-			} else {
-				// Check the hashes
-				file, err := os.Open(path)
-				if err != nil {
-					return err
-				}
-				defer file.Close()
-
-				hash := sha1.New()
-				_, err = io.Copy(hash, file)
-
-				if err != nil {
-					return err
-				}
-
-				newHash := base64.StdEncoding.EncodeToString(hash.Sum(nil))
-
-				if meta.Hash != newHash {
-					status.fileModified(meta, path, sandboxPath)
-				}
+	return status, nil
+}
+
+// A concurrent scan of the sandbox. Directories are read and files are hashed
+// by a bounded number of goroutines. The scan only records results in the
+// status so the outcome doesn't depend on the order in which work finishes.
+type statusScan struct {
+	status *status
+	full   bool
+
+	// Paths (relative to the sandbox) that were found during the scan
+	visited map[string]bool
+	// Metadata with fresh stat information for files that were hashed
+	//  and found to be unchanged
+	refreshed []metaObject
+
+	mutex     sync.Mutex
+	firstErr  error
+	dirs      sync.WaitGroup
+	dirSem    chan bool
+	hashQueue chan hashRequest
+}
+
+type hashRequest struct {
+	path string
+	// Stat information from before the file was hashed
+	info os.FileInfo
+}
+
+func (scan *statusScan) run() error {
+	scan.visited = make(map[string]bool)
+	scan.dirSem = make(chan bool, numStatusGoroutines)
+	scan.hashQueue = make(chan hashRequest, bufferSize)
+
+	hashers := &sync.WaitGroup{}
+	for i := 0; i < numStatusGoroutines; i++ {
+		hashers.Add(1)
+		go func() {
+			defer hashers.Done()
+
+			for request := range scan.hashQueue {
+				scan.hashFile(request.path, request.info)
 			}
-			//}
-		}
+		}()
+	}
 
-		return nil
-	})
+	scan.dirs.Add(1)
+	go scan.readDir(scan.status.sandboxPath)
+	scan.dirs.Wait()
 
-	if err != nil {
-		return nil, err
+	// All directories are read so nothing else will be queued for hashing
+	close(scan.hashQueue)
+	hashers.Wait()
+
+	return scan.firstErr
+}
+
+func (scan *statusScan) fail(err error) {
+	scan.mutex.Lock()
+	defer scan.mutex.Unlock()
+
+	if scan.firstErr == nil {
+		scan.firstErr = err
 	}
+}
 
-	// Walk the metadata to find any items that don't exist
-	for path, meta := range oldMetaData.pathMap {
-		fullpath := filepath.Join(sandboxPath, path)
-		_, err := os.Stat(fullpath)
-		if err != nil {
-			status.fileDeleted(meta, fullpath, sandboxPath)
-		}
+// Panics in the scanning goroutines can't be recovered by the caller, turn
+// them into an error for the scan instead.
+func (scan *statusScan) recoverFailure() {
+	r := recover()
+	if r == nil {
+		return
 	}
 
-	return status, nil
+	err, ok := r.(error)
+	if !ok {
+		err = fmt.Errorf("%v", r)
+	}
+	scan.fail(err)
 }
 
-func (status *status) calcCopyPath(path string) string {
-	if status.copyPath == "" {
-		return ""
-	}
+func (scan *statusScan) readDir(dir string) {
+	defer scan.dirs.Done()
+	defer scan.recoverFailure()
 
-	relpath, err := filepath.Rel(status.sandboxPath, path)
+	scan.dirSem <- true
+	d, err := os.Open(dir)
+	if err != nil {
+		<-scan.dirSem
+		scan.fail(err)
+		return
+	}
+	infos, err := d.Readdir(-1)
+	d.Close()
+	<-scan.dirSem
 
 	if err != nil {
-		panic(err)
+		scan.fail(err)
+		return
 	}
 
-	return filepath.Join(status.copyPath, relpath)
-}
+	status := scan.status
+	sandboxPath := status.sandboxPath
+
+	for _, info := range infos {
+		path := filepath.Join(dir, info.Name())
+
+		rel, err := filepath.Rel(sandboxPath, path)
+		if err != nil {
+			scan.fail(err)
+			return
+		}
 
-func IsIgnored(path string) (bool, error) {
-	// Should we ignore changes to this file?
-	// Check for signs that it isn't source code
-	//  -Really big file (>10MB)
-	//  -File extension (e.g. .exe, .dll, .so)
-	//  -Temporary files left by editors (e.g. *~, *.ext.swp)
+		inside, descend := status.inScope(rel)
+		if !inside {
+			if descend && info.IsDir() {
+				scan.dirs.Add(1)
+				go scan.readDir(path)
+			}
+			continue
+		}
 
-	base := filepath.Base(path)
+		ignored, reason, err := status.policy.check(path)
+		if err != nil {
+			scan.fail(err)
+			return
+		}
+
+		if ignored {
+			status.fileIgnored(path, sandboxPath, reason)
+			continue
+		}
+
+		scan.mutex.Lock()
+		scan.visited[rel] = true
+		scan.mutex.Unlock()
+
+		meta, ok := status.metaData.get(path, sandboxPath)
+
+		// Metadata doesn't exist for this file, so it must be added
+		if !ok {
+			status.fileAdded(path, sandboxPath)
+		} else if !info.IsDir() {
+			// Different sizes mean that the file has changed for sure
+			if meta.Size != info.Size() {
+				status.fileModified(meta, path, sandboxPath)
+			} else if scan.full || !status.metaData.statUnchanged(meta, info) {
+				scan.hashQueue <- hashRequest{path: path, info: info}
+			}
+		}
 
-	// Skip the metadata, staging and backup directories
-	if base == metadataFileName || strings.Contains(path, stageFolder) || strings.Contains(path, backupFolder) {
-		return true, nil
+		if info.IsDir() {
+			scan.dirs.Add(1)
+			go scan.readDir(path)
+		}
 	}
+}
+
+func (scan *statusScan) hashFile(path string, info os.FileInfo) {
+	defer scan.recoverFailure()
+
+	status := scan.status
+	sandboxPath := status.sandboxPath
 
-	// Skip bin directories
-	if strings.HasSuffix(path, "/bin") || strings.Contains(path, "/bin/") {
-		return true, nil
+	meta, _ := status.metaData.get(path, sandboxPath)
+
+	file, err := os.Open(path)
+	if err != nil {
+		scan.fail(err)
+		return
 	}
+	defer file.Close()
 
-	if strings.HasSuffix(base, ".exe") || strings.HasSuffix(base, ".dll") || strings.HasSuffix(base, ".so") {
-		return true, nil
+	hash := sha1.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		scan.fail(err)
+		return
 	}
 
-	if strings.HasSuffix(base, "~") || strings.HasSuffix(base, ".ext.swp") {
-		return true, nil
+	newHash := base64.StdEncoding.EncodeToString(hash.Sum(nil))
+
+	if meta.Hash != newHash {
+		status.fileModified(meta, path, sandboxPath)
+	} else {
+		// Same contents, refresh the stat information so that
+		//  the next status can skip hashing this file. If the file
+		//  changed while it was being hashed then its modification
+		//  time won't match this and it will be hashed again.
+		meta.setStat(info)
+
+		scan.mutex.Lock()
+		scan.refreshed = append(scan.refreshed, meta)
+		scan.mutex.Unlock()
 	}
+}
 
-	s, err := os.Stat(path)
-	if err != nil {
-		return false, err
+func (status *status) calcCopyPath(path string) string {
+	if status.copyPath == "" {
+		return ""
 	}
 
-	if s.Size() > 10*1024*1024 {
-		return true, nil
+	relpath, err := filepath.Rel(status.sandboxPath, path)
+
+	if err != nil {
+		panic(err)
 	}
 
-	return false, nil
+	return filepath.Join(status.copyPath, relpath)
 }
 
 func (status *status) fileAdded(path string, sandboxPath string) {
@@ -284,7 +726,9 @@ func (status *status) fileAdded(path string, sandboxPath string) {
 		panic(err)
 	}
 
+	status.mutex.Lock()
 	status.Added[rel] = true
+	status.mutex.Unlock()
 	copyPath := status.calcCopyPath(path)
 
 	if copyPath != "" {
@@ -293,6 +737,10 @@ func (status *status) fileAdded(path string, sandboxPath string) {
 		} else {
 			os.MkdirAll(filepath.Dir(copyPath), 0700)
 
+			status.mutex.Lock()
+			status.staged[rel] = s
+			status.mutex.Unlock()
+
 			stagedFile, err := os.Create(copyPath)
 			if err != nil {
 				panic(err)
@@ -318,7 +766,9 @@ func (status *status) fileModified(meta metaObject, path string, sandboxPath str
 		panic(err)
 	}
 
+	status.mutex.Lock()
 	status.Modified[rel] = true
+	status.mutex.Unlock()
 	copyPath := status.calcCopyPath(path)
 
 	if copyPath != "" {
@@ -333,6 +783,10 @@ func (status *status) fileModified(meta metaObject, path string, sandboxPath str
 		} else {
 			os.MkdirAll(filepath.Dir(copyPath), 0700)
 
+			status.mutex.Lock()
+			status.staged[rel] = s
+			status.mutex.Unlock()
+
 			stagedFile, err := os.Create(copyPath)
 			if err != nil {
 				panic(err)
@@ -352,6 +806,22 @@ func (status *status) fileModified(meta metaObject, path string, sandboxPath str
 	}
 }
 
+func (status *status) fileIgnored(path string, sandboxPath string, reason string) {
+	rel, err := filepath.Rel(sandboxPath, path)
+	if err != nil {
+		panic(err)
+	}
+
+	// Metadata is always ignored, there's no need to report it
+	if reason == metadataReason {
+		return
+	}
+
+	status.mutex.Lock()
+	status.Ignored[rel] = reason
+	status.mutex.Unlock()
+}
+
 func (status *status) fileDeleted(meta metaObject, path string, sandboxPath string) {
 	rel, err := filepath.Rel(sandboxPath, path)
 	if err != nil {
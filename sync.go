@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"net/url"
 	"os"
+	"path/filepath"
+	"time"
 )
 
 func syncDefaults() {
@@ -13,10 +15,39 @@ func syncDefaults() {
 }
 
 func syncOp() {
+	operation := commandLine()
 	sandboxPath := flag.String("sandbox", "", "Location of the sandbox to sync the files")
 	force := flag.Bool("force", false, "Don't prompt for anything. Clobber files when necessary.")
+	wait := flag.Duration("wait", 0, "How long to wait for another operation on the sandbox to finish instead of failing right away.")
+	all := flag.Bool("all", false, "Sync all of your sandboxes of repository workspaces.")
+	applyTransferFlags := transferFlags()
 	flag.Usage = syncDefaults
 	flag.Parse()
+	applyTransferFlags()
+
+	if *all {
+		if *sandboxPath != "" {
+			panic(simpleWarning("Use either -all or -sandbox, not both."))
+		}
+
+		forEachSandbox(func(sandboxPath string) {
+			fmt.Printf("Syncing %v...\n", sandboxPath)
+
+			// Sandboxes of streams and snapshots are brought up to date with load
+			metadata := newMetaData()
+			err := metadata.load(filepath.Join(sandboxPath, metadataFileName))
+			if err != nil {
+				panic(simpleWarning("Not a sandbox"))
+			}
+			if metadata.isstream || metadata.readOnly() {
+				fmt.Printf("Skipped, there is nothing to check in from a sandbox of a stream or a snapshot.\n")
+				return
+			}
+
+			syncSandbox(sandboxPath, operation, *force, *wait)
+		})
+		return
+	}
 
 	if *sandboxPath == "" {
 		path, err := os.Getwd()
@@ -28,7 +59,19 @@ func syncOp() {
 		sandboxPath = &path
 	}
 
-	status, err := scmStatus(*sandboxPath, STAGE)
+	syncSandbox(*sandboxPath, operation, *force, *wait)
+}
+
+// Bring in the remote changes and check in the local ones
+func syncSandbox(sandboxPath string, operation string, force bool, wait time.Duration) {
+	lock, err := lockSandbox(sandboxPath, operation, wait)
+	if err != nil {
+		panic(err)
+	}
+	defer lock.unlock()
+
+	// Back up the changes before incoming changes are merged into them
+	status, err := scmBackup(sandboxPath, operation, nil)
 	if err != nil {
 		panic(err)
 	}
@@ -37,6 +80,15 @@ func syncOp() {
 		panic(simpleWarning("Sync is for repository workspaces, use load instead to incrementally update your loaded stream."))
 	}
 
+	if status.metaData.readOnly() {
+		panic(simpleWarning("This sandbox was loaded from a snapshot or baselines, changes to it can't be checked in. Load the latest with 'gojazz load -snapshot=' first."))
+	}
+
+	_, err = pruneBackups(sandboxPath, defaultBackupRetention)
+	if err != nil {
+		panic(err)
+	}
+
 	userId, password, err := getCredentials()
 	if err != nil {
 		panic(err)
@@ -47,14 +99,27 @@ func syncOp() {
 		panic(err)
 	}
 
-	scmCheckin(client, status, *sandboxPath)
+	// Bring in the changes from the repository workspace first so that the
+	//  check-in is based on the latest version of each file
+	options := status.metaData.loadOptions()
+	options.force = force
+	conflicts := scmLoad(client, status.metaData.ccmBaseUrl, status.metaData.projectName, status.metaData.workspaceId, status.metaData.isstream, status.metaData.userId, sandboxPath, status, options)
 
-	// Clear out all of the changes in the status before performing the load
-	status.Added = make(map[string]bool)
-	status.Modified = make(map[string]bool)
-	status.Deleted = make(map[string]bool)
+	if !conflicts.empty() {
+		fmt.Printf("These files were changed both locally and remotely and could not be merged:\n%v", conflicts)
+		fmt.Printf("Your changes have been backed up to this location: %v\n", status.copyPath)
+		panic(simpleWarning("Nothing was checked in. Resolve the conflicts and then sync again."))
+	}
+
+	status, err = scmStatus(sandboxPath, STAGE, false)
+	if err != nil {
+		panic(err)
+	}
 
-	scmLoad(client, status.metaData.ccmBaseUrl, status.metaData.projectName, status.metaData.workspaceId, status.metaData.isstream, status.metaData.userId, *sandboxPath, status, *force)
+	if !status.unchanged() {
+		scmCheckin(client, status, sandboxPath, "")
+	}
+	fmt.Printf("Transferred %v\n", client.Statistics())
 
 	// Force a load/reload of the jazzhub sandbox to avoid out of sync when
 	//  looking at the changes page
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	transferSettingsFile = "transfer.txt"
+)
+
+var (
+	// Files downloaded, remote folders read and files uploaded at the same time
+	numDownloadGoroutines = 10
+	numWalkGoroutines     = 10
+	numUploadGoroutines   = 4
+
+	// Requests started per second and bytes transferred per second, no
+	//  limit if zero
+	requestRateLimit = float64(0)
+	bandwidthLimit   = int64(0)
+)
+
+// Read the transfer settings of the user from ~/.gojazz/transfer.txt. Each
+// line is a setting and its value:
+//
+//	downloads 10
+//	walkers 10
+//	uploads 4
+//	rate 20
+//	bandwidth 5MB
+//
+// The rate is the number of requests per second and the bandwidth the
+// number of bytes per second, in both directions together. The defaults
+// are kept if the settings can't be read.
+func loadTransferSettings() error {
+	usr, err := user.Current()
+	if err != nil {
+		return nil
+	}
+
+	downloads, walkers, uploads, rate, bandwidth := numDownloadGoroutines, numWalkGoroutines, numUploadGoroutines, requestRateLimit, bandwidthLimit
+
+	err = parseTransferSettings(filepath.Join(usr.HomeDir, gojazzDataDir, transferSettingsFile))
+	if err != nil {
+		numDownloadGoroutines, numWalkGoroutines, numUploadGoroutines, requestRateLimit, bandwidthLimit = downloads, walkers, uploads, rate, bandwidth
+	}
+
+	return err
+}
+
+func parseTransferSettings(p string) error {
+	file, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return simpleWarning(fmt.Sprintf("Invalid setting '%v' in %v", line, p))
+		}
+
+		switch fields[0] {
+		case "downloads", "walkers", "uploads":
+			n, err := strconv.Atoi(fields[1])
+			if err != nil || n < 1 {
+				return simpleWarning(fmt.Sprintf("Invalid setting '%v' in %v", line, p))
+			}
+
+			switch fields[0] {
+			case "downloads":
+				numDownloadGoroutines = n
+			case "walkers":
+				numWalkGoroutines = n
+			case "uploads":
+				numUploadGoroutines = n
+			}
+		case "rate":
+			rate, err := strconv.ParseFloat(fields[1], 64)
+			if err != nil || rate < 0 {
+				return simpleWarning(fmt.Sprintf("Invalid setting '%v' in %v", line, p))
+			}
+			requestRateLimit = rate
+		case "bandwidth":
+			bandwidth, err := parseSize(fields[1])
+			if err != nil || bandwidth < 0 {
+				return simpleWarning(fmt.Sprintf("Invalid setting '%v' in %v", line, p))
+			}
+			bandwidthLimit = bandwidth
+		default:
+			return simpleWarning(fmt.Sprintf("Unknown setting '%v' in %v", fields[0], p))
+		}
+	}
+
+	return scanner.Err()
+}
+
+// Define the flags that override the transfer settings for one operation.
+// The returned function applies them once the flags are parsed.
+func transferFlags() func() {
+	downloads := flag.Int("downloads", numDownloadGoroutines, "Number of files to download at the same time.")
+	walkers := flag.Int("walkers", numWalkGoroutines, "Number of remote folders to read at the same time.")
+	uploads := flag.Int("uploads", numUploadGoroutines, "Number of files to upload at the same time.")
+	rate := flag.Float64("rate", requestRateLimit, "Most requests to send to the server per second, 0 for no limit.")
+	bandwidth := flag.String("bandwidth", "", "Most bytes to transfer per second, such as 500KB or 2MB, 0 for no limit.")
+
+	return func() {
+		if *downloads < 1 || *walkers < 1 || *uploads < 1 {
+			panic(simpleWarning("At least one file has to be downloaded, folder read and file uploaded at a time"))
+		}
+		numDownloadGoroutines = *downloads
+		numWalkGoroutines = *walkers
+		numUploadGoroutines = *uploads
+
+		if *rate < 0 {
+			panic(simpleWarning(fmt.Sprintf("Invalid rate %v", *rate)))
+		}
+		requestRateLimit = *rate
+
+		if *bandwidth != "" {
+			limit, err := parseSize(*bandwidth)
+			if err != nil || limit < 0 {
+				panic(simpleWarning("Invalid bandwidth " + *bandwidth))
+			}
+			bandwidthLimit = limit
+		}
+	}
+}
+
+// Spaces out uses of something so that they happen at the given rate
+// per second on average
+type pacer struct {
+	mutex sync.Mutex
+	rate  float64
+	next  time.Time
+}
+
+func newPacer(rate float64) *pacer {
+	if rate <= 0 {
+		return nil
+	}
+
+	return &pacer{rate: rate}
+}
+
+// Reserve an amount and return how long to wait until it can be used
+func (p *pacer) reserve(amount int64) time.Duration {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := time.Now()
+	if p.next.Before(now) {
+		p.next = now
+	}
+
+	start := p.next
+	p.next = p.next.Add(time.Duration(float64(amount) / p.rate * float64(time.Second)))
+
+	return start.Sub(now)
+}
+
+// Counts what the client transferred
+type transferStats struct {
+	start     time.Time
+	requests  int64
+	bytesDown int64
+	bytesUp   int64
+}
+
+func (stats *transferStats) String() string {
+	elapsed := time.Since(stats.start)
+	down := atomic.LoadInt64(&stats.bytesDown)
+	up := atomic.LoadInt64(&stats.bytesUp)
+
+	throughput := int64(0)
+	if elapsed > 0 {
+		throughput = int64(float64(down+up) / elapsed.Seconds())
+	}
+
+	return fmt.Sprintf("%v requests, %v downloaded, %v uploaded in %v (%v/s)", atomic.LoadInt64(&stats.requests), formatSize(down), formatSize(up), elapsed-elapsed%time.Second, formatSize(throughput))
+}
+
+// A transport that limits the rate of the requests and the bandwidth that
+// they use, and counts them
+type limitedTransport struct {
+	transport http.RoundTripper
+	requests  *pacer
+	bandwidth *pacer
+	stats     *transferStats
+}
+
+func (transport *limitedTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if transport.requests != nil {
+		time.Sleep(transport.requests.reserve(1))
+	}
+	atomic.AddInt64(&transport.stats.requests, 1)
+
+	// The request belongs to the caller, the limited body goes on a copy.
+	//  A body that is sent again is limited as well.
+	if request.Body != nil {
+		limited := *request
+		limited.Body = transport.limitUpload(request.Body)
+		if request.GetBody != nil {
+			getBody := request.GetBody
+			limited.GetBody = func() (io.ReadCloser, error) {
+				body, err := getBody()
+				if err != nil {
+					return nil, err
+				}
+				return transport.limitUpload(body), nil
+			}
+		}
+		request = &limited
+	}
+
+	response, err := transport.transport.RoundTrip(request)
+	if err != nil {
+		return nil, err
+	}
+
+	response.Body = &limitedBody{body: response.Body, bandwidth: transport.bandwidth, count: &transport.stats.bytesDown}
+
+	return response, nil
+}
+
+func (transport *limitedTransport) limitUpload(body io.ReadCloser) io.ReadCloser {
+	return &limitedBody{body: body, bandwidth: transport.bandwidth, count: &transport.stats.bytesUp}
+}
+
+// A request or response body that is read no faster than the bandwidth
+type limitedBody struct {
+	body      io.ReadCloser
+	bandwidth *pacer
+	count     *int64
+}
+
+func (body *limitedBody) Read(p []byte) (int, error) {
+	n, err := body.body.Read(p)
+	if n > 0 {
+		atomic.AddInt64(body.count, int64(n))
+		if body.bandwidth != nil {
+			time.Sleep(body.bandwidth.reserve(int64(n)))
+		}
+	}
+
+	return n, err
+}
+
+func (body *limitedBody) Close() error {
+	return body.body.Close()
+}